@@ -1,90 +1,648 @@
 package config
 
 import (
-	"log"
+	"bytes"
+	"errors"
+	"fmt"
+	"log/slog"
 	"os"
 	"strconv"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+	"merged-go-bot/models"
 )
 
 type Config struct {
-	ListenAddr string
-	RedisAddr  string
-	RedisPassword string
-	RedisDB int
-	TelegramBotToken string
-	TelegramWebhookPath string
-	TelegramWebhookURL string
-	AzureOpenAIEndpoint string
-	AzureOpenAIAPIKey string
-	AzureOpenAIAPIVersionChat string
-	DefaultOpenAIDeploymentName string
-	ReservedForResponseTokens int
-	ModelTokenLimits map[string]int
-	MaxContextMessages int
-	TokenWarningThreshold float64
+	ConfigFile                    string
+	ListenAddr                    string
+	RedisAddr                     string
+	RedisPassword                 string
+	RedisDB                       int
+	TelegramBotToken              string
+	TelegramWebhookBaseURL        string
+	TelegramWebhookPath           string
+	TelegramWebhookURL            string
+	AzureOpenAIEndpoint           string
+	AzureOpenAIAPIKey             string
+	AzureOpenAIAPIVersionChat     string
+	DefaultOpenAIDeploymentName   string
+	SystemPrompt                  string
+	ReservedForResponseTokens     int
+	ModelRegistryFile             string
+	Models                        *ModelRegistry
+	MaxContextMessages            int
+	HistoryRetention              string
+	HistoryMaxMessages            int
+	TokenWarningThreshold         float64
 	AzureOpenAISoraDeploymentName string
-	AzureOpenAISoraAPIVersion string
-	SoraDefaultWidth int
-	SoraDefaultHeight int
-	SoraDefaultNSeconds int
-}
-
-func LoadConfig() *Config {
-	cfg := &Config{}
-	
-	cfg.ListenAddr = os.Getenv("LISTEN_ADDR")
-	cfg.RedisAddr = os.Getenv("REDIS_ADDR")
-	cfg.RedisPassword = os.Getenv("REDIS_PASSWORD")
-	cfg.TelegramBotToken = os.Getenv("TELEGRAM_BOT_TOKEN")
-	cfg.AzureOpenAIEndpoint = os.Getenv("AZURE_OPENAI_ENDPOINT")
-	cfg.AzureOpenAIAPIKey = os.Getenv("AZURE_OPENAI_API_KEY")
-	cfg.AzureOpenAIAPIVersionChat = os.Getenv("AZURE_OPENAI_API_VERSION_CHAT")
-	cfg.DefaultOpenAIDeploymentName = os.Getenv("DEFAULT_OPENAI_DEPLOYMENT_NAME")
-	cfg.AzureOpenAISoraDeploymentName = os.Getenv("AZURE_OPENAI_SORA_DEPLOYMENT_NAME")
-	cfg.AzureOpenAISoraAPIVersion = os.Getenv("AZURE_OPENAI_SORA_API_VERSION")
-
-	if cfg.ListenAddr == "" { cfg.ListenAddr = ":8081" }
-	if cfg.RedisAddr == "" { cfg.RedisAddr = "127.0.0.1:6379" }
-	if db, err := strconv.Atoi(os.Getenv("REDIS_DB")); err == nil {
-		cfg.RedisDB = db
-	} else {
-		cfg.RedisDB = 3
+	AzureOpenAISoraAPIVersion     string
+	SoraDefaultWidth              int
+	SoraDefaultHeight             int
+	SoraDefaultNSeconds           int
+	AdminAPIToken                 string
+	DefaultRoomQuota              models.RoomQuota
+	QuotaWarningThresholds        []float64
+	Currency                      string
+	SoraPricePerSecond            float64
+	AzureRequestTimeout           time.Duration
+	AzureVideoDownloadTimeout     time.Duration
+	AzureMaxRetries               int
+	AzureRetryBaseDelay           time.Duration
+	AzureRetryMaxDelay            time.Duration
+	BreakerFailureThreshold       int
+	BreakerCooldown               time.Duration
+	UpdateTimeout                 time.Duration
+	VideoJobTimeout               time.Duration
+	ShutdownTimeout               time.Duration
+	LogLevel                      string
+	LogFormat                     string
+	LogUserContent                bool
+	TracingEndpoint               string
+	TracingInsecure               bool
+	TracingSampleRatio            float64
+	ReadinessTimeout              time.Duration
+	ReadinessAzureProbe           bool
+	ReadinessProbeInterval        time.Duration
+	MaxQueueDepth                 int
+	GroupTriggerMode              string
+	GroupTriggerPrefix            string
+	GroupHistoryScope             string
+	SpeakerAttribution            string
+	PseudonymizeSpeakers          bool
+	InlineEnabled                 bool
+	InlineAllowedUsers            []int64
+	InlineDebounce                time.Duration
+	InlineCacheTTL                time.Duration
+	InlineRateLimit               int
+	InlineRateWindow              time.Duration
+}
+
+// fileConfig 對應選填的 YAML 設定檔；未填寫的欄位保留預設值，環境變數優先於設定檔。
+type fileConfig struct {
+	ListenAddr string `yaml:"listen_addr"`
+	Redis      struct {
+		Addr     string `yaml:"addr"`
+		Password string `yaml:"password"`
+		DB       *int   `yaml:"db"`
+	} `yaml:"redis"`
+	Telegram struct {
+		BotToken       string `yaml:"bot_token"`
+		WebhookBaseURL string `yaml:"webhook_base_url"`
+	} `yaml:"telegram"`
+	Azure struct {
+		Endpoint          string         `yaml:"endpoint"`
+		APIKey            string         `yaml:"api_key"`
+		APIVersionChat    string         `yaml:"api_version_chat"`
+		DefaultDeployment string         `yaml:"default_deployment"`
+		RequestTimeout    *time.Duration `yaml:"request_timeout"`
+		DownloadTimeout   *time.Duration `yaml:"video_download_timeout"`
+		MaxRetries        *int           `yaml:"max_retries"`
+		RetryBaseDelay    *time.Duration `yaml:"retry_base_delay"`
+		RetryMaxDelay     *time.Duration `yaml:"retry_max_delay"`
+		Breaker           struct {
+			FailureThreshold *int           `yaml:"failure_threshold"`
+			Cooldown         *time.Duration `yaml:"cooldown"`
+		} `yaml:"breaker"`
+	} `yaml:"azure"`
+	ModelRegistryFile string `yaml:"model_registry_file"`
+	SystemPrompt      string `yaml:"system_prompt"`
+	Limits            struct {
+		ReservedForResponseTokens *int           `yaml:"reserved_for_response_tokens"`
+		MaxContextMessages        *int           `yaml:"max_context_messages"`
+		HistoryRetention          string         `yaml:"history_retention"`
+		HistoryMaxMessages        *int           `yaml:"history_max_messages"`
+		TokenWarningThreshold     *float64       `yaml:"token_warning_threshold"`
+		UpdateTimeout             *time.Duration `yaml:"update_timeout"`
+		VideoJobTimeout           *time.Duration `yaml:"video_job_timeout"`
+	} `yaml:"limits"`
+	ShutdownTimeout *time.Duration `yaml:"shutdown_timeout"`
+	Sora            struct {
+		Deployment      string   `yaml:"deployment"`
+		APIVersion      string   `yaml:"api_version"`
+		DefaultWidth    *int     `yaml:"default_width"`
+		DefaultHeight   *int     `yaml:"default_height"`
+		DefaultNSeconds *int     `yaml:"default_n_seconds"`
+		PricePerSecond  *float64 `yaml:"price_per_second"`
+	} `yaml:"sora"`
+	Admin struct {
+		APIToken string `yaml:"api_token"`
+	} `yaml:"admin"`
+	Logging struct {
+		Level       string `yaml:"level"`
+		Format      string `yaml:"format"`
+		UserContent *bool  `yaml:"user_content"`
+	} `yaml:"logging"`
+	Tracing struct {
+		OTLPEndpoint string   `yaml:"otlp_endpoint"`
+		Insecure     *bool    `yaml:"insecure"`
+		SampleRatio  *float64 `yaml:"sample_ratio"`
+	} `yaml:"tracing"`
+	Readiness struct {
+		Timeout            *time.Duration `yaml:"timeout"`
+		AzureProbe         *bool          `yaml:"azure_probe"`
+		AzureProbeInterval *time.Duration `yaml:"azure_probe_interval"`
+		MaxQueueDepth      *int           `yaml:"max_queue_depth"`
+	} `yaml:"readiness"`
+	Group struct {
+		TriggerMode   string `yaml:"trigger_mode"`
+		TriggerPrefix string `yaml:"trigger_prefix"`
+		HistoryScope  string `yaml:"history_scope"`
+		// 群組共用歷史時如何標示說話者
+		SpeakerAttribution   string `yaml:"speaker_attribution"`
+		PseudonymizeSpeakers *bool  `yaml:"pseudonymize_speakers"`
+	} `yaml:"group"`
+	Inline struct {
+		Enabled      *bool          `yaml:"enabled"`
+		AllowedUsers []int64        `yaml:"allowed_users"`
+		Debounce     *time.Duration `yaml:"debounce"`
+		CacheTTL     *time.Duration `yaml:"cache_ttl"`
+		RateLimit    *int           `yaml:"rate_limit"`
+		RateWindow   *time.Duration `yaml:"rate_window"`
+	} `yaml:"inline"`
+	Currency string `yaml:"currency"`
+	Quota    struct {
+		Default           *models.RoomQuota `yaml:"default"`
+		WarningThresholds []float64         `yaml:"warning_thresholds"`
+	} `yaml:"quota"`
+}
+
+func defaultConfig() *Config {
+	return &Config{
+		ListenAddr:                ":8081",
+		RedisAddr:                 "127.0.0.1:6379",
+		RedisDB:                   3,
+		ReservedForResponseTokens: 500,
+		MaxContextMessages:        10,
+		HistoryRetention:          "24h",
+		HistoryMaxMessages:        200,
+		TokenWarningThreshold:     0.9,
+		SoraDefaultWidth:          1920,
+		SoraDefaultHeight:         1080,
+		SoraDefaultNSeconds:       10,
+		QuotaWarningThresholds:    []float64{0.8},
+		Currency:                  "USD",
+		AzureRequestTimeout:       60 * time.Second,
+		AzureVideoDownloadTimeout: 5 * time.Minute,
+		AzureMaxRetries:           3,
+		AzureRetryBaseDelay:       500 * time.Millisecond,
+		AzureRetryMaxDelay:        30 * time.Second,
+		BreakerFailureThreshold:   3,
+		BreakerCooldown:           30 * time.Second,
+		UpdateTimeout:             3 * time.Minute,
+		VideoJobTimeout:           20 * time.Minute,
+		ShutdownTimeout:           30 * time.Second,
+		LogLevel:                  "info",
+		LogFormat:                 "json",
+		TracingSampleRatio:        1.0,
+		ReadinessTimeout:          5 * time.Second,
+		ReadinessProbeInterval:    time.Minute,
+		MaxQueueDepth:             100,
+		GroupTriggerMode:          models.TriggerAll,
+		GroupHistoryScope:         models.HistoryShared,
+		SpeakerAttribution:        models.AttributionPrefix,
+		InlineEnabled:             true,
+		InlineDebounce:            700 * time.Millisecond,
+		InlineCacheTTL:            10 * time.Minute,
+		InlineRateLimit:           10,
+		InlineRateWindow:          time.Minute,
 	}
-	if w, err := strconv.Atoi(os.Getenv("SORA_DEFAULT_WIDTH")); err == nil && w > 0 {
-		cfg.SoraDefaultWidth = w
-	} else {
-		cfg.SoraDefaultWidth = 1920
+}
+
+// LoadConfig 依序套用預設值、YAML 設定檔 (path 為空時嘗試 config.yaml) 與環境變數，
+// 並回傳所有驗證錯誤，而不是直接結束程式。
+func LoadConfig(path string) (*Config, error) {
+	cfg := defaultConfig()
+	var errs []error
+
+	if path == "" {
+		if _, err := os.Stat("config.yaml"); err == nil {
+			path = "config.yaml"
+		}
 	}
-	if h, err := strconv.Atoi(os.Getenv("SORA_DEFAULT_HEIGHT")); err == nil && h > 0 {
-		cfg.SoraDefaultHeight = h
-	} else {
-		cfg.SoraDefaultHeight = 1080
+	if path != "" {
+		cfg.ConfigFile = path
+		if err := cfg.applyFile(path); err != nil {
+			errs = append(errs, err)
+		}
 	}
-	if s, err := strconv.Atoi(os.Getenv("SORA_DEFAULT_N_SECONDS")); err == nil && s > 0 {
-		cfg.SoraDefaultNSeconds = s
+
+	errs = append(errs, cfg.applyEnv()...)
+
+	cfg.TelegramWebhookPath = "/telegram_webhook/" + cfg.TelegramBotToken
+	cfg.TelegramWebhookURL = cfg.TelegramWebhookBaseURL + cfg.TelegramWebhookPath
+
+	if cfg.ModelRegistryFile == "" {
+		if _, err := os.Stat("models.yaml"); err == nil {
+			cfg.ModelRegistryFile = "models.yaml"
+		}
+	}
+	if cfg.ModelRegistryFile != "" {
+		registry, err := LoadModelRegistry(cfg.ModelRegistryFile)
+		if err != nil {
+			errs = append(errs, err)
+		}
+		cfg.Models = registry
 	} else {
-		cfg.SoraDefaultNSeconds = 10
+		cfg.Models = DefaultModelRegistry()
 	}
 
-	cfg.TelegramWebhookPath = "/telegram_webhook/" + cfg.TelegramBotToken
-	cfg.TelegramWebhookURL = os.Getenv("TELEGRAM_WEBHOOK_BASE_URL") + cfg.TelegramWebhookPath
-	
-	cfg.ReservedForResponseTokens = 500
-	cfg.MaxContextMessages = 10
-	cfg.TokenWarningThreshold = 0.9
-	cfg.ModelTokenLimits = map[string]int{
-		"gpt-35-turbo": 4096, "gpt-35-turbo-16k": 16384, "gpt-4": 8192,
-		"gpt-4-32k": 32768, "gpt-4o": 128000, "gpt-4o-mini": 128000,
-		"gpt-4.1-nano-deployment": 1000000, "gpt-4.1-nano": 1000000,
+	errs = append(errs, cfg.validate()...)
+	if len(errs) > 0 {
+		return nil, errors.Join(errs...)
+	}
+
+	slog.Info("設定載入成功", "config_file", path, "models", len(cfg.Models.Models))
+	return cfg, nil
+}
+
+func (cfg *Config) applyFile(path string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("讀取設定檔 %s 失敗: %w", path, err)
+	}
+
+	var fc fileConfig
+	dec := yaml.NewDecoder(bytes.NewReader(data))
+	dec.KnownFields(true)
+	if err := dec.Decode(&fc); err != nil {
+		return fmt.Errorf("解析設定檔 %s 失敗: %w", path, err)
+	}
+
+	setString(&cfg.ListenAddr, fc.ListenAddr)
+	setString(&cfg.RedisAddr, fc.Redis.Addr)
+	setString(&cfg.RedisPassword, fc.Redis.Password)
+	setInt(&cfg.RedisDB, fc.Redis.DB)
+	setString(&cfg.TelegramBotToken, fc.Telegram.BotToken)
+	setString(&cfg.TelegramWebhookBaseURL, fc.Telegram.WebhookBaseURL)
+	setString(&cfg.AzureOpenAIEndpoint, fc.Azure.Endpoint)
+	setString(&cfg.AzureOpenAIAPIKey, fc.Azure.APIKey)
+	setString(&cfg.AzureOpenAIAPIVersionChat, fc.Azure.APIVersionChat)
+	setString(&cfg.DefaultOpenAIDeploymentName, fc.Azure.DefaultDeployment)
+	setDuration(&cfg.AzureRequestTimeout, fc.Azure.RequestTimeout)
+	setDuration(&cfg.AzureVideoDownloadTimeout, fc.Azure.DownloadTimeout)
+	setInt(&cfg.AzureMaxRetries, fc.Azure.MaxRetries)
+	setDuration(&cfg.AzureRetryBaseDelay, fc.Azure.RetryBaseDelay)
+	setDuration(&cfg.AzureRetryMaxDelay, fc.Azure.RetryMaxDelay)
+	setInt(&cfg.BreakerFailureThreshold, fc.Azure.Breaker.FailureThreshold)
+	setDuration(&cfg.BreakerCooldown, fc.Azure.Breaker.Cooldown)
+	setString(&cfg.ModelRegistryFile, fc.ModelRegistryFile)
+	setString(&cfg.SystemPrompt, fc.SystemPrompt)
+	setInt(&cfg.ReservedForResponseTokens, fc.Limits.ReservedForResponseTokens)
+	setInt(&cfg.MaxContextMessages, fc.Limits.MaxContextMessages)
+	setString(&cfg.HistoryRetention, fc.Limits.HistoryRetention)
+	setInt(&cfg.HistoryMaxMessages, fc.Limits.HistoryMaxMessages)
+	if fc.Limits.TokenWarningThreshold != nil {
+		cfg.TokenWarningThreshold = *fc.Limits.TokenWarningThreshold
+	}
+	setDuration(&cfg.UpdateTimeout, fc.Limits.UpdateTimeout)
+	setDuration(&cfg.VideoJobTimeout, fc.Limits.VideoJobTimeout)
+	setDuration(&cfg.ShutdownTimeout, fc.ShutdownTimeout)
+	setString(&cfg.AzureOpenAISoraDeploymentName, fc.Sora.Deployment)
+	setString(&cfg.AzureOpenAISoraAPIVersion, fc.Sora.APIVersion)
+	setInt(&cfg.SoraDefaultWidth, fc.Sora.DefaultWidth)
+	setInt(&cfg.SoraDefaultHeight, fc.Sora.DefaultHeight)
+	setInt(&cfg.SoraDefaultNSeconds, fc.Sora.DefaultNSeconds)
+	if fc.Sora.PricePerSecond != nil {
+		cfg.SoraPricePerSecond = *fc.Sora.PricePerSecond
+	}
+	setString(&cfg.LogLevel, fc.Logging.Level)
+	setString(&cfg.LogFormat, fc.Logging.Format)
+	if fc.Logging.UserContent != nil {
+		cfg.LogUserContent = *fc.Logging.UserContent
 	}
+	setString(&cfg.TracingEndpoint, fc.Tracing.OTLPEndpoint)
+	if fc.Tracing.Insecure != nil {
+		cfg.TracingInsecure = *fc.Tracing.Insecure
+	}
+	if fc.Tracing.SampleRatio != nil {
+		cfg.TracingSampleRatio = *fc.Tracing.SampleRatio
+	}
+	setDuration(&cfg.ReadinessTimeout, fc.Readiness.Timeout)
+	if fc.Readiness.AzureProbe != nil {
+		cfg.ReadinessAzureProbe = *fc.Readiness.AzureProbe
+	}
+	setDuration(&cfg.ReadinessProbeInterval, fc.Readiness.AzureProbeInterval)
+	setInt(&cfg.MaxQueueDepth, fc.Readiness.MaxQueueDepth)
+	setString(&cfg.GroupTriggerMode, fc.Group.TriggerMode)
+	setString(&cfg.GroupTriggerPrefix, fc.Group.TriggerPrefix)
+	setString(&cfg.GroupHistoryScope, fc.Group.HistoryScope)
+	setString(&cfg.SpeakerAttribution, fc.Group.SpeakerAttribution)
+	if fc.Group.PseudonymizeSpeakers != nil {
+		cfg.PseudonymizeSpeakers = *fc.Group.PseudonymizeSpeakers
+	}
+	if fc.Inline.Enabled != nil {
+		cfg.InlineEnabled = *fc.Inline.Enabled
+	}
+	if fc.Inline.AllowedUsers != nil {
+		cfg.InlineAllowedUsers = fc.Inline.AllowedUsers
+	}
+	setDuration(&cfg.InlineDebounce, fc.Inline.Debounce)
+	setDuration(&cfg.InlineCacheTTL, fc.Inline.CacheTTL)
+	setInt(&cfg.InlineRateLimit, fc.Inline.RateLimit)
+	setDuration(&cfg.InlineRateWindow, fc.Inline.RateWindow)
+	setString(&cfg.Currency, fc.Currency)
+	setString(&cfg.AdminAPIToken, fc.Admin.APIToken)
+	if fc.Quota.Default != nil {
+		cfg.DefaultRoomQuota = *fc.Quota.Default
+	}
+	if fc.Quota.WarningThresholds != nil {
+		cfg.QuotaWarningThresholds = fc.Quota.WarningThresholds
+	}
+	return nil
+}
+
+func (cfg *Config) applyEnv() []error {
+	var errs []error
+
+	envString(&cfg.ListenAddr, "LISTEN_ADDR")
+	envString(&cfg.RedisAddr, "REDIS_ADDR")
+	envString(&cfg.RedisPassword, "REDIS_PASSWORD")
+	envString(&cfg.TelegramBotToken, "TELEGRAM_BOT_TOKEN")
+	envString(&cfg.TelegramWebhookBaseURL, "TELEGRAM_WEBHOOK_BASE_URL")
+	envString(&cfg.AzureOpenAIEndpoint, "AZURE_OPENAI_ENDPOINT")
+	envString(&cfg.AzureOpenAIAPIKey, "AZURE_OPENAI_API_KEY")
+	envString(&cfg.AzureOpenAIAPIVersionChat, "AZURE_OPENAI_API_VERSION_CHAT")
+	envString(&cfg.DefaultOpenAIDeploymentName, "DEFAULT_OPENAI_DEPLOYMENT_NAME")
+	envString(&cfg.ModelRegistryFile, "MODEL_REGISTRY_FILE")
+	envString(&cfg.SystemPrompt, "SYSTEM_PROMPT")
+	envString(&cfg.AzureOpenAISoraDeploymentName, "AZURE_OPENAI_SORA_DEPLOYMENT_NAME")
+	envString(&cfg.AzureOpenAISoraAPIVersion, "AZURE_OPENAI_SORA_API_VERSION")
+	envString(&cfg.AdminAPIToken, "ADMIN_API_TOKEN")
+	envString(&cfg.Currency, "PRICING_CURRENCY")
+	envString(&cfg.LogLevel, "LOG_LEVEL")
+	envString(&cfg.LogFormat, "LOG_FORMAT")
+	envString(&cfg.TracingEndpoint, "OTLP_TRACES_ENDPOINT")
+	envString(&cfg.GroupTriggerMode, "GROUP_TRIGGER_MODE")
+	envString(&cfg.GroupTriggerPrefix, "GROUP_TRIGGER_PREFIX")
+	envString(&cfg.GroupHistoryScope, "GROUP_HISTORY_SCOPE")
+	envString(&cfg.SpeakerAttribution, "SPEAKER_ATTRIBUTION")
+	envString(&cfg.HistoryRetention, "HISTORY_RETENTION")
+
+	errs = appendErr(errs, envInt(&cfg.RedisDB, "REDIS_DB"))
+	errs = appendErr(errs, envInt(&cfg.ReservedForResponseTokens, "RESERVED_FOR_RESPONSE_TOKENS"))
+	errs = appendErr(errs, envInt(&cfg.MaxContextMessages, "MAX_CONTEXT_MESSAGES"))
+	errs = appendErr(errs, envInt(&cfg.HistoryMaxMessages, "HISTORY_MAX_MESSAGES"))
+	errs = appendErr(errs, envFloat(&cfg.TokenWarningThreshold, "TOKEN_WARNING_THRESHOLD"))
+	errs = appendErr(errs, envInt(&cfg.SoraDefaultWidth, "SORA_DEFAULT_WIDTH"))
+	errs = appendErr(errs, envInt(&cfg.SoraDefaultHeight, "SORA_DEFAULT_HEIGHT"))
+	errs = appendErr(errs, envInt(&cfg.SoraDefaultNSeconds, "SORA_DEFAULT_N_SECONDS"))
+	errs = appendErr(errs, envInt64(&cfg.DefaultRoomQuota.DailyTokens, "DEFAULT_ROOM_DAILY_TOKENS"))
+	errs = appendErr(errs, envInt64(&cfg.DefaultRoomQuota.MonthlyTokens, "DEFAULT_ROOM_MONTHLY_TOKENS"))
+	errs = appendErr(errs, envInt64(&cfg.DefaultRoomQuota.DailyVideoSeconds, "DEFAULT_ROOM_DAILY_VIDEO_SECONDS"))
+	errs = appendErr(errs, envInt64(&cfg.DefaultRoomQuota.MonthlyVideoSeconds, "DEFAULT_ROOM_MONTHLY_VIDEO_SECONDS"))
+	errs = appendErr(errs, envFloatList(&cfg.QuotaWarningThresholds, "QUOTA_WARNING_THRESHOLDS"))
+	errs = appendErr(errs, envFloat(&cfg.SoraPricePerSecond, "SORA_PRICE_PER_SECOND"))
+	errs = appendErr(errs, envDuration(&cfg.AzureRequestTimeout, "AZURE_REQUEST_TIMEOUT"))
+	errs = appendErr(errs, envDuration(&cfg.AzureVideoDownloadTimeout, "AZURE_VIDEO_DOWNLOAD_TIMEOUT"))
+	errs = appendErr(errs, envInt(&cfg.AzureMaxRetries, "AZURE_MAX_RETRIES"))
+	errs = appendErr(errs, envDuration(&cfg.AzureRetryBaseDelay, "AZURE_RETRY_BASE_DELAY"))
+	errs = appendErr(errs, envDuration(&cfg.AzureRetryMaxDelay, "AZURE_RETRY_MAX_DELAY"))
+	errs = appendErr(errs, envInt(&cfg.BreakerFailureThreshold, "BREAKER_FAILURE_THRESHOLD"))
+	errs = appendErr(errs, envDuration(&cfg.BreakerCooldown, "BREAKER_COOLDOWN"))
+	errs = appendErr(errs, envDuration(&cfg.UpdateTimeout, "UPDATE_TIMEOUT"))
+	errs = appendErr(errs, envDuration(&cfg.VideoJobTimeout, "VIDEO_JOB_TIMEOUT"))
+	errs = appendErr(errs, envDuration(&cfg.ShutdownTimeout, "SHUTDOWN_TIMEOUT"))
+	errs = appendErr(errs, envBool(&cfg.LogUserContent, "LOG_USER_CONTENT"))
+	errs = appendErr(errs, envBool(&cfg.TracingInsecure, "OTLP_INSECURE"))
+	errs = appendErr(errs, envBool(&cfg.PseudonymizeSpeakers, "PSEUDONYMIZE_SPEAKERS"))
+	errs = appendErr(errs, envFloat(&cfg.TracingSampleRatio, "TRACE_SAMPLE_RATIO"))
+	errs = appendErr(errs, envDuration(&cfg.ReadinessTimeout, "READINESS_TIMEOUT"))
+	errs = appendErr(errs, envBool(&cfg.ReadinessAzureProbe, "READINESS_AZURE_PROBE"))
+	errs = appendErr(errs, envDuration(&cfg.ReadinessProbeInterval, "READINESS_AZURE_PROBE_INTERVAL"))
+	errs = appendErr(errs, envInt(&cfg.MaxQueueDepth, "READINESS_MAX_QUEUE_DEPTH"))
+	errs = appendErr(errs, envBool(&cfg.InlineEnabled, "INLINE_MODE_ENABLED"))
+	errs = appendErr(errs, envInt64List(&cfg.InlineAllowedUsers, "INLINE_ALLOWED_USERS"))
+	errs = appendErr(errs, envDuration(&cfg.InlineDebounce, "INLINE_DEBOUNCE"))
+	errs = appendErr(errs, envDuration(&cfg.InlineCacheTTL, "INLINE_CACHE_TTL"))
+	errs = appendErr(errs, envInt(&cfg.InlineRateLimit, "INLINE_RATE_LIMIT"))
+	errs = appendErr(errs, envDuration(&cfg.InlineRateWindow, "INLINE_RATE_WINDOW"))
+	return errs
+}
+
+func (cfg *Config) validate() []error {
+	var errs []error
 
 	if cfg.TelegramBotToken == "" {
-		log.Fatal("錯誤：TELEGRAM_BOT_TOKEN 環境變數未設定。")
+		errs = append(errs, fmt.Errorf("錯誤：TELEGRAM_BOT_TOKEN 未設定。"))
 	}
 	if cfg.AzureOpenAIAPIKey == "" || cfg.AzureOpenAIEndpoint == "" {
-		log.Fatal("錯誤：Azure API 相關環境變數未設定。")
+		errs = append(errs, fmt.Errorf("錯誤：Azure API 相關設定 (AZURE_OPENAI_ENDPOINT / AZURE_OPENAI_API_KEY) 未設定。"))
+	}
+	if cfg.DefaultOpenAIDeploymentName != "" && cfg.Models != nil {
+		if _, ok := cfg.Models.Lookup(cfg.DefaultOpenAIDeploymentName); !ok {
+			errs = append(errs, fmt.Errorf("錯誤：預設模型部署 %s 不在模型註冊表中。", cfg.DefaultOpenAIDeploymentName))
+		}
+	}
+	if cfg.RedisDB < 0 {
+		errs = append(errs, fmt.Errorf("錯誤：REDIS_DB 不可為負數。"))
+	}
+	if cfg.ReservedForResponseTokens <= 0 {
+		errs = append(errs, fmt.Errorf("錯誤：reserved_for_response_tokens 必須大於 0。"))
+	}
+	if cfg.MaxContextMessages <= 0 {
+		errs = append(errs, fmt.Errorf("錯誤：max_context_messages 必須大於 0。"))
+	}
+	if cfg.TokenWarningThreshold <= 0 || cfg.TokenWarningThreshold > 1 {
+		errs = append(errs, fmt.Errorf("錯誤：token_warning_threshold 必須介於 0 與 1 之間。"))
+	}
+	if cfg.SoraDefaultWidth <= 0 || cfg.SoraDefaultHeight <= 0 || cfg.SoraDefaultNSeconds <= 0 {
+		errs = append(errs, fmt.Errorf("錯誤：Sora 預設寬度、高度與秒數必須大於 0。"))
+	}
+	if cfg.AzureRequestTimeout <= 0 || cfg.AzureVideoDownloadTimeout <= 0 {
+		errs = append(errs, fmt.Errorf("錯誤：Azure 請求逾時時間必須大於 0。"))
+	}
+	if cfg.AzureMaxRetries < 0 {
+		errs = append(errs, fmt.Errorf("錯誤：AZURE_MAX_RETRIES 不可為負數。"))
+	}
+	if cfg.AzureRetryBaseDelay <= 0 || cfg.AzureRetryMaxDelay < cfg.AzureRetryBaseDelay {
+		errs = append(errs, fmt.Errorf("錯誤：重試延遲必須大於 0，且最大延遲不可小於基本延遲。"))
+	}
+	if cfg.UpdateTimeout <= 0 || cfg.VideoJobTimeout <= 0 || cfg.ShutdownTimeout <= 0 {
+		errs = append(errs, fmt.Errorf("錯誤：更新處理、影片任務與關機逾時時間必須大於 0。"))
+	}
+	if cfg.BreakerFailureThreshold <= 0 || cfg.BreakerCooldown <= 0 {
+		errs = append(errs, fmt.Errorf("錯誤：斷路器失敗門檻與冷卻時間必須大於 0。"))
+	}
+	switch strings.ToLower(cfg.LogLevel) {
+	case "debug", "info", "warn", "error":
+	default:
+		errs = append(errs, fmt.Errorf("錯誤：LOG_LEVEL 必須是 debug、info、warn 或 error。"))
+	}
+	if cfg.LogFormat != "json" && cfg.LogFormat != "text" {
+		errs = append(errs, fmt.Errorf("錯誤：LOG_FORMAT 必須是 json 或 text。"))
 	}
+	if cfg.TracingSampleRatio < 0 || cfg.TracingSampleRatio > 1 {
+		errs = append(errs, fmt.Errorf("錯誤：TRACE_SAMPLE_RATIO 必須介於 0 與 1 之間。"))
+	}
+	if cfg.ReadinessTimeout <= 0 || cfg.ReadinessProbeInterval < 0 || cfg.MaxQueueDepth <= 0 {
+		errs = append(errs, fmt.Errorf("錯誤：就緒檢查逾時與佇列上限必須大於 0，Azure 探測間隔不可為負數。"))
+	}
+	if !models.ValidTriggerMode(cfg.GroupTriggerMode) {
+		errs = append(errs, fmt.Errorf("錯誤：GROUP_TRIGGER_MODE 必須是 all、mention、reply、prefix 或 commands。"))
+	} else if cfg.GroupTriggerMode == models.TriggerPrefix && strings.TrimSpace(cfg.GroupTriggerPrefix) == "" {
+		errs = append(errs, fmt.Errorf("錯誤：GROUP_TRIGGER_MODE 為 prefix 時必須設定 GROUP_TRIGGER_PREFIX。"))
+	}
+	if !models.ValidHistoryScope(cfg.GroupHistoryScope) {
+		errs = append(errs, fmt.Errorf("錯誤：GROUP_HISTORY_SCOPE 必須是 shared、per_user 或 per_thread。"))
+	}
+	if cfg.HistoryMaxMessages <= 0 {
+		errs = append(errs, fmt.Errorf("錯誤：HISTORY_MAX_MESSAGES 必須大於 0。"))
+	}
+	if _, _, err := models.ParseRetention(cfg.HistoryRetention); err != nil {
+		errs = append(errs, fmt.Errorf("錯誤：HISTORY_RETENTION 必須是 ephemeral、forever、N 小時 (例如 12h) 或 N 天 (例如 7d)。"))
+	}
+	if !models.ValidAttribution(cfg.SpeakerAttribution) {
+		errs = append(errs, fmt.Errorf("錯誤：SPEAKER_ATTRIBUTION 必須是 off、name 或 prefix。"))
+	}
+	if cfg.InlineDebounce < 0 || cfg.InlineCacheTTL < 0 || cfg.InlineRateLimit < 0 || cfg.InlineRateWindow <= 0 {
+		errs = append(errs, fmt.Errorf("錯誤：inline 模式的延遲、快取時間與頻率上限不可為負數，頻率計算區間必須大於 0。"))
+	}
+	if cfg.SoraPricePerSecond < 0 {
+		errs = append(errs, fmt.Errorf("錯誤：SORA_PRICE_PER_SECOND 不可為負數。"))
+	}
+	q := cfg.DefaultRoomQuota
+	if q.DailyTokens < 0 || q.MonthlyTokens < 0 || q.DailyVideoSeconds < 0 || q.MonthlyVideoSeconds < 0 {
+		errs = append(errs, fmt.Errorf("錯誤：預設聊天室額度不可為負數。"))
+	}
+	for _, t := range cfg.QuotaWarningThresholds {
+		if t <= 0 || t >= 1 {
+			errs = append(errs, fmt.Errorf("錯誤：額度警告門檻 %v 必須介於 0 與 1 之間。", t))
+		}
+	}
+	return errs
+}
 
-	log.Println("設定載入成功。")
-	return cfg
+func setString(dst *string, v string) {
+	if v != "" {
+		*dst = v
+	}
+}
+
+func setInt(dst *int, v *int) {
+	if v != nil {
+		*dst = *v
+	}
+}
+
+func envString(dst *string, name string) {
+	if v := os.Getenv(name); v != "" {
+		*dst = v
+	}
+}
+
+func envInt(dst *int, name string) error {
+	v := os.Getenv(name)
+	if v == "" {
+		return nil
+	}
+	n, err := strconv.Atoi(v)
+	if err != nil {
+		return fmt.Errorf("錯誤：環境變數 %s 的值 %q 不是整數。", name, v)
+	}
+	*dst = n
+	return nil
+}
+
+func envBool(dst *bool, name string) error {
+	v := os.Getenv(name)
+	if v == "" {
+		return nil
+	}
+	b, err := strconv.ParseBool(v)
+	if err != nil {
+		return fmt.Errorf("錯誤：環境變數 %s 的值 %q 不是布林值 (true/false)。", name, v)
+	}
+	*dst = b
+	return nil
+}
+
+func setDuration(dst *time.Duration, v *time.Duration) {
+	if v != nil {
+		*dst = *v
+	}
+}
+
+// envDuration 解析 time.ParseDuration 格式的值，例如 "30s" 或 "500ms"。
+func envDuration(dst *time.Duration, name string) error {
+	v := os.Getenv(name)
+	if v == "" {
+		return nil
+	}
+	d, err := time.ParseDuration(v)
+	if err != nil {
+		return fmt.Errorf("錯誤：環境變數 %s 的值 %q 不是有效的時間長度 (例如 30s)。", name, v)
+	}
+	*dst = d
+	return nil
+}
+
+func envInt64(dst *int64, name string) error {
+	v := os.Getenv(name)
+	if v == "" {
+		return nil
+	}
+	n, err := strconv.ParseInt(v, 10, 64)
+	if err != nil {
+		return fmt.Errorf("錯誤：環境變數 %s 的值 %q 不是整數。", name, v)
+	}
+	*dst = n
+	return nil
+}
+
+// envFloatList 解析以逗號分隔的數字清單，例如 "0.8,0.95"。
+func envFloatList(dst *[]float64, name string) error {
+	v := os.Getenv(name)
+	if v == "" {
+		return nil
+	}
+	var values []float64
+	for _, part := range strings.Split(v, ",") {
+		f, err := strconv.ParseFloat(strings.TrimSpace(part), 64)
+		if err != nil {
+			return fmt.Errorf("錯誤：環境變數 %s 的值 %q 不是以逗號分隔的數字。", name, v)
+		}
+		values = append(values, f)
+	}
+	*dst = values
+	return nil
+}
+
+// envInt64List 解析以逗號分隔的整數清單，例如 Telegram 使用者 ID "123,456"。
+func envInt64List(dst *[]int64, name string) error {
+	v := os.Getenv(name)
+	if v == "" {
+		return nil
+	}
+	var values []int64
+	for _, part := range strings.Split(v, ",") {
+		n, err := strconv.ParseInt(strings.TrimSpace(part), 10, 64)
+		if err != nil {
+			return fmt.Errorf("錯誤：環境變數 %s 的值 %q 不是以逗號分隔的整數。", name, v)
+		}
+		values = append(values, n)
+	}
+	*dst = values
+	return nil
+}
+
+func envFloat(dst *float64, name string) error {
+	v := os.Getenv(name)
+	if v == "" {
+		return nil
+	}
+	f, err := strconv.ParseFloat(v, 64)
+	if err != nil {
+		return fmt.Errorf("錯誤：環境變數 %s 的值 %q 不是數字。", name, v)
+	}
+	*dst = f
+	return nil
+}
+
+func appendErr(errs []error, err error) []error {
+	if err != nil {
+		return append(errs, err)
+	}
+	return errs
 }
@@ -0,0 +1,178 @@
+package config
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// ModelPricing 為每 1K token 的預估價格，幣別由 Config.Currency 決定。
+type ModelPricing struct {
+	InputPer1K  float64 `json:"input_per_1k" yaml:"input_per_1k"`
+	OutputPer1K float64 `json:"output_per_1k" yaml:"output_per_1k"`
+}
+
+// EstimateCost 依提示與回應 token 數計算預估費用。
+func (p ModelPricing) EstimateCost(promptTokens, completionTokens int) float64 {
+	return float64(promptTokens)/1000*p.InputPer1K + float64(completionTokens)/1000*p.OutputPer1K
+}
+
+type ModelCapabilities struct {
+	Vision    bool `json:"vision" yaml:"vision"`
+	Tools     bool `json:"tools" yaml:"tools"`
+	Streaming bool `json:"streaming" yaml:"streaming"`
+	Reasoning bool `json:"reasoning" yaml:"reasoning"`
+}
+
+// ModelSpec 描述一個 Azure OpenAI 部署 (deployment)。Name 為註冊表中的名稱 (預設與 deployment 相同)，
+// 讓不同區域的同名部署可以並存；Endpoint 與 APIKeyEnv 留空時使用全域設定。
+type ModelSpec struct {
+	Name            string            `json:"name,omitempty" yaml:"name,omitempty"`
+	Deployment      string            `json:"deployment" yaml:"deployment"`
+	Endpoint        string            `json:"endpoint,omitempty" yaml:"endpoint,omitempty"`
+	APIKeyEnv       string            `json:"api_key_env,omitempty" yaml:"api_key_env,omitempty"`
+	Fallbacks       []string          `json:"fallbacks,omitempty" yaml:"fallbacks,omitempty"`
+	Model           string            `json:"model" yaml:"model"`
+	Description     string            `json:"description,omitempty" yaml:"description,omitempty"`
+	ContextWindow   int               `json:"context_window" yaml:"context_window"`
+	MaxOutputTokens int               `json:"max_output_tokens" yaml:"max_output_tokens"`
+	Tokenizer       string            `json:"tokenizer" yaml:"tokenizer"`
+	APIVersion      string            `json:"api_version,omitempty" yaml:"api_version,omitempty"`
+	Pricing         ModelPricing      `json:"pricing" yaml:"pricing"`
+	Capabilities    ModelCapabilities `json:"capabilities" yaml:"capabilities"`
+}
+
+type ModelRegistry struct {
+	Models []ModelSpec `json:"models" yaml:"models"`
+
+	byName map[string]ModelSpec
+}
+
+func DefaultModelRegistry() *ModelRegistry {
+	registry := &ModelRegistry{Models: []ModelSpec{
+		{Deployment: "gpt-35-turbo", Model: "gpt-35-turbo", ContextWindow: 4096, MaxOutputTokens: 4096, Tokenizer: "cl100k_base",
+			Pricing: ModelPricing{InputPer1K: 0.0005, OutputPer1K: 0.0015}, Capabilities: ModelCapabilities{Tools: true, Streaming: true}},
+		{Deployment: "gpt-35-turbo-16k", Model: "gpt-35-turbo-16k", ContextWindow: 16384, MaxOutputTokens: 4096, Tokenizer: "cl100k_base",
+			Pricing: ModelPricing{InputPer1K: 0.003, OutputPer1K: 0.004}, Capabilities: ModelCapabilities{Tools: true, Streaming: true}},
+		{Deployment: "gpt-4", Model: "gpt-4", ContextWindow: 8192, MaxOutputTokens: 8192, Tokenizer: "cl100k_base",
+			Pricing: ModelPricing{InputPer1K: 0.03, OutputPer1K: 0.06}, Capabilities: ModelCapabilities{Tools: true, Streaming: true}},
+		{Deployment: "gpt-4-32k", Model: "gpt-4-32k", ContextWindow: 32768, MaxOutputTokens: 8192, Tokenizer: "cl100k_base",
+			Pricing: ModelPricing{InputPer1K: 0.06, OutputPer1K: 0.12}, Capabilities: ModelCapabilities{Tools: true, Streaming: true}},
+		{Deployment: "gpt-4o", Model: "gpt-4o", ContextWindow: 128000, MaxOutputTokens: 16384, Tokenizer: "o200k_base",
+			Pricing: ModelPricing{InputPer1K: 0.0025, OutputPer1K: 0.01}, Capabilities: ModelCapabilities{Vision: true, Tools: true, Streaming: true}},
+		{Deployment: "gpt-4o-mini", Model: "gpt-4o-mini", ContextWindow: 128000, MaxOutputTokens: 16384, Tokenizer: "o200k_base",
+			Pricing: ModelPricing{InputPer1K: 0.00015, OutputPer1K: 0.0006}, Capabilities: ModelCapabilities{Vision: true, Tools: true, Streaming: true}},
+		{Deployment: "gpt-4.1-nano", Model: "gpt-4.1-nano", ContextWindow: 1047576, MaxOutputTokens: 32768, Tokenizer: "o200k_base",
+			Pricing: ModelPricing{InputPer1K: 0.0001, OutputPer1K: 0.0004}, Capabilities: ModelCapabilities{Vision: true, Tools: true, Streaming: true}},
+	}}
+	registry.index()
+	return registry
+}
+
+// LoadModelRegistry 依副檔名讀取 YAML 或 JSON 格式的模型註冊表。
+func LoadModelRegistry(path string) (*ModelRegistry, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("讀取模型註冊表 %s 失敗: %w", path, err)
+	}
+
+	registry := &ModelRegistry{}
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".json":
+		err = json.Unmarshal(data, registry)
+	case ".yaml", ".yml":
+		err = yaml.Unmarshal(data, registry)
+	default:
+		return nil, fmt.Errorf("不支援的模型註冊表格式: %s", path)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("解析模型註冊表 %s 失敗: %w", path, err)
+	}
+
+	if err := registry.validate(); err != nil {
+		return nil, fmt.Errorf("模型註冊表 %s 無效: %w", path, err)
+	}
+	registry.index()
+	return registry, nil
+}
+
+func (r *ModelRegistry) validate() error {
+	if len(r.Models) == 0 {
+		return fmt.Errorf("未定義任何模型")
+	}
+	seen := make(map[string]bool, len(r.Models))
+	for i, spec := range r.Models {
+		if spec.Deployment == "" {
+			return fmt.Errorf("第 %d 個模型缺少 deployment", i+1)
+		}
+		name := spec.Name
+		if name == "" {
+			name = spec.Deployment
+		}
+		if seen[name] {
+			return fmt.Errorf("模型 %s 重複定義", name)
+		}
+		seen[name] = true
+		if spec.APIKeyEnv != "" && os.Getenv(spec.APIKeyEnv) == "" {
+			return fmt.Errorf("模型 %s 指定的環境變數 %s 未設定", name, spec.APIKeyEnv)
+		}
+		if spec.ContextWindow <= 0 {
+			return fmt.Errorf("deployment %s 的 context_window 必須大於 0", spec.Deployment)
+		}
+		if spec.MaxOutputTokens < 0 {
+			return fmt.Errorf("deployment %s 的 max_output_tokens 不可為負數", spec.Deployment)
+		}
+		if spec.Pricing.InputPer1K < 0 || spec.Pricing.OutputPer1K < 0 {
+			return fmt.Errorf("deployment %s 的價格不可為負數", spec.Deployment)
+		}
+		switch spec.Tokenizer {
+		case "", "cl100k_base", "o200k_base", "p50k_base", "r50k_base":
+		default:
+			return fmt.Errorf("deployment %s 的 tokenizer %q 不受支援", spec.Deployment, spec.Tokenizer)
+		}
+	}
+	for _, spec := range r.Models {
+		for _, fallback := range spec.Fallbacks {
+			if !seen[fallback] {
+				return fmt.Errorf("deployment %s 的備援模型 %s 未定義", spec.Deployment, fallback)
+			}
+		}
+	}
+	return nil
+}
+
+func (r *ModelRegistry) index() {
+	r.byName = make(map[string]ModelSpec, len(r.Models))
+	for _, spec := range r.Models {
+		if spec.Name == "" {
+			spec.Name = spec.Deployment
+		}
+		if spec.Model == "" {
+			spec.Model = spec.Deployment
+		}
+		if spec.Tokenizer == "" {
+			spec.Tokenizer = "cl100k_base"
+		}
+		r.byName[spec.Name] = spec
+	}
+}
+
+func (r *ModelRegistry) Lookup(name string) (ModelSpec, bool) {
+	spec, ok := r.byName[name]
+	return spec, ok
+}
+
+// Deployments 回傳依名稱排序的所有模型名稱。
+func (r *ModelRegistry) Deployments() []string {
+	names := make([]string, 0, len(r.byName))
+	for name := range r.byName {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
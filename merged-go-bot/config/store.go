@@ -0,0 +1,105 @@
+package config
+
+import (
+	"log/slog"
+	"sync/atomic"
+)
+
+// Store 保存目前生效的設定，讓 SIGHUP 重新載入時可以在不中斷連線的情況下替換。
+type Store struct {
+	current atomic.Pointer[Config]
+}
+
+func NewStore(cfg *Config) *Store {
+	s := &Store{}
+	s.current.Store(cfg)
+	return s
+}
+
+func (s *Store) Current() *Config {
+	return s.current.Load()
+}
+
+// Reload 重新讀取設定檔與環境變數，只套用非結構性設定 (模型、價格、限制、額度、提示詞)；
+// 監聽位址、Redis、Telegram 與 Azure 連線設定需重新啟動才會生效。
+func (s *Store) Reload() error {
+	old := s.Current()
+	next, err := LoadConfig(old.ConfigFile)
+	if err != nil {
+		return err
+	}
+
+	for _, name := range structuralChanges(old, next) {
+		slog.Warn("設定已變更，但需重新啟動才會生效", "setting", name)
+	}
+
+	merged := *old
+	merged.ModelRegistryFile = next.ModelRegistryFile
+	merged.Models = next.Models
+	merged.DefaultOpenAIDeploymentName = next.DefaultOpenAIDeploymentName
+	merged.SystemPrompt = next.SystemPrompt
+	merged.ReservedForResponseTokens = next.ReservedForResponseTokens
+	merged.MaxContextMessages = next.MaxContextMessages
+	merged.HistoryRetention = next.HistoryRetention
+	merged.HistoryMaxMessages = next.HistoryMaxMessages
+	merged.TokenWarningThreshold = next.TokenWarningThreshold
+	merged.SoraDefaultWidth = next.SoraDefaultWidth
+	merged.SoraDefaultHeight = next.SoraDefaultHeight
+	merged.SoraDefaultNSeconds = next.SoraDefaultNSeconds
+	merged.DefaultRoomQuota = next.DefaultRoomQuota
+	merged.QuotaWarningThresholds = next.QuotaWarningThresholds
+	merged.Currency = next.Currency
+	merged.SoraPricePerSecond = next.SoraPricePerSecond
+	merged.AzureRequestTimeout = next.AzureRequestTimeout
+	merged.AzureVideoDownloadTimeout = next.AzureVideoDownloadTimeout
+	merged.AzureMaxRetries = next.AzureMaxRetries
+	merged.AzureRetryBaseDelay = next.AzureRetryBaseDelay
+	merged.AzureRetryMaxDelay = next.AzureRetryMaxDelay
+	merged.BreakerFailureThreshold = next.BreakerFailureThreshold
+	merged.BreakerCooldown = next.BreakerCooldown
+	merged.UpdateTimeout = next.UpdateTimeout
+	merged.VideoJobTimeout = next.VideoJobTimeout
+	merged.ShutdownTimeout = next.ShutdownTimeout
+	merged.LogLevel = next.LogLevel
+	merged.LogUserContent = next.LogUserContent
+	merged.ReadinessTimeout = next.ReadinessTimeout
+	merged.ReadinessAzureProbe = next.ReadinessAzureProbe
+	merged.ReadinessProbeInterval = next.ReadinessProbeInterval
+	merged.MaxQueueDepth = next.MaxQueueDepth
+	merged.GroupTriggerMode = next.GroupTriggerMode
+	merged.GroupTriggerPrefix = next.GroupTriggerPrefix
+	merged.GroupHistoryScope = next.GroupHistoryScope
+	merged.SpeakerAttribution = next.SpeakerAttribution
+	merged.PseudonymizeSpeakers = next.PseudonymizeSpeakers
+	merged.InlineEnabled = next.InlineEnabled
+	merged.InlineAllowedUsers = next.InlineAllowedUsers
+	merged.InlineDebounce = next.InlineDebounce
+	merged.InlineCacheTTL = next.InlineCacheTTL
+	merged.InlineRateLimit = next.InlineRateLimit
+	merged.InlineRateWindow = next.InlineRateWindow
+	s.current.Store(&merged)
+
+	slog.Info("設定已重新載入", "models", len(merged.Models.Models), "default_deployment", merged.DefaultOpenAIDeploymentName)
+	return nil
+}
+
+func structuralChanges(old, next *Config) []string {
+	var changed []string
+	check := func(name string, differs bool) {
+		if differs {
+			changed = append(changed, name)
+		}
+	}
+	check("listen_addr", old.ListenAddr != next.ListenAddr)
+	check("redis", old.RedisAddr != next.RedisAddr || old.RedisPassword != next.RedisPassword || old.RedisDB != next.RedisDB)
+	check("telegram", old.TelegramBotToken != next.TelegramBotToken || old.TelegramWebhookURL != next.TelegramWebhookURL)
+	check("azure", old.AzureOpenAIEndpoint != next.AzureOpenAIEndpoint || old.AzureOpenAIAPIKey != next.AzureOpenAIAPIKey ||
+		old.AzureOpenAIAPIVersionChat != next.AzureOpenAIAPIVersionChat)
+	check("sora", old.AzureOpenAISoraDeploymentName != next.AzureOpenAISoraDeploymentName ||
+		old.AzureOpenAISoraAPIVersion != next.AzureOpenAISoraAPIVersion)
+	check("admin", old.AdminAPIToken != next.AdminAPIToken)
+	check("logging.format", old.LogFormat != next.LogFormat)
+	check("tracing", old.TracingEndpoint != next.TracingEndpoint || old.TracingInsecure != next.TracingInsecure ||
+		old.TracingSampleRatio != next.TracingSampleRatio)
+	return changed
+}
@@ -0,0 +1,220 @@
+package handlers
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"strings"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+
+	"merged-go-bot/logging"
+	"merged-go-bot/metrics"
+	"merged-go-bot/models"
+	"merged-go-bot/services"
+	"merged-go-bot/telegram"
+	"merged-go-bot/tracing"
+)
+
+// 回覆按鈕的 callback data，格式為 ai:<動作>
+const (
+	actionPrefix     = "ai:"
+	actionRegenerate = "regenerate"
+	actionContinue   = "continue"
+	actionShorter    = "shorter"
+	actionLonger     = "longer"
+	actionClear      = "clear"
+)
+
+// Telegram 單則訊息的長度上限
+const maxMessageRunes = 4096
+
+// actionInstructions 為改寫回答時附加在上下文最後的指示；不會寫入聊天歷史。
+var actionInstructions = map[string]string{
+	actionContinue: "請從上一則回答中斷的地方直接繼續，不要重複已經寫過的內容。",
+	actionShorter:  "請把上一則回答改寫得更精簡，保留重點。",
+	actionLonger:   "請把上一則回答改寫得更詳細，補充說明與例子。",
+}
+
+// replyKeyboard 為附在 turn 的 AI 回答下方的按鈕。不寫入聊天歷史的回答 (/get) 沒有上下文可清除，不顯示清除按鈕。
+func replyKeyboard(turn *models.Turn) tgbotapi.InlineKeyboardMarkup {
+	row := tgbotapi.NewInlineKeyboardRow(
+		tgbotapi.NewInlineKeyboardButtonData("更短", actionPrefix+actionShorter),
+		tgbotapi.NewInlineKeyboardButtonData("更長", actionPrefix+actionLonger),
+	)
+	if !turn.Standalone {
+		row = append(row, tgbotapi.NewInlineKeyboardButtonData("🧹 清除上下文", actionPrefix+actionClear))
+	}
+	return tgbotapi.NewInlineKeyboardMarkup(
+		tgbotapi.NewInlineKeyboardRow(
+			tgbotapi.NewInlineKeyboardButtonData("🔄 重新產生", actionPrefix+actionRegenerate),
+			tgbotapi.NewInlineKeyboardButtonData("➡️ 繼續", actionPrefix+actionContinue),
+		),
+		row,
+	)
+}
+
+// handleCallbackQuery 處理回答下方的按鈕。只有提問者或群組管理員可以操作，
+// 按鈕對應的一問一答以機器人回覆的訊息 ID 從索引找回。
+func (h *MergedHandler) handleCallbackQuery(parent trace.SpanContext, updateID int, query *tgbotapi.CallbackQuery) {
+	action, ok := strings.CutPrefix(query.Data, actionPrefix)
+	if !ok || query.Message == nil || query.From == nil {
+		return
+	}
+	chatID := query.Message.Chat.ID
+	botMessageID := query.Message.MessageID
+
+	ctx, done, ok := h.tryTrack(chatID, botMessageID, h.cfg.Current().UpdateTimeout)
+	if !ok {
+		ctx = logging.WithCorrelationID(h.baseCtx, fmt.Sprintf("tg-%d", updateID))
+		h.answerCallback(ctx, tgbotapi.NewCallback(query.ID, "這則回答正在處理中，請稍候。"))
+		return
+	}
+	defer done()
+	ctx = logging.WithCorrelationID(ctx, fmt.Sprintf("tg-%d", updateID))
+	ctx, span := tracing.Start(trace.ContextWithSpanContext(ctx, parent), "telegram.callback_query",
+		attribute.Int("telegram.update_id", updateID), attribute.Int64("chat.id", chatID), attribute.String("action", action))
+	defer span.End()
+	slog.InfoContext(ctx, "收到回覆按鈕操作", "chat_id", chatID, "message_id", botMessageID, "user_id", query.From.ID, "action", action)
+
+	turn, err := h.redisSvc.GetTurn(ctx, chatID, botMessageID)
+	if err != nil {
+		slog.ErrorContext(ctx, "查詢按鈕對應的對話失敗", "chat_id", chatID, "message_id", botMessageID, "error", err)
+		h.answerCallback(ctx, tgbotapi.NewCallback(query.ID, "無法處理，請稍後再試。"))
+		return
+	}
+	if turn == nil || turn.BotMessageID != botMessageID {
+		h.answerCallback(ctx, tgbotapi.NewCallbackWithAlert(query.ID, "這則回答已過期，無法再操作。"))
+		return
+	}
+	if query.From.ID != turn.User.UserID && (query.Message.Chat.IsPrivate() || !h.isMemberAdmin(ctx, chatID, query.From.ID)) {
+		h.answerCallback(ctx, tgbotapi.NewCallbackWithAlert(query.ID, "只有提問者或群組管理員可以使用這些按鈕。"))
+		return
+	}
+	// 回覆與聊天歷史都在原本提問的論壇主題中
+	ctx = telegram.WithTopic(ctx, turn.History.TopicID)
+
+	unlock, ok := h.lockChat(ctx, chatID)
+	if !ok {
+		return
+	}
+	defer unlock()
+
+	roomConfig, err := h.redisSvc.GetRoomConfig(ctx, chatID)
+	if err != nil {
+		slog.ErrorContext(ctx, "從 Redis 獲取聊天室配置失敗", "chat_id", chatID, "error", err)
+		h.answerCallback(ctx, tgbotapi.NewCallback(query.ID, "無法處理，請稍後再試。"))
+		return
+	}
+	if roomConfig == nil || !roomConfig.Approved {
+		h.answerCallback(ctx, tgbotapi.NewCallbackWithAlert(query.ID, "此聊天室未被授權使用 AI 功能。"))
+		return
+	}
+
+	metrics.CommandsHandled.WithLabelValues("button_" + action).Inc()
+	switch action {
+	case actionClear:
+		// 與 /clear 相同：共用的聊天歷史只有群組管理員可以清除
+		if turn.Standalone {
+			h.answerCallback(ctx, tgbotapi.NewCallbackWithAlert(query.ID, "這則回答沒有寫入聊天歷史，沒有上下文可清除。"))
+			return
+		}
+		if turn.History.UserID == 0 && turn.History.RootID == 0 && !query.Message.Chat.IsPrivate() && !h.isMemberAdmin(ctx, chatID, query.From.ID) {
+			h.answerCallback(ctx, tgbotapi.NewCallbackWithAlert(query.ID, "此群組共用聊天歷史，只有群組管理員可以清除。"))
+			return
+		}
+		if err := h.redisSvc.ClearMessages(ctx, turn.History); err != nil {
+			slog.ErrorContext(ctx, "清除聊天歷史失敗", "chat_id", chatID, "error", err)
+			h.answerCallback(ctx, tgbotapi.NewCallback(query.ID, "無法清除聊天歷史，請稍後再試。"))
+			return
+		}
+		slog.InfoContext(ctx, "已由按鈕清除聊天歷史", "chat_id", chatID, "user_id", query.From.ID)
+		h.answerCallback(ctx, tgbotapi.NewCallback(query.ID, "聊天歷史已清除。"))
+	case actionRegenerate, actionContinue, actionShorter, actionLonger:
+		// 先回應按鈕，讓 Telegram 停止顯示載入中
+		h.answerCallback(ctx, tgbotapi.NewCallback(query.ID, "處理中…"))
+		h.reviseAnswer(ctx, roomConfig, query.Message.Chat, query.From.ID, turn, action)
+	default:
+		h.answerCallback(ctx, tgbotapi.NewCallback(query.ID, "未知的操作。"))
+	}
+}
+
+// reviseAnswer 依按鈕重新產生、延續或改寫 turn 的回答。這一輪仍在聊天歷史中時以它之前的訊息為上下文，
+// 並以新的回答取代歷史中的舊回答。
+func (h *MergedHandler) reviseAnswer(ctx context.Context, roomConfig *models.RoomConfig, chat *tgbotapi.Chat, userID int64, turn *models.Turn, action string) {
+	chatID := chat.ID
+	history, err := h.redisSvc.GetMessages(ctx, turn.History)
+	if err != nil {
+		slog.ErrorContext(ctx, "獲取聊天歷史失敗", "chat_id", chatID, "error", err)
+		return
+	}
+	idx := findTurn(history, turn)
+	var messages []models.Message
+	if idx >= 0 {
+		messages = append(messages, history[:idx]...)
+	}
+	messages = append(messages, turn.User)
+	if instruction, ok := actionInstructions[action]; ok {
+		messages = append(messages, turn.Assistant, models.Message{Role: "user", Content: instruction})
+	}
+
+	if !h.checkQuota(ctx, roomConfig, services.QuotaUnitTokens, 0) {
+		return
+	}
+	response, err := h.openaiSvc.GetChatCompletion(ctx, "", h.modelChain(ctx, roomConfig),
+		withSystemPrompt(h.systemPrompt(ctx, roomConfig), h.attributeSpeakers(roomConfig, chat, messages)))
+	if err != nil {
+		slog.ErrorContext(ctx, "重新產生回答失敗", "chat_id", chatID, "action", action, "error", err)
+		h.replyError(ctx, chatID, "從 AI 獲取回應時發生錯誤。")
+		return
+	}
+	h.recordChatUsage(ctx, chatID, userID, response)
+
+	content := response.Content
+	if action == actionContinue {
+		content = turn.Assistant.Content + response.Content
+		if len([]rune(content)) > maxMessageRunes {
+			h.sendContinuation(ctx, roomConfig, turn, content, response.Content)
+			h.warnQuota(ctx, roomConfig, services.QuotaUnitTokens)
+			return
+		}
+	}
+	if h.replaceTurn(ctx, roomConfig, turn, turn.User, assistantMessage(content)) {
+		slog.InfoContext(ctx, "已依按鈕更新回答", "chat_id", chatID, "bot_message_id", turn.BotMessageID, "action", action, "in_history", idx >= 0)
+	}
+	h.warnQuota(ctx, roomConfig, services.QuotaUnitTokens)
+}
+
+// sendContinuation 在延續後的回答超過單則訊息上限時，把延續的部分以新訊息回覆原本的回答。
+// 聊天歷史中仍保存完整的回答；原本的索引改為完整的回答，讓編輯提問時仍找得到歷史中的這一輪。
+// 新訊息只以自己的訊息 ID 建立索引，讓按鈕可以繼續使用，而不會取代使用者訊息指向原本回覆的索引。
+func (h *MergedHandler) sendContinuation(ctx context.Context, roomConfig *models.RoomConfig, turn *models.Turn, content, continuation string) {
+	chatID := turn.History.ChatID
+	assistantMsg := assistantMessage(content)
+	h.rewriteTurn(ctx, roomConfig, turn, turn.User, assistantMsg)
+	msg := tgbotapi.NewMessage(chatID, continuation)
+	msg.ReplyToMessageID = turn.BotMessageID
+	msg.ReplyMarkup = replyKeyboard(turn)
+	sent, err := h.send(ctx, msg)
+	if err != nil {
+		return
+	}
+	original := *turn
+	original.Assistant = assistantMsg
+	h.saveTurn(ctx, roomConfig, &original)
+	h.saveTurn(ctx, roomConfig, &models.Turn{
+		History:      turn.History,
+		BotMessageID: sent.MessageID,
+		User:         turn.User,
+		Assistant:    assistantMsg,
+		Standalone:   turn.Standalone,
+	})
+}
+
+func (h *MergedHandler) answerCallback(ctx context.Context, c tgbotapi.CallbackConfig) {
+	if err := h.request(ctx, "callback", c); err != nil {
+		slog.WarnContext(ctx, "回應按鈕操作失敗", "error", err)
+	}
+}
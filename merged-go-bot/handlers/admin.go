@@ -0,0 +1,465 @@
+package handlers
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"merged-go-bot/config"
+	"merged-go-bot/models"
+	"merged-go-bot/services"
+)
+
+type AdminHandler struct {
+	cfg      *config.Store
+	redisSvc *services.RedisService
+}
+
+func NewAdminHandler(cfg *config.Store, redisSvc *services.RedisService) *AdminHandler {
+	if cfg.Current().AdminAPIToken == "" {
+		slog.Warn("未設定 ADMIN_API_TOKEN，管理員 API (Admin API) 的所有請求都會被拒絕")
+	}
+	return &AdminHandler{
+		cfg:      cfg,
+		redisSvc: redisSvc,
+	}
+}
+
+// authorize 要求 "Authorization: Bearer <token>"。未設定 ADMIN_API_TOKEN 時一律拒絕，
+// 管理員 API 與 Telegram webhook 共用同一個對外的 listener，不能預設開放。
+func (h *AdminHandler) authorize(w http.ResponseWriter, r *http.Request) bool {
+	token := h.cfg.Current().AdminAPIToken
+	if token == "" {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return false
+	}
+	given := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if subtle.ConstantTimeCompare([]byte(given), []byte(token)) != 1 {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return false
+	}
+	return true
+}
+
+type roomUsage struct {
+	ChatID int64                `json:"chat_id"`
+	Usage  *models.UsageSummary `json:"usage"`
+}
+
+// HandleUsage 回傳指定期間的用量：
+// GET /admin/usage?chat_id=<id>&user_id=<id>&from=YYYY-MM-DD&to=YYYY-MM-DD
+// 未指定 chat_id 時回傳所有聊天室的用量及總計。
+func (h *AdminHandler) HandleUsage(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if !h.authorize(w, r) {
+		return
+	}
+
+	from, to, err := parseDateRange(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	query := r.URL.Query()
+	var chatID, userID int64
+	if v := query.Get("chat_id"); v != "" {
+		if chatID, err = strconv.ParseInt(v, 10, 64); err != nil {
+			http.Error(w, "Invalid chat_id", http.StatusBadRequest)
+			return
+		}
+	}
+	if v := query.Get("user_id"); v != "" {
+		if userID, err = strconv.ParseInt(v, 10, 64); err != nil {
+			http.Error(w, "Invalid user_id", http.StatusBadRequest)
+			return
+		}
+	}
+
+	var result interface{}
+	switch {
+	case chatID != 0 && userID != 0:
+		usage, err := h.redisSvc.GetRoomUserUsage(r.Context(), chatID, userID, from, to)
+		if err != nil {
+			slog.ErrorContext(r.Context(), "獲取聊天室使用者用量失敗", "chat_id", chatID, "user_id", userID, "error", err)
+			http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+			return
+		}
+		usage.Currency = h.cfg.Current().Currency
+		result = map[string]interface{}{"chat_id": chatID, "user_id": userID, "usage": usage}
+	case chatID != 0:
+		usage, err := h.redisSvc.GetRoomUsage(r.Context(), chatID, from, to)
+		if err != nil {
+			slog.ErrorContext(r.Context(), "獲取聊天室用量失敗", "chat_id", chatID, "error", err)
+			http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+			return
+		}
+		usage.Currency = h.cfg.Current().Currency
+		result = roomUsage{ChatID: chatID, Usage: usage}
+	case userID != 0:
+		usage, err := h.redisSvc.GetUserUsage(r.Context(), userID, from, to)
+		if err != nil {
+			slog.ErrorContext(r.Context(), "獲取使用者用量失敗", "user_id", userID, "error", err)
+			http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+			return
+		}
+		usage.Currency = h.cfg.Current().Currency
+		result = map[string]interface{}{"user_id": userID, "usage": usage}
+	default:
+		rooms, total, err := h.allRoomUsage(r.Context(), from, to)
+		if err != nil {
+			slog.ErrorContext(r.Context(), "獲取所有聊天室用量失敗", "error", err)
+			http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+			return
+		}
+		result = map[string]interface{}{"rooms": rooms, "total": total}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(result); err != nil {
+		slog.ErrorContext(r.Context(), "編碼用量回應失敗", "error", err)
+	}
+}
+
+func (h *AdminHandler) allRoomUsage(ctx context.Context, from, to time.Time) ([]roomUsage, *models.UsageSummary, error) {
+	chatIDs, err := h.redisSvc.GetUsageRooms(ctx)
+	if err != nil {
+		return nil, nil, err
+	}
+	sort.Slice(chatIDs, func(i, j int) bool { return chatIDs[i] < chatIDs[j] })
+
+	currency := h.cfg.Current().Currency
+	total := &models.UsageSummary{From: from.Format("2006-01-02"), To: to.Format("2006-01-02"), Currency: currency}
+	rooms := make([]roomUsage, 0, len(chatIDs))
+	for _, chatID := range chatIDs {
+		usage, err := h.redisSvc.GetRoomUsage(ctx, chatID, from, to)
+		if err != nil {
+			return nil, nil, err
+		}
+		if usage.Requests == 0 && usage.VideoJobs == 0 {
+			continue
+		}
+		usage.Currency = currency
+		total.Add(usage)
+		rooms = append(rooms, roomUsage{ChatID: chatID, Usage: usage})
+	}
+	return rooms, total, nil
+}
+
+// HandleUsageExport 以 CSV 匯出指定月份各聊天室的用量與預估費用，供財務分攤成本：
+// GET /admin/usage/export?month=YYYY-MM (預設為本月)
+func (h *AdminHandler) HandleUsageExport(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if !h.authorize(w, r) {
+		return
+	}
+
+	now := time.Now()
+	month := time.Date(now.Year(), now.Month(), 1, 0, 0, 0, 0, now.Location())
+	if v := r.URL.Query().Get("month"); v != "" {
+		t, err := time.ParseInLocation("2006-01", v, time.Local)
+		if err != nil {
+			http.Error(w, "Invalid month, expected YYYY-MM", http.StatusBadRequest)
+			return
+		}
+		month = t
+	}
+	from := month
+	to := month.AddDate(0, 1, -1)
+
+	rooms, total, err := h.allRoomUsage(r.Context(), from, to)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "匯出用量失敗", "month", month.Format("2006-01"), "error", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/csv; charset=utf-8")
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=\"usage-%s.csv\"", month.Format("2006-01")))
+
+	cw := csv.NewWriter(w)
+	cw.Write([]string{"month", "chat_id", "requests", "prompt_tokens", "completion_tokens", "total_tokens", "video_jobs", "video_seconds", "estimated_cost", "currency"})
+	writeRow := func(chatID string, u *models.UsageSummary) {
+		cw.Write([]string{
+			month.Format("2006-01"),
+			chatID,
+			strconv.FormatInt(u.Requests, 10),
+			strconv.FormatInt(u.PromptTokens, 10),
+			strconv.FormatInt(u.CompletionTokens, 10),
+			strconv.FormatInt(u.TotalTokens, 10),
+			strconv.FormatInt(u.VideoJobs, 10),
+			strconv.FormatInt(u.VideoSeconds, 10),
+			strconv.FormatFloat(u.EstimatedCost, 'f', 6, 64),
+			total.Currency,
+		})
+	}
+	for _, room := range rooms {
+		writeRow(strconv.FormatInt(room.ChatID, 10), room.Usage)
+	}
+	writeRow("total", total)
+	cw.Flush()
+	if err := cw.Error(); err != nil {
+		slog.ErrorContext(r.Context(), "寫入 CSV 失敗", "error", err)
+	}
+}
+
+// parseDateRange 解析 from/to 參數，預設為本月初至今日。
+func parseDateRange(r *http.Request) (time.Time, time.Time, error) {
+	today := startOfDay(time.Now())
+	from := time.Date(today.Year(), today.Month(), 1, 0, 0, 0, 0, today.Location())
+	to := today
+
+	query := r.URL.Query()
+	if v := query.Get("from"); v != "" {
+		t, err := time.ParseInLocation("2006-01-02", v, time.Local)
+		if err != nil {
+			return from, to, fmt.Errorf("Invalid from date, expected YYYY-MM-DD")
+		}
+		from = t
+	}
+	if v := query.Get("to"); v != "" {
+		t, err := time.ParseInLocation("2006-01-02", v, time.Local)
+		if err != nil {
+			return from, to, fmt.Errorf("Invalid to date, expected YYYY-MM-DD on or after from")
+		}
+		to = t
+	}
+	if to.Before(from) {
+		return from, to, fmt.Errorf("Invalid to date, expected YYYY-MM-DD on or after from")
+	}
+	if to.Sub(from) > 366*24*time.Hour {
+		return from, to, fmt.Errorf("Date range too long, maximum is 366 days")
+	}
+	return from, to, nil
+}
+
+// HandleExportHistory 匯出聊天室的聊天歷史供客服調查：
+// GET /admin/history/export?chat_id=<id>&format=md|json|html&topic_id=&user_id=&root_id=&conversation_id=
+// 未指定的範圍參數為 0，也就是聊天室共用歷史的預設對話。
+func (h *AdminHandler) HandleExportHistory(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if !h.authorize(w, r) {
+		return
+	}
+
+	query := r.URL.Query()
+	key := models.HistoryKey{}
+	var err error
+	if key.ChatID, err = strconv.ParseInt(query.Get("chat_id"), 10, 64); err != nil || key.ChatID == 0 {
+		http.Error(w, "Invalid chat_id", http.StatusBadRequest)
+		return
+	}
+	for name, dst := range map[string]*int{"topic_id": &key.TopicID, "root_id": &key.RootID, "conversation_id": &key.ConversationID} {
+		if v := query.Get(name); v != "" {
+			if *dst, err = strconv.Atoi(v); err != nil {
+				http.Error(w, "Invalid "+name, http.StatusBadRequest)
+				return
+			}
+		}
+	}
+	if v := query.Get("user_id"); v != "" {
+		if key.UserID, err = strconv.ParseInt(v, 10, 64); err != nil {
+			http.Error(w, "Invalid user_id", http.StatusBadRequest)
+			return
+		}
+	}
+	format := query.Get("format")
+	if format == "" {
+		format = exportJSON
+	}
+	if !validExportFormat(format) {
+		http.Error(w, "Invalid format, expected md, json or html", http.StatusBadRequest)
+		return
+	}
+
+	messages, err := h.redisSvc.GetMessages(r.Context(), key)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "獲取聊天歷史失敗", "chat_id", key.ChatID, "error", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	if len(messages) == 0 {
+		http.Error(w, "No chat history", http.StatusNotFound)
+		return
+	}
+	data, contentType, err := renderExport(format, historyTitle(r.Context(), h.redisSvc, key), key, messages)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "匯出聊天歷史失敗", "chat_id", key.ChatID, "format", format, "error", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	slog.InfoContext(r.Context(), "管理員匯出聊天歷史", "chat_id", key.ChatID, "format", format, "messages", len(messages))
+	w.Header().Set("Content-Type", contentType+"; charset=utf-8")
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", exportFileName(key, format)))
+	w.Write(data)
+}
+
+// HandleSetRoomQuota 設定聊天室額度：
+// POST /admin/set_room_quota {"chat_id": <id>, "quota": {"daily_tokens": 100000, ...}}
+// quota 為 null 時改回使用全域預設額度。
+func (h *AdminHandler) HandleSetRoomQuota(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if !h.authorize(w, r) {
+		return
+	}
+
+	var req struct {
+		ChatID int64             `json:"chat_id"`
+		Quota  *models.RoomQuota `json:"quota"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.ChatID == 0 {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	if q := req.Quota; q != nil && (q.DailyTokens < 0 || q.MonthlyTokens < 0 || q.DailyVideoSeconds < 0 || q.MonthlyVideoSeconds < 0) {
+		http.Error(w, "Quota values must not be negative", http.StatusBadRequest)
+		return
+	}
+
+	roomConfig, err := h.redisSvc.GetRoomConfig(r.Context(), req.ChatID)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "獲取聊天室配置失敗", "chat_id", req.ChatID, "error", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	if roomConfig == nil {
+		http.Error(w, "Room not found", http.StatusNotFound)
+		return
+	}
+
+	roomConfig.Quota = req.Quota
+	if err := h.redisSvc.SaveRoomConfig(r.Context(), roomConfig); err != nil {
+		slog.ErrorContext(r.Context(), "無法保存聊天室額度", "chat_id", req.ChatID, "error", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+	fmt.Fprintf(w, "聊天室 %d 額度已更新。", req.ChatID)
+	slog.InfoContext(r.Context(), "聊天室額度已更新", "chat_id", req.ChatID, "quota", req.Quota)
+}
+
+type topicInfo struct {
+	TopicID int `json:"topic_id"`
+	models.TopicConfig
+}
+
+// HandleTopics 列出聊天室中已知的論壇主題及其設定：GET /admin/topics?chat_id=<id>
+func (h *AdminHandler) HandleTopics(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if !h.authorize(w, r) {
+		return
+	}
+
+	chatID, err := strconv.ParseInt(r.URL.Query().Get("chat_id"), 10, 64)
+	if err != nil || chatID == 0 {
+		http.Error(w, "Invalid chat_id", http.StatusBadRequest)
+		return
+	}
+	roomConfig, err := h.redisSvc.GetRoomConfig(r.Context(), chatID)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "獲取聊天室配置失敗", "chat_id", chatID, "error", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	if roomConfig == nil {
+		http.Error(w, "Room not found", http.StatusNotFound)
+		return
+	}
+
+	topics := make([]topicInfo, 0, len(roomConfig.Topics))
+	for id, topic := range roomConfig.Topics {
+		topics = append(topics, topicInfo{TopicID: id, TopicConfig: *topic})
+	}
+	sort.Slice(topics, func(i, j int) bool { return topics[i].TopicID < topics[j].TopicID })
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(map[string]interface{}{"chat_id": chatID, "topics": topics}); err != nil {
+		slog.ErrorContext(r.Context(), "編碼主題列表失敗", "error", err)
+	}
+}
+
+// HandleSetTopicConfig 設定論壇主題的模型與系統提示詞：
+// POST /admin/set_topic_config {"chat_id": <id>, "topic_id": <message_thread_id>, "model_name": "...", "system_prompt": "..."}
+// 空白欄位表示沿用聊天室或全域設定；"reset": true 時刪除主題的設定。
+func (h *AdminHandler) HandleSetTopicConfig(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if !h.authorize(w, r) {
+		return
+	}
+
+	var req struct {
+		ChatID       int64   `json:"chat_id"`
+		TopicID      int     `json:"topic_id"`
+		Name         *string `json:"name"`
+		ModelName    string  `json:"model_name"`
+		SystemPrompt string  `json:"system_prompt"`
+		Reset        bool    `json:"reset"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.ChatID == 0 || req.TopicID == 0 {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	if req.ModelName != "" {
+		if _, ok := h.cfg.Current().Models.Lookup(req.ModelName); !ok {
+			http.Error(w, "Unknown model_name", http.StatusBadRequest)
+			return
+		}
+	}
+
+	roomConfig, err := h.redisSvc.GetRoomConfig(r.Context(), req.ChatID)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "獲取聊天室配置失敗", "chat_id", req.ChatID, "error", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	if roomConfig == nil {
+		http.Error(w, "Room not found", http.StatusNotFound)
+		return
+	}
+
+	if req.Reset {
+		delete(roomConfig.Topics, req.TopicID)
+	} else {
+		roomConfig.SetTopic(req.TopicID, func(t *models.TopicConfig) {
+			if req.Name != nil {
+				t.Name = *req.Name
+			}
+			t.ModelName = req.ModelName
+			t.SystemPrompt = req.SystemPrompt
+		})
+	}
+	if err := h.redisSvc.SaveRoomConfig(r.Context(), roomConfig); err != nil {
+		slog.ErrorContext(r.Context(), "無法保存主題設定", "chat_id", req.ChatID, "topic_id", req.TopicID, "error", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+	fmt.Fprintf(w, "聊天室 %d 主題 %d 設定已更新。", req.ChatID, req.TopicID)
+	slog.InfoContext(r.Context(), "主題設定已更新", "chat_id", req.ChatID, "topic_id", req.TopicID, "model", req.ModelName, "reset", req.Reset)
+}
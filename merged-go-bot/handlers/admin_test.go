@@ -0,0 +1,51 @@
+package handlers
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"merged-go-bot/config"
+)
+
+func TestAdminAuthorize(t *testing.T) {
+	endpoints := []struct {
+		method string
+		path   string
+		serve  func(*AdminHandler) http.HandlerFunc
+	}{
+		{http.MethodGet, "/admin/usage", func(h *AdminHandler) http.HandlerFunc { return h.HandleUsage }},
+		{http.MethodPost, "/admin/set_room_quota", func(h *AdminHandler) http.HandlerFunc { return h.HandleSetRoomQuota }},
+		{http.MethodGet, "/admin/usage/export", func(h *AdminHandler) http.HandlerFunc { return h.HandleUsageExport }},
+		{http.MethodGet, "/admin/topics", func(h *AdminHandler) http.HandlerFunc { return h.HandleTopics }},
+		{http.MethodPost, "/admin/set_topic_config", func(h *AdminHandler) http.HandlerFunc { return h.HandleSetTopicConfig }},
+		{http.MethodGet, "/admin/history/export", func(h *AdminHandler) http.HandlerFunc { return h.HandleExportHistory }},
+	}
+	cases := []struct {
+		name   string
+		token  string
+		header string
+	}{
+		{"未設定 token", "", ""},
+		{"未設定 token 但送出空白 bearer", "", "Bearer "},
+		{"缺少 Authorization", "secret", ""},
+		{"錯誤的 token", "secret", "Bearer wrong"},
+		{"缺少 Bearer 前綴的錯誤 token", "secret", "wrong"},
+	}
+	for _, tc := range cases {
+		h := NewAdminHandler(config.NewStore(&config.Config{AdminAPIToken: tc.token}), nil)
+		for _, ep := range endpoints {
+			t.Run(tc.name+" "+ep.path, func(t *testing.T) {
+				req := httptest.NewRequest(ep.method, ep.path, nil)
+				if tc.header != "" {
+					req.Header.Set("Authorization", tc.header)
+				}
+				rec := httptest.NewRecorder()
+				ep.serve(h)(rec, req)
+				if rec.Code != http.StatusUnauthorized {
+					t.Fatalf("狀態碼 = %d，預期 %d", rec.Code, http.StatusUnauthorized)
+				}
+			})
+		}
+	}
+}
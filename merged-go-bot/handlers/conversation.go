@@ -0,0 +1,206 @@
+package handlers
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"strconv"
+	"strings"
+	"time"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+
+	"merged-go-bot/models"
+	"merged-go-bot/telegram"
+)
+
+// maxTitleRunes 限制對話標題的長度；自動產生的標題取第一個提問的開頭
+const maxTitleRunes = 40
+
+// conversationScope 回傳訊息所屬的具名對話範圍。回覆串範圍的每個回覆串各自就是一段對話，不支援具名對話。
+func (h *MergedHandler) conversationScope(ctx context.Context, roomConfig *models.RoomConfig, message *tgbotapi.Message) (models.HistoryKey, bool) {
+	scope := models.HistoryKey{ChatID: message.Chat.ID, TopicID: telegram.TopicID(ctx)}
+	switch h.historyScope(roomConfig, message.Chat) {
+	case models.HistoryPerUser:
+		scope.UserID = senderID(message)
+	case models.HistoryPerThread:
+		return scope, false
+	}
+	return scope, true
+}
+
+// touchConversation 更新對話的最後使用時間，尚未命名時以這次的提問作為標題；
+// 對話資訊的保存時間與聊天歷史相同。
+func (h *MergedHandler) touchConversation(ctx context.Context, key models.HistoryKey, prompt string, ttl time.Duration) {
+	if key.RootID != 0 {
+		return
+	}
+	scope := key
+	scope.ConversationID = 0
+	conv, err := h.redisSvc.GetConversation(ctx, scope, key.ConversationID)
+	if err == nil && conv == nil {
+		conv = &models.Conversation{ID: key.ConversationID, CreatedAt: time.Now()}
+	}
+	if err == nil {
+		if conv.Title == "" {
+			conv.Title = conversationTitle(prompt)
+		}
+		conv.UpdatedAt = time.Now()
+		err = h.redisSvc.SaveConversation(context.WithoutCancel(ctx), scope, conv, ttl)
+	}
+	if err != nil {
+		slog.ErrorContext(ctx, "更新對話資訊失敗", "chat_id", key.ChatID, "conversation_id", key.ConversationID, "error", err)
+	}
+}
+
+func conversationTitle(prompt string) string {
+	line, _, _ := strings.Cut(strings.TrimSpace(prompt), "\n")
+	return truncateRunes(strings.TrimSpace(line), maxTitleRunes)
+}
+
+// handleConversationCommand 處理 /new [標題]、/chats、/switch <id>、/rename <標題> 與 /delete <id>。
+func (h *MergedHandler) handleConversationCommand(ctx context.Context, roomConfig *models.RoomConfig, message *tgbotapi.Message) {
+	chatID := message.Chat.ID
+	scope, ok := h.conversationScope(ctx, roomConfig, message)
+	if !ok {
+		h.send(ctx, tgbotapi.NewMessage(chatID, "此群組使用回覆串範圍，每個回覆串就是一段對話，不支援切換對話。"))
+		return
+	}
+	args := strings.TrimSpace(message.CommandArguments())
+	ttl, keep := h.historyRetention(roomConfig)
+	if !keep && message.Command() != "chats" {
+		h.send(ctx, tgbotapi.NewMessage(chatID, "此聊天室設定為不保存聊天歷史 (ephemeral)，不支援具名對話。"))
+		return
+	}
+	if message.Command() != "chats" && h.historyScope(roomConfig, message.Chat) == models.HistoryShared && !h.isChatAdmin(ctx, message) {
+		h.send(ctx, tgbotapi.NewMessage(chatID, "此群組共用聊天歷史，只有群組管理員可以建立、切換、重新命名或刪除對話。"))
+		return
+	}
+
+	switch message.Command() {
+	case "new":
+		conv, err := h.redisSvc.CreateConversation(ctx, scope, truncateRunes(args, maxTitleRunes), ttl)
+		if err != nil {
+			slog.ErrorContext(ctx, "建立對話失敗", "chat_id", chatID, "error", err)
+			h.send(ctx, tgbotapi.NewMessage(chatID, "無法建立對話，請稍後再試。"))
+			return
+		}
+		slog.InfoContext(ctx, "已建立對話", "chat_id", chatID, "conversation_id", conv.ID)
+		h.send(ctx, tgbotapi.NewMessage(chatID, fmt.Sprintf("已建立並切換到新對話 #%d %s。原本的對話仍然保留，可用 /chats 查看、/switch 切換。",
+			conv.ID, describeTitle(conv))))
+	case "chats":
+		h.listConversations(ctx, scope, chatID)
+	case "switch":
+		id, err := strconv.Atoi(args)
+		if err != nil || id < 0 {
+			h.send(ctx, tgbotapi.NewMessage(chatID, "請在 `/switch` 後面加上對話編號，例如 `/switch 2`。使用 /chats 查看所有對話。"))
+			return
+		}
+		conv, err := h.redisSvc.GetConversation(ctx, scope, id)
+		if err == nil && conv == nil && id != 0 {
+			h.send(ctx, tgbotapi.NewMessage(chatID, fmt.Sprintf("找不到對話 #%d。使用 /chats 查看所有對話。", id)))
+			return
+		}
+		if err == nil {
+			err = h.redisSvc.SetActiveConversation(ctx, scope, id, ttl)
+		}
+		if err != nil {
+			slog.ErrorContext(ctx, "切換對話失敗", "chat_id", chatID, "conversation_id", id, "error", err)
+			h.send(ctx, tgbotapi.NewMessage(chatID, "無法切換對話，請稍後再試。"))
+			return
+		}
+		if conv == nil {
+			conv = &models.Conversation{}
+		}
+		h.send(ctx, tgbotapi.NewMessage(chatID, fmt.Sprintf("已切換到對話 #%d %s。", id, describeTitle(conv))))
+	case "rename":
+		title := truncateRunes(args, maxTitleRunes)
+		if title == "" {
+			h.send(ctx, tgbotapi.NewMessage(chatID, "請在 `/rename` 後面加上新的標題，會套用到目前的對話。"))
+			return
+		}
+		id, err := h.redisSvc.GetActiveConversation(ctx, scope)
+		var conv *models.Conversation
+		if err == nil {
+			conv, err = h.redisSvc.GetConversation(ctx, scope, id)
+		}
+		if err == nil {
+			if conv == nil {
+				conv = &models.Conversation{ID: id, CreatedAt: time.Now(), UpdatedAt: time.Now()}
+			}
+			conv.Title = title
+			err = h.redisSvc.SaveConversation(ctx, scope, conv, ttl)
+		}
+		if err != nil {
+			slog.ErrorContext(ctx, "重新命名對話失敗", "chat_id", chatID, "error", err)
+			h.send(ctx, tgbotapi.NewMessage(chatID, "無法重新命名對話，請稍後再試。"))
+			return
+		}
+		h.send(ctx, tgbotapi.NewMessage(chatID, fmt.Sprintf("對話 #%d 已重新命名為「%s」。", id, title)))
+	case "delete":
+		id, err := strconv.Atoi(args)
+		if err != nil || id < 0 {
+			h.send(ctx, tgbotapi.NewMessage(chatID, "請在 `/delete` 後面加上要刪除的對話編號，例如 `/delete 2`。使用 /chats 查看所有對話。"))
+			return
+		}
+		if err := h.redisSvc.DeleteConversation(ctx, scope, id); err != nil {
+			slog.ErrorContext(ctx, "刪除對話失敗", "chat_id", chatID, "conversation_id", id, "error", err)
+			h.send(ctx, tgbotapi.NewMessage(chatID, "無法刪除對話，請稍後再試。"))
+			return
+		}
+		slog.InfoContext(ctx, "已刪除對話", "chat_id", chatID, "conversation_id", id)
+		if id == 0 {
+			h.send(ctx, tgbotapi.NewMessage(chatID, "預設對話的聊天歷史已清除。"))
+			return
+		}
+		h.send(ctx, tgbotapi.NewMessage(chatID, fmt.Sprintf("對話 #%d 已刪除。", id)))
+	}
+}
+
+func (h *MergedHandler) listConversations(ctx context.Context, scope models.HistoryKey, chatID int64) {
+	convs, err := h.redisSvc.ListConversations(ctx, scope)
+	var active int
+	if err == nil {
+		active, err = h.redisSvc.GetActiveConversation(ctx, scope)
+	}
+	if err != nil {
+		slog.ErrorContext(ctx, "列出對話失敗", "chat_id", chatID, "error", err)
+		h.send(ctx, tgbotapi.NewMessage(chatID, "無法列出對話，請稍後再試。"))
+		return
+	}
+	hasDefault := false
+	for _, conv := range convs {
+		if conv.ID == 0 {
+			hasDefault = true
+		}
+	}
+	if !hasDefault {
+		convs = append(convs, models.Conversation{})
+	}
+
+	var sb strings.Builder
+	sb.WriteString("對話列表：\n")
+	for _, conv := range convs {
+		marker := "  "
+		if conv.ID == active {
+			marker = "▶ "
+		}
+		lastActive := "尚未使用"
+		if !conv.UpdatedAt.IsZero() {
+			lastActive = conv.UpdatedAt.Local().Format("2006-01-02 15:04")
+		}
+		fmt.Fprintf(&sb, "%s#%d %s (最後使用: %s)\n", marker, conv.ID, describeTitle(&conv), lastActive)
+	}
+	sb.WriteString("\n使用 /switch <編號> 切換、/new [標題] 建立新對話、/rename <標題> 重新命名目前的對話、/delete <編號> 刪除。")
+	h.send(ctx, tgbotapi.NewMessage(chatID, sb.String()))
+}
+
+func describeTitle(conv *models.Conversation) string {
+	switch {
+	case conv.Title != "":
+		return "「" + conv.Title + "」"
+	case conv.ID == 0:
+		return "(預設對話)"
+	}
+	return "(未命名)"
+}
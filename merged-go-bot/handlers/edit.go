@@ -0,0 +1,166 @@
+package handlers
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"strings"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+
+	"merged-go-bot/logging"
+	"merged-go-bot/models"
+	"merged-go-bot/services"
+	"merged-go-bot/telegram"
+	"merged-go-bot/tracing"
+)
+
+// handleEditedMessage 在使用者編輯先前的提問時重新產生回答：以編輯後的內容取代聊天歷史中的那一輪，
+// 並直接編輯機器人原本的回覆。只處理仍有訊息 ID 索引 (turnTTL 內) 的一般提問與 /get。
+func (h *MergedHandler) handleEditedMessage(parent trace.SpanContext, updateID int, message *tgbotapi.Message, extra telegram.Extra) {
+	chatID := message.Chat.ID
+	ctx, done := h.track(chatID, message.MessageID, h.cfg.Current().UpdateTimeout)
+	defer done()
+	ctx = logging.WithCorrelationID(ctx, fmt.Sprintf("tg-%d", updateID))
+	ctx = telegram.WithTopic(ctx, extra.Topic.ThreadID)
+	ctx, span := tracing.Start(trace.ContextWithSpanContext(ctx, parent), "telegram.edited_message",
+		attribute.Int("telegram.update_id", updateID), attribute.Int64("chat.id", chatID), attribute.Int("telegram.topic_id", extra.Topic.ThreadID))
+	defer span.End()
+	slog.InfoContext(ctx, "收到編輯過的 Telegram 訊息", "chat_id", chatID, "message_id", message.MessageID,
+		"user_id", senderID(message), logging.Content("text", message.Text))
+
+	turn, err := h.redisSvc.GetTurn(ctx, chatID, message.MessageID)
+	if err != nil {
+		slog.ErrorContext(ctx, "查詢被編輯的對話失敗", "chat_id", chatID, "message_id", message.MessageID, "error", err)
+		return
+	}
+	if turn == nil || turn.UserMessageID != message.MessageID {
+		slog.DebugContext(ctx, "被編輯的訊息沒有對應的回答，略過", "chat_id", chatID, "message_id", message.MessageID)
+		return
+	}
+
+	unlock, ok := h.lockChat(ctx, chatID)
+	if !ok {
+		return
+	}
+	defer unlock()
+
+	roomConfig, err := h.redisSvc.GetRoomConfig(ctx, chatID)
+	if err != nil {
+		slog.ErrorContext(ctx, "從 Redis 獲取聊天室配置失敗", "chat_id", chatID, "error", err)
+		return
+	}
+	if roomConfig == nil || !roomConfig.Approved {
+		return
+	}
+
+	var prompt string
+	switch {
+	case message.Command() == "get":
+		prompt = strings.TrimSpace(message.CommandArguments())
+		ok = prompt != ""
+	case message.IsCommand():
+		ok = false
+	default:
+		prompt, ok = h.triggerPrompt(roomConfig, message)
+	}
+	if !ok {
+		slog.InfoContext(ctx, "編輯後的訊息不再是提問，保留原本的回答", "chat_id", chatID, "message_id", message.MessageID)
+		return
+	}
+	h.regenerateTurn(ctx, roomConfig, message, turn, prompt, extra.Quote)
+}
+
+// regenerateTurn 以編輯後的提問重新產生 turn 的回答。這一輪仍在聊天歷史中時，以它之前的訊息為上下文
+// 並取代歷史中的這一輪 (之後的訊息保留)；已不在歷史中時 (例如 /get 或已被裁剪) 不帶上下文，也不寫入歷史。
+func (h *MergedHandler) regenerateTurn(ctx context.Context, roomConfig *models.RoomConfig, message *tgbotapi.Message, turn *models.Turn, prompt, quote string) {
+	chatID := message.Chat.ID
+	history, err := h.redisSvc.GetMessages(ctx, turn.History)
+	if err != nil {
+		slog.ErrorContext(ctx, "獲取聊天歷史失敗", "chat_id", chatID, "error", err)
+		return
+	}
+	idx := findTurn(history, turn)
+	var messages []models.Message
+	if idx >= 0 {
+		messages = append(messages, history[:idx]...)
+	}
+
+	reference := referencedText(message, quote)
+	if h.isReplyToBot(message) && quote == "" && idx >= 0 {
+		// 被回覆的回答在上下文中，與原本的提問相同不另外附上
+		reference = ""
+	}
+	if prompt == "" {
+		prompt = "請針對上面的訊息回應。"
+	}
+	userMsg := userMessage(message, h.withReference(message, reference, prompt))
+	messages = append(messages, userMsg)
+
+	if !h.checkQuota(ctx, roomConfig, services.QuotaUnitTokens, 0) {
+		return
+	}
+	response, err := h.openaiSvc.GetChatCompletion(ctx, "", h.modelChain(ctx, roomConfig),
+		withSystemPrompt(h.systemPrompt(ctx, roomConfig), h.attributeSpeakers(roomConfig, message.Chat, messages)))
+	if err != nil {
+		slog.ErrorContext(ctx, "重新產生回答失敗", "chat_id", chatID, "error", err)
+		h.replyError(ctx, chatID, "從 AI 獲取回應時發生錯誤。")
+		return
+	}
+	h.recordChatUsage(ctx, chatID, senderID(message), response)
+
+	if h.replaceTurn(ctx, roomConfig, turn, userMsg, assistantMessage(response.Content)) {
+		slog.InfoContext(ctx, "已依編輯後的提問重新產生回答", "chat_id", chatID, "message_id", message.MessageID,
+			"bot_message_id", turn.BotMessageID, "in_history", idx >= 0)
+	}
+	h.warnQuota(ctx, roomConfig, services.QuotaUnitTokens)
+}
+
+// replaceTurn 以新的一問一答取代聊天歷史中的這一輪 (已不在歷史中時不寫入)，
+// 編輯機器人原本的回覆並更新訊息 ID 索引。回覆編輯失敗時回傳 false。
+func (h *MergedHandler) replaceTurn(ctx context.Context, roomConfig *models.RoomConfig, turn *models.Turn, userMsg, assistantMsg models.Message) bool {
+	chatID := turn.History.ChatID
+	h.rewriteTurn(ctx, roomConfig, turn, userMsg, assistantMsg)
+
+	edit := tgbotapi.NewEditMessageTextAndMarkup(chatID, turn.BotMessageID, assistantMsg.Content, replyKeyboard(turn))
+	if _, err := h.send(ctx, edit); err != nil {
+		slog.ErrorContext(ctx, "編輯機器人回覆失敗", "chat_id", chatID, "message_id", turn.BotMessageID, "error", err)
+		return false
+	}
+	turn.User, turn.Assistant = userMsg, assistantMsg
+	h.saveTurn(ctx, roomConfig, turn)
+	return true
+}
+
+// rewriteTurn 在聊天歷史中找到 turn 並改寫為新的一問一答。產生回答期間歷史可能已附加新的訊息或被裁剪，
+// 所以在寫入時才重新尋找這一輪的位置。
+func (h *MergedHandler) rewriteTurn(ctx context.Context, roomConfig *models.RoomConfig, turn *models.Turn, userMsg, assistantMsg models.Message) {
+	ttl, _ := h.historyRetention(roomConfig)
+	_, err := h.redisSvc.EditMessages(ctx, turn.History, ttl, func(history []models.Message) map[int]models.Message {
+		idx := findTurn(history, turn)
+		if idx < 0 {
+			return nil
+		}
+		return map[int]models.Message{idx: userMsg, idx + 1: assistantMsg}
+	})
+	if err != nil {
+		slog.ErrorContext(ctx, "保存聊天歷史失敗", "chat_id", turn.History.ChatID, "error", err)
+	}
+}
+
+// findTurn 回傳 turn 的提問在聊天歷史中的位置 (其後緊接著回答)，找不到時回傳 -1。
+// 同樣的一問一答出現多次時取最後一次；不寫入聊天歷史的 /get 一律回傳 -1。
+func findTurn(history []models.Message, turn *models.Turn) int {
+	if turn.Standalone {
+		return -1
+	}
+	for i := len(history) - 2; i >= 0; i-- {
+		if history[i].Role == "user" && history[i].Content == turn.User.Content &&
+			history[i+1].Role == "assistant" && history[i+1].Content == turn.Assistant.Content {
+			return i
+		}
+	}
+	return -1
+}
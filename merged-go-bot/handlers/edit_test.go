@@ -0,0 +1,45 @@
+package handlers
+
+import (
+	"testing"
+
+	"merged-go-bot/models"
+)
+
+func TestFindTurn(t *testing.T) {
+	user := func(s string) models.Message { return models.Message{Role: "user", Content: s} }
+	assistant := func(s string) models.Message { return models.Message{Role: "assistant", Content: s} }
+	turn := &models.Turn{User: user("q"), Assistant: assistant("a")}
+
+	cases := []struct {
+		name    string
+		history []models.Message
+		want    int
+	}{
+		{name: "空的歷史", history: nil, want: -1},
+		{name: "只有提問", history: []models.Message{user("q")}, want: -1},
+		{name: "唯一的一輪", history: []models.Message{user("q"), assistant("a")}, want: 0},
+		{name: "在歷史中間", history: []models.Message{user("x"), assistant("y"), user("q"), assistant("a"), user("z"), assistant("w")}, want: 2},
+		{name: "重複時取最後一次", history: []models.Message{user("q"), assistant("a"), user("q"), assistant("a")}, want: 2},
+		{name: "回答已被改寫", history: []models.Message{user("q"), assistant("b")}, want: -1},
+		{name: "提問與回答不相鄰", history: []models.Message{user("q"), user("r"), assistant("a")}, want: -1},
+		{name: "角色不符", history: []models.Message{assistant("q"), user("a")}, want: -1},
+		{name: "前面被裁剪只剩回答", history: []models.Message{assistant("a"), user("z"), assistant("w")}, want: -1},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			if got := findTurn(tc.history, turn); got != tc.want {
+				t.Errorf("findTurn = %d，預期 %d", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestFindTurnStandalone(t *testing.T) {
+	// /get 的回答不在聊天歷史中，內容剛好相同也不能當成歷史中的那一輪
+	turn := &models.Turn{User: models.Message{Role: "user", Content: "q"}, Assistant: models.Message{Role: "assistant", Content: "a"}, Standalone: true}
+	history := []models.Message{turn.User, turn.Assistant}
+	if got := findTurn(history, turn); got != -1 {
+		t.Errorf("findTurn = %d，預期 -1", got)
+	}
+}
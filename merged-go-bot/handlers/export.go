@@ -0,0 +1,199 @@
+package handlers
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"log/slog"
+	"strings"
+	"time"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+
+	"merged-go-bot/models"
+	"merged-go-bot/services"
+)
+
+// 匯出格式
+const (
+	exportMarkdown = "md"
+	exportJSON     = "json"
+	exportHTML     = "html"
+)
+
+// exportFormatName 為 JSON 匯出的格式識別，/import 以此辨認本機器人的匯出檔
+const exportFormatName = "merged-go-bot/chat-export"
+
+// chatExport 為 JSON 匯出的內容，也是 /import 接受的格式之一。
+type chatExport struct {
+	Format     string            `json:"format"`
+	Version    int               `json:"version"`
+	Title      string            `json:"title,omitempty"`
+	History    models.HistoryKey `json:"history"`
+	ExportedAt time.Time         `json:"exported_at"`
+	Messages   []models.Message  `json:"messages"`
+}
+
+func validExportFormat(format string) bool {
+	switch format {
+	case exportMarkdown, exportJSON, exportHTML:
+		return true
+	}
+	return false
+}
+
+// renderExport 將聊天歷史輸出為指定格式，回傳檔案內容與 MIME 類型。
+func renderExport(format, title string, key models.HistoryKey, messages []models.Message) ([]byte, string, error) {
+	now := time.Now()
+	switch format {
+	case exportJSON:
+		data, err := json.MarshalIndent(chatExport{
+			Format:     exportFormatName,
+			Version:    1,
+			Title:      title,
+			History:    key,
+			ExportedAt: now,
+			Messages:   messages,
+		}, "", "  ")
+		return data, "application/json", err
+	case exportHTML:
+		var buf bytes.Buffer
+		err := exportTemplate.Execute(&buf, map[string]interface{}{
+			"Title":      exportTitle(title, key),
+			"ExportedAt": now.Format("2006-01-02 15:04"),
+			"Messages":   exportEntries(messages),
+		})
+		return buf.Bytes(), "text/html", err
+	default:
+		var sb strings.Builder
+		fmt.Fprintf(&sb, "# %s\n\n匯出時間：%s\n", exportTitle(title, key), now.Format("2006-01-02 15:04"))
+		for _, e := range exportEntries(messages) {
+			fmt.Fprintf(&sb, "\n---\n\n**%s**", e.Speaker)
+			if e.Time != "" {
+				fmt.Fprintf(&sb, " · %s", e.Time)
+			}
+			fmt.Fprintf(&sb, "\n\n%s\n", e.Content)
+		}
+		return []byte(sb.String()), "text/markdown", nil
+	}
+}
+
+type exportEntry struct {
+	Speaker   string
+	Time      string
+	Content   string
+	Assistant bool
+}
+
+func exportEntries(messages []models.Message) []exportEntry {
+	entries := make([]exportEntry, 0, len(messages))
+	for _, msg := range messages {
+		e := exportEntry{Content: msg.Content, Assistant: msg.Role == "assistant"}
+		switch {
+		case e.Assistant:
+			e.Speaker = "AI"
+		case msg.SenderName != "":
+			e.Speaker = msg.SenderName
+		case msg.UserID != 0:
+			e.Speaker = fmt.Sprintf("user_%d", msg.UserID)
+		default:
+			e.Speaker = "使用者"
+		}
+		if msg.Timestamp != 0 {
+			e.Time = time.Unix(msg.Timestamp, 0).Local().Format("2006-01-02 15:04")
+		}
+		entries = append(entries, e)
+	}
+	return entries
+}
+
+func exportTitle(title string, key models.HistoryKey) string {
+	if title != "" {
+		return "聊天紀錄：" + title
+	}
+	return fmt.Sprintf("聊天紀錄：%d", key.ChatID)
+}
+
+func exportFileName(key models.HistoryKey, format string) string {
+	return fmt.Sprintf("chat-%d-%s.%s", key.ChatID, time.Now().Format("20060102-1504"), format)
+}
+
+var exportTemplate = template.Must(template.New("export").Parse(`<!DOCTYPE html>
+<html lang="zh-Hant">
+<head>
+<meta charset="utf-8">
+<title>{{.Title}}</title>
+<style>
+body { font-family: sans-serif; max-width: 48rem; margin: 2rem auto; padding: 0 1rem; color: #222; }
+.msg { border-radius: 8px; padding: .75rem 1rem; margin: .75rem 0; background: #f1f3f5; }
+.msg.ai { background: #e7f5ff; }
+.meta { font-size: .85rem; color: #666; margin-bottom: .25rem; }
+.content { white-space: pre-wrap; }
+</style>
+</head>
+<body>
+<h1>{{.Title}}</h1>
+<p class="meta">匯出時間：{{.ExportedAt}}</p>
+{{range .Messages}}<div class="msg{{if .Assistant}} ai{{end}}">
+<div class="meta"><strong>{{.Speaker}}</strong>{{if .Time}} · {{.Time}}{{end}}</div>
+<div class="content">{{.Content}}</div>
+</div>
+{{end}}</body>
+</html>
+`))
+
+// handleExportCommand 將目前的聊天歷史匯出為檔案：/export [md|json|html]，預設為 Markdown。
+func (h *MergedHandler) handleExportCommand(ctx context.Context, roomConfig *models.RoomConfig, message *tgbotapi.Message) {
+	chatID := message.Chat.ID
+	format := strings.ToLower(strings.TrimSpace(message.CommandArguments()))
+	if format == "" {
+		format = exportMarkdown
+	}
+	if !validExportFormat(format) {
+		h.send(ctx, tgbotapi.NewMessage(chatID, "未知的匯出格式。可用格式: md、json、html，例如 `/export html`。"))
+		return
+	}
+
+	key, err := h.historyKey(ctx, roomConfig, message)
+	var messages []models.Message
+	if err == nil {
+		messages, err = h.redisSvc.GetMessages(ctx, key)
+	}
+	if err != nil {
+		slog.ErrorContext(ctx, "獲取聊天歷史失敗", "chat_id", chatID, "error", err)
+		h.send(ctx, tgbotapi.NewMessage(chatID, "無法匯出聊天歷史，請稍後再試。"))
+		return
+	}
+	if len(messages) == 0 {
+		h.send(ctx, tgbotapi.NewMessage(chatID, "目前的對話沒有聊天歷史可以匯出。"))
+		return
+	}
+
+	data, _, err := renderExport(format, historyTitle(ctx, h.redisSvc, key), key, messages)
+	if err != nil {
+		slog.ErrorContext(ctx, "匯出聊天歷史失敗", "chat_id", chatID, "format", format, "error", err)
+		h.send(ctx, tgbotapi.NewMessage(chatID, "無法匯出聊天歷史，請稍後再試。"))
+		return
+	}
+	doc := tgbotapi.NewDocument(chatID, tgbotapi.FileBytes{Name: exportFileName(key, format), Bytes: data})
+	doc.Caption = fmt.Sprintf("共 %d 則訊息。", len(messages))
+	if _, err := h.send(ctx, doc); err == nil {
+		slog.InfoContext(ctx, "已匯出聊天歷史", "chat_id", chatID, "format", format, "messages", len(messages))
+	}
+}
+
+// historyTitle 回傳聊天歷史所屬具名對話的標題；回覆串或未命名時為空字串。
+func historyTitle(ctx context.Context, redisSvc *services.RedisService, key models.HistoryKey) string {
+	if key.RootID != 0 {
+		return ""
+	}
+	scope := key
+	scope.ConversationID = 0
+	conv, err := redisSvc.GetConversation(ctx, scope, key.ConversationID)
+	if err != nil || conv == nil {
+		return ""
+	}
+	return conv.Title
+}
@@ -1,192 +1,781 @@
 package handlers
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 	"io"
-	"log"
+	"log/slog"
 	"net/http"
 	"os"
 	"path/filepath"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
 
 	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 	"merged-go-bot/config"
+	"merged-go-bot/logging"
+	"merged-go-bot/metrics"
 	"merged-go-bot/models"
 	"merged-go-bot/services"
+	"merged-go-bot/telegram"
+	"merged-go-bot/tracing"
 )
 
 type MergedHandler struct {
-	cfg       *config.Config
+	cfg       *config.Store
 	redisSvc  *services.RedisService
 	openaiSvc *services.OpenAIService
 	soraSvc   *services.SoraService
+	quotaSvc  *services.QuotaService
 	bot       *tgbotapi.BotAPI
+
+	// baseCtx 為所有 update 處理的根 context，關機逾時後以 cancelAll 中止仍在執行的工作
+	baseCtx   context.Context
+	cancelAll context.CancelFunc
+	wg        sync.WaitGroup
+	inFlight  atomic.Int64
+
+	mu        sync.Mutex
+	running   map[int64]map[int]context.CancelFunc // chat ID -> message ID -> cancel
+	chatLocks map[int64]*chatLock
+	// inlineIDs 記錄每位使用者最新的 inline 查詢 ID，用於延遲合併連續輸入
+	inlineIDs map[int64]string
+}
+
+// chatLock 讓同一聊天室的 update 依序處理，避免同時讀寫聊天歷史。
+type chatLock struct {
+	sem  chan struct{}
+	refs int
 }
 
 func NewMergedHandler(
-	cfg *config.Config,
+	cfg *config.Store,
 	redisSvc *services.RedisService,
 	openaiSvc *services.OpenAIService,
 	soraSvc *services.SoraService,
+	quotaSvc *services.QuotaService,
 	bot *tgbotapi.BotAPI,
 ) *MergedHandler {
+	baseCtx, cancelAll := context.WithCancel(context.Background())
 	return &MergedHandler{
 		cfg:       cfg,
 		redisSvc:  redisSvc,
 		openaiSvc: openaiSvc,
 		soraSvc:   soraSvc,
+		quotaSvc:  quotaSvc,
 		bot:       bot,
+		baseCtx:   baseCtx,
+		cancelAll: cancelAll,
+		running:   make(map[int64]map[int]context.CancelFunc),
+		chatLocks: make(map[int64]*chatLock),
+		inlineIDs: make(map[int64]string),
 	}
 }
 
+// HandleTelegramWebhook 立即回應 Telegram，並在背景處理 update，
+// 讓長時間的請求 (例如 Sora 影片) 執行期間仍能收到同一聊天室的 /cancel。
 func (h *MergedHandler) HandleTelegramWebhook(w http.ResponseWriter, r *http.Request) {
-	expectedPath := "/telegram_webhook/" + h.cfg.TelegramBotToken
+	expectedPath := "/telegram_webhook/" + h.cfg.Current().TelegramBotToken
 	if r.URL.Path != expectedPath {
-		log.Printf("Webhook path mismatch. Expected: %s, Got: %s", expectedPath, r.URL.Path)
+		// 路徑中含有 bot token，不記錄預期的路徑
+		slog.Warn("Webhook 路徑不符，拒絕請求", "remote_addr", r.RemoteAddr)
 		http.Error(w, "Unauthorized", http.StatusUnauthorized)
 		return
 	}
 
+	_, span := tracing.Start(r.Context(), "telegram.webhook")
+	body, err := io.ReadAll(r.Body)
 	var update tgbotapi.Update
-	if err := json.NewDecoder(r.Body).Decode(&update); err != nil {
-		log.Printf("解析 Telegram update 失敗: %v", err)
+	// tgbotapi 不支援論壇主題與引用，另外解析原始 message 的 message_thread_id 與 quote
+	var raw struct {
+		Message       json.RawMessage `json:"message"`
+		EditedMessage json.RawMessage `json:"edited_message"`
+	}
+	if err == nil {
+		err = json.Unmarshal(body, &update)
+	}
+	if err == nil {
+		err = json.Unmarshal(body, &raw)
+	}
+	if err != nil {
+		tracing.End(span, err)
+		slog.Error("解析 Telegram update 失敗", "error", err)
 		return
 	}
+	extra := telegram.ParseExtra(raw.Message, update.Message)
+	if update.EditedMessage != nil {
+		extra = telegram.ParseExtra(raw.EditedMessage, update.EditedMessage)
+	}
+	span.SetAttributes(attribute.Int("telegram.update_id", update.UpdateID), attribute.String("telegram.update_type", updateType(&update)))
+	span.End()
+	w.WriteHeader(http.StatusOK)
+	metrics.UpdatesReceived.WithLabelValues(updateType(&update)).Inc()
 
-	if update.Message == nil {
-		w.WriteHeader(http.StatusOK)
+	if update.Message == nil && update.EditedMessage == nil && update.InlineQuery == nil && update.CallbackQuery == nil {
 		return
 	}
-	
-	message := update.Message
+	if h.baseCtx.Err() != nil {
+		slog.Warn("服務正在關閉，略過 update", "update_id", update.UpdateID)
+		return
+	}
+
+	h.wg.Add(1)
+	h.inFlight.Add(1)
+	// 背景處理的 span 接在 webhook span 之下，即使 HTTP 請求已經結束
+	parent := span.SpanContext()
+	go func() {
+		defer h.wg.Done()
+		defer h.inFlight.Add(-1)
+		if update.CallbackQuery != nil {
+			h.handleCallbackQuery(parent, update.UpdateID, update.CallbackQuery)
+			return
+		}
+		if update.InlineQuery != nil {
+			h.handleInlineQuery(parent, update.UpdateID, update.InlineQuery)
+			return
+		}
+		if update.EditedMessage != nil {
+			h.handleEditedMessage(parent, update.UpdateID, update.EditedMessage, extra)
+			return
+		}
+		h.handleMessage(parent, update.UpdateID, update.Message, extra)
+	}()
+}
+
+func (h *MergedHandler) handleMessage(parent trace.SpanContext, updateID int, message *tgbotapi.Message, extra telegram.Extra) {
+	captionCommand(message)
+	topic := extra.Topic
 	chatID := message.Chat.ID
 	text := message.Text
 
-	roomConfig, err := h.redisSvc.GetRoomConfig(chatID)
+	cfg := h.cfg.Current()
+	timeout := cfg.UpdateTimeout
+	if message.Command() == "video" {
+		timeout = cfg.VideoJobTimeout
+	}
+	ctx, done := h.track(chatID, message.MessageID, timeout)
+	defer done()
+	ctx = logging.WithCorrelationID(ctx, fmt.Sprintf("tg-%d", updateID))
+	// 回覆與聊天歷史都以訊息所在的論壇主題為範圍
+	ctx = telegram.WithTopic(ctx, topic.ThreadID)
+	ctx, span := tracing.Start(trace.ContextWithSpanContext(ctx, parent), "telegram.update",
+		attribute.Int("telegram.update_id", updateID), attribute.Int64("chat.id", chatID), attribute.Int("telegram.topic_id", topic.ThreadID),
+		attribute.String("command", commandLabel(message)))
+	defer span.End()
+	slog.InfoContext(ctx, "收到 Telegram 訊息", "chat_id", chatID, "topic_id", topic.ThreadID, "message_id", message.MessageID,
+		"user_id", senderID(message), "command", message.Command(), logging.Content("text", text))
+
+	// 群組中未觸發的一般訊息在排隊前就略過，不佔用聊天室的處理順序
+	if !message.Chat.IsPrivate() {
+		if message.IsCommand() {
+			if h.addressedToOtherBot(message) {
+				return
+			}
+		} else {
+			roomConfig, err := h.redisSvc.GetRoomConfig(ctx, chatID)
+			if err != nil {
+				slog.ErrorContext(ctx, "從 Redis 獲取聊天室配置失敗", "chat_id", chatID, "error", err)
+				return
+			}
+			if _, ok := h.triggerPrompt(roomConfig, message); !ok {
+				slog.DebugContext(ctx, "訊息未觸發機器人，略過", "chat_id", chatID, "message_id", message.MessageID)
+				return
+			}
+		}
+	}
+
+	// /cancel 不排隊，才能中止正在執行或等待中的請求
+	if message.Command() != "cancel" {
+		unlock, ok := h.lockChat(ctx, chatID)
+		if !ok {
+			slog.InfoContext(ctx, "訊息在排隊時已取消", "chat_id", chatID, "message_id", message.MessageID, "error", ctx.Err())
+			return
+		}
+		defer unlock()
+	}
+
+	// 排隊期間其他指令可能已修改設定，取得處理權後重新讀取，之後的處理 (包括保存) 都使用這一份
+	roomConfig, err := h.redisSvc.GetRoomConfig(ctx, chatID)
 	if err != nil {
-		log.Printf("從 Redis 獲取聊天室配置失敗: %v", err)
-		w.WriteHeader(http.StatusOK)
+		slog.ErrorContext(ctx, "從 Redis 獲取聊天室配置失敗", "chat_id", chatID, "error", err)
 		return
 	}
 	if roomConfig == nil || !roomConfig.Approved {
-		h.bot.Send(tgbotapi.NewMessage(chatID, "此聊天室未被授權使用 AI 功能。請聯繫管理員。"))
-		w.WriteHeader(http.StatusOK)
+		h.send(ctx, tgbotapi.NewMessage(chatID, "此聊天室未被授權使用 AI 功能。請聯繫管理員。"))
 		return
 	}
+	h.rememberTopic(ctx, roomConfig, topic)
+	h.rememberMember(ctx, message)
 
-	if strings.HasPrefix(text, "/get ") {
-		h.handleGetCommand(chatID, text)
-	} else if strings.HasPrefix(text, "/video ") {
-		h.handleVideoCommand(chatID, text)
+	metrics.CommandsHandled.WithLabelValues(commandLabel(message)).Inc()
+	if message.Command() == "get" {
+		h.handleGetCommand(ctx, roomConfig, message, extra.Quote)
+	} else if message.Command() == "video" {
+		h.handleVideoCommand(ctx, roomConfig, message)
 	} else if message.IsCommand() {
-		h.handleGeneralCommands(chatID, message.Command())
-	} else if text != "" {
-		h.handleChatCompletion(chatID, text)
+		h.handleGeneralCommands(ctx, roomConfig, message)
+	} else if prompt, ok := h.triggerPrompt(roomConfig, message); ok {
+		h.handleChatCompletion(ctx, roomConfig, message, prompt, extra.Quote)
 	}
-	
-	w.WriteHeader(http.StatusOK)
 }
 
-func (h *MergedHandler) handleGeneralCommands(chatID int64, command string) {
-	switch command {
+// QueueDepth 回傳正在處理或排隊中的 update 數量。
+func (h *MergedHandler) QueueDepth() int64 {
+	return h.inFlight.Load()
+}
+
+// send 發送訊息到 Telegram，失敗時記錄日誌與指標。
+func (h *MergedHandler) send(ctx context.Context, c tgbotapi.Chattable) (tgbotapi.Message, error) {
+	kind := "message"
+	switch c.(type) {
+	case tgbotapi.VideoConfig:
+		kind = "video"
+	case tgbotapi.DocumentConfig:
+		kind = "document"
+	}
+	_, span := tracing.Start(ctx, "telegram.Send", attribute.String("kind", kind))
+	sent, err := telegram.Send(ctx, h.bot, c)
+	tracing.End(span, err)
+	if err != nil {
+		metrics.TelegramSendFailures.WithLabelValues(kind).Inc()
+		slog.ErrorContext(ctx, "發送到 Telegram 失敗", "kind", kind, "error", err)
+	}
+	return sent, err
+}
+
+// request 發送不回傳訊息的請求 (例如回應按鈕)，與 send 一樣記錄 tracing 與失敗次數。
+func (h *MergedHandler) request(ctx context.Context, kind string, c tgbotapi.Chattable) error {
+	_, span := tracing.Start(ctx, "telegram.Request", attribute.String("kind", kind))
+	_, err := h.bot.Request(c)
+	tracing.End(span, err)
+	if err != nil {
+		metrics.TelegramSendFailures.WithLabelValues(kind).Inc()
+	}
+	return err
+}
+
+func updateType(update *tgbotapi.Update) string {
+	switch {
+	case update.Message != nil:
+		return "message"
+	case update.EditedMessage != nil:
+		return "edited_message"
+	case update.CallbackQuery != nil:
+		return "callback_query"
+	case update.InlineQuery != nil:
+		return "inline_query"
+	case update.ChannelPost != nil:
+		return "channel_post"
+	case update.MyChatMember != nil, update.ChatMember != nil:
+		return "chat_member"
+	default:
+		return "other"
+	}
+}
+
+// commandLabel 回傳指標用的指令名稱，未知指令歸為 other 以限制標籤數量。
+func commandLabel(message *tgbotapi.Message) string {
+	switch command := message.Command(); command {
+	case "":
+		return "chat"
+	case "start", "clear", "model", "fallback", "trigger", "scope", "usage", "cancel", "get", "video",
+		"new", "chats", "switch", "rename", "delete", "export", "import", "retention":
+		return command
+	default:
+		return "other"
+	}
+}
+
+// track 為 update 建立帶有期限的 context 並登記到聊天室，讓 /cancel 可以中止它。
+func (h *MergedHandler) track(chatID int64, messageID int, timeout time.Duration) (context.Context, func()) {
+	ctx, done, _ := h.register(chatID, messageID, timeout, true)
+	return ctx, done
+}
+
+// tryTrack 與 track 相同，但同一則訊息已在處理中時不登記並回傳 false，
+// 避免重複點擊按鈕時覆蓋前一個工作，使它無法再被取消。
+func (h *MergedHandler) tryTrack(chatID int64, messageID int, timeout time.Duration) (context.Context, func(), bool) {
+	return h.register(chatID, messageID, timeout, false)
+}
+
+func (h *MergedHandler) register(chatID int64, messageID int, timeout time.Duration, replace bool) (context.Context, func(), bool) {
+	h.mu.Lock()
+	if _, busy := h.running[chatID][messageID]; busy && !replace {
+		h.mu.Unlock()
+		return nil, nil, false
+	}
+	ctx, cancel := context.WithTimeout(h.baseCtx, timeout)
+	if h.running[chatID] == nil {
+		h.running[chatID] = make(map[int]context.CancelFunc)
+	}
+	h.running[chatID][messageID] = cancel
+	h.mu.Unlock()
+
+	return ctx, func() {
+		h.mu.Lock()
+		delete(h.running[chatID], messageID)
+		if len(h.running[chatID]) == 0 {
+			delete(h.running, chatID)
+		}
+		h.mu.Unlock()
+		cancel()
+	}, true
+}
+
+// lockChat 等待取得聊天室的處理權；ctx 先結束時回傳 false。
+func (h *MergedHandler) lockChat(ctx context.Context, chatID int64) (func(), bool) {
+	h.mu.Lock()
+	lock := h.chatLocks[chatID]
+	if lock == nil {
+		lock = &chatLock{sem: make(chan struct{}, 1)}
+		h.chatLocks[chatID] = lock
+	}
+	lock.refs++
+	h.mu.Unlock()
+
+	release := func() {
+		h.mu.Lock()
+		lock.refs--
+		if lock.refs == 0 {
+			delete(h.chatLocks, chatID)
+		}
+		h.mu.Unlock()
+	}
+
+	select {
+	case lock.sem <- struct{}{}:
+		return func() {
+			<-lock.sem
+			release()
+		}, true
+	case <-ctx.Done():
+		release()
+		return nil, false
+	}
+}
+
+// cancelChat 取消聊天室中除了 except 以外所有進行中的請求，回傳取消的數量。
+func (h *MergedHandler) cancelChat(chatID int64, except int) int {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	count := 0
+	for messageID, cancel := range h.running[chatID] {
+		if messageID == except {
+			continue
+		}
+		cancel()
+		count++
+	}
+	return count
+}
+
+// Shutdown 等待進行中的 update 處理完成；ctx 到期時取消剩餘的工作並等待它們結束。
+func (h *MergedHandler) Shutdown(ctx context.Context) {
+	done := make(chan struct{})
+	go func() {
+		h.wg.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-ctx.Done():
+		slog.Warn("關機逾時，取消仍在進行中的請求")
+		h.cancelAll()
+		<-done
+	}
+	h.cancelAll()
+}
+
+// replyError 回報請求失敗；被 /cancel 取消的請求已由 /cancel 回覆，不再重複通知。
+func (h *MergedHandler) replyError(ctx context.Context, chatID int64, text string) {
+	switch ctx.Err() {
+	case context.Canceled:
+		return
+	case context.DeadlineExceeded:
+		text = "處理時間過長，請求已逾時。"
+	}
+	h.send(ctx, tgbotapi.NewMessage(chatID, text))
+}
+
+func (h *MergedHandler) handleGeneralCommands(ctx context.Context, roomConfig *models.RoomConfig, message *tgbotapi.Message) {
+	chatID := message.Chat.ID
+	switch message.Command() {
 	case "start":
-		msg := tgbotapi.NewMessage(chatID, "歡迎使用，請輸入您想問的內容，或使用 `/get [提示詞]` 進行一次性查詢，或 `/video [提示詞]` 生成影片。")
-		h.bot.Send(msg)
+		msg := tgbotapi.NewMessage(chatID, "歡迎使用，請輸入您想問的內容，或使用 `/get [提示詞]` 進行一次性查詢，或 `/video [提示詞]` 生成影片。\n"+
+			"使用 `/new [標題]` 開始新的對話，`/chats` 查看並以 `/switch` 切換對話。\n"+
+			h.retentionStatus(ctx, roomConfig, message))
+		h.send(ctx, msg)
 	case "clear":
-		h.redisSvc.ClearMessages(chatID)
-		msg := tgbotapi.NewMessage(chatID, "聊天歷史已清除。")
-		h.bot.Send(msg)
+		h.handleClearCommand(ctx, roomConfig, message)
+	case "model":
+		h.handleModelCommand(ctx, roomConfig, message)
+	case "fallback":
+		h.handleFallbackCommand(ctx, roomConfig, message)
+	case "trigger":
+		h.handleTriggerCommand(ctx, roomConfig, message)
+	case "scope":
+		h.handleScopeCommand(ctx, roomConfig, message)
+	case "cancel":
+		if n := h.cancelChat(chatID, message.MessageID); n > 0 {
+			h.send(ctx, tgbotapi.NewMessage(chatID, fmt.Sprintf("已取消 %d 個進行中的請求。", n)))
+		} else {
+			h.send(ctx, tgbotapi.NewMessage(chatID, "目前沒有進行中的請求。"))
+		}
+	case "usage":
+		h.handleUsageCommand(ctx, roomConfig, message)
+	case "new", "chats", "switch", "rename", "delete":
+		h.handleConversationCommand(ctx, roomConfig, message)
+	case "export":
+		h.handleExportCommand(ctx, roomConfig, message)
+	case "import":
+		h.handleImportCommand(ctx, roomConfig, message)
+	case "retention":
+		h.handleRetentionCommand(ctx, roomConfig, message)
 	default:
 	}
 }
 
-func (h *MergedHandler) handleGetCommand(chatID int64, text string) {
-	prompt := strings.TrimSpace(strings.TrimPrefix(text, "/get"))
+// deploymentFor 回傳聊天室 (或 ctx 中的論壇主題) 使用的模型部署；未設定或未註冊時使用預設部署。
+func (h *MergedHandler) deploymentFor(ctx context.Context, roomConfig *models.RoomConfig) string {
+	if topic := roomConfig.Topic(telegram.TopicID(ctx)); topic != nil && topic.ModelName != "" {
+		if _, ok := h.openaiSvc.Models().Lookup(topic.ModelName); ok {
+			return topic.ModelName
+		}
+		slog.WarnContext(ctx, "主題設定的模型不在模型註冊表中，改用聊天室設定", "chat_id", roomConfig.ChatID, "model", topic.ModelName)
+	}
+	if roomConfig != nil && roomConfig.ModelName != "" {
+		if _, ok := h.openaiSvc.Models().Lookup(roomConfig.ModelName); ok {
+			return roomConfig.ModelName
+		}
+		slog.WarnContext(ctx, "聊天室設定的模型不在模型註冊表中，改用預設部署", "chat_id", roomConfig.ChatID, "model", roomConfig.ModelName)
+	}
+	return h.cfg.Current().DefaultOpenAIDeploymentName
+}
+
+// modelChain 回傳聊天室的主要模型與依序嘗試的備援模型。聊天室自訂的 FallbackModels 優先於
+// 模型註冊表中的 fallbacks，未註冊或重複的模型會被略過。
+func (h *MergedHandler) modelChain(ctx context.Context, roomConfig *models.RoomConfig) []string {
+	primary := h.deploymentFor(ctx, roomConfig)
+	if primary == "" {
+		return nil
+	}
+	registry := h.openaiSvc.Models()
+	fallbacks := []string(nil)
+	if spec, ok := registry.Lookup(primary); ok {
+		fallbacks = spec.Fallbacks
+	}
+	if roomConfig != nil && len(roomConfig.FallbackModels) > 0 {
+		fallbacks = roomConfig.FallbackModels
+	}
+
+	chain := []string{primary}
+	seen := map[string]bool{primary: true}
+	for _, name := range fallbacks {
+		if seen[name] {
+			continue
+		}
+		if _, ok := registry.Lookup(name); !ok {
+			slog.Warn("備援模型不在模型註冊表中，略過", "model", name)
+			continue
+		}
+		seen[name] = true
+		chain = append(chain, name)
+	}
+	return chain
+}
+
+func (h *MergedHandler) handleModelCommand(ctx context.Context, roomConfig *models.RoomConfig, message *tgbotapi.Message) {
+	chatID := message.Chat.ID
+	arg := strings.TrimSpace(message.CommandArguments())
+	registry := h.openaiSvc.Models()
+	current := h.deploymentFor(ctx, roomConfig)
+
+	if arg == "" {
+		var sb strings.Builder
+		sb.WriteString(fmt.Sprintf("目前使用的模型: %s\n\n可用模型:\n", current))
+		for _, name := range registry.Deployments() {
+			spec, _ := registry.Lookup(name)
+			marker := "  "
+			if name == current {
+				marker = "▶ "
+			}
+			sb.WriteString(fmt.Sprintf("%s%s (%s) - 上下文 %d tokens, 最大輸出 %d tokens%s\n",
+				marker, name, spec.Model, spec.ContextWindow, spec.MaxOutputTokens, describeCapabilities(spec.Capabilities)))
+		}
+		sb.WriteString("\n使用 /model <部署名稱> 切換模型。")
+		h.send(ctx, tgbotapi.NewMessage(chatID, sb.String()))
+		return
+	}
+	if !h.isChatAdmin(ctx, message) {
+		h.send(ctx, tgbotapi.NewMessage(chatID, "只有群組管理員可以切換模型。"))
+		return
+	}
+
+	if _, ok := registry.Lookup(arg); !ok {
+		h.send(ctx, tgbotapi.NewMessage(chatID, fmt.Sprintf("找不到模型 %s。請使用 /model 查看可用模型。", arg)))
+		return
+	}
+
+	// 在論壇主題中只切換該主題的模型
+	topicID := telegram.TopicID(ctx)
+	if topicID != 0 {
+		roomConfig.SetTopic(topicID, func(t *models.TopicConfig) { t.ModelName = arg })
+	} else {
+		roomConfig.ModelName = arg
+	}
+	if err := h.redisSvc.SaveRoomConfig(ctx, roomConfig); err != nil {
+		slog.ErrorContext(ctx, "保存聊天室模型設定失敗", "chat_id", chatID, "error", err)
+		h.send(ctx, tgbotapi.NewMessage(chatID, "無法保存模型設定，請稍後再試。"))
+		return
+	}
+	slog.InfoContext(ctx, "聊天室模型已切換", "chat_id", chatID, "topic_id", topicID, "model", arg)
+	h.send(ctx, tgbotapi.NewMessage(chatID, fmt.Sprintf("模型已切換為 %s。", arg)))
+}
+
+// handleFallbackCommand 顯示或設定聊天室的備援模型順序。
+// /fallback 顯示目前順序及斷路器狀態，/fallback <模型> [模型...] 設定，/fallback clear 改回註冊表預設。
+func (h *MergedHandler) handleFallbackCommand(ctx context.Context, roomConfig *models.RoomConfig, message *tgbotapi.Message) {
+	chatID := message.Chat.ID
+	args := strings.Fields(message.CommandArguments())
+	if len(args) == 0 {
+		var sb strings.Builder
+		sb.WriteString("模型嘗試順序:\n")
+		for i, name := range h.modelChain(ctx, roomConfig) {
+			sb.WriteString(fmt.Sprintf("%d. %s (斷路器: %s)\n", i+1, name, h.openaiSvc.BreakerState(name)))
+		}
+		sb.WriteString("\n使用 /fallback <模型> [模型...] 設定備援順序，/fallback clear 改回預設。")
+		h.send(ctx, tgbotapi.NewMessage(chatID, sb.String()))
+		return
+	}
+	if !h.isChatAdmin(ctx, message) {
+		h.send(ctx, tgbotapi.NewMessage(chatID, "只有群組管理員可以變更備援模型。"))
+		return
+	}
+
+	var fallbacks []string
+	if !(len(args) == 1 && args[0] == "clear") {
+		registry := h.openaiSvc.Models()
+		for _, name := range args {
+			if _, ok := registry.Lookup(name); !ok {
+				h.send(ctx, tgbotapi.NewMessage(chatID, fmt.Sprintf("找不到模型 %s。請使用 /model 查看可用模型。", name)))
+				return
+			}
+		}
+		fallbacks = args
+	}
+
+	roomConfig.FallbackModels = fallbacks
+	if err := h.redisSvc.SaveRoomConfig(ctx, roomConfig); err != nil {
+		slog.ErrorContext(ctx, "保存聊天室備援模型設定失敗", "chat_id", chatID, "error", err)
+		h.send(ctx, tgbotapi.NewMessage(chatID, "無法保存備援模型設定，請稍後再試。"))
+		return
+	}
+	slog.InfoContext(ctx, "聊天室備援模型已設定", "chat_id", chatID, "fallbacks", fallbacks)
+	h.send(ctx, tgbotapi.NewMessage(chatID, fmt.Sprintf("模型嘗試順序: %s", strings.Join(h.modelChain(ctx, roomConfig), " → "))))
+}
+
+func describeCapabilities(c config.ModelCapabilities) string {
+	var caps []string
+	if c.Vision {
+		caps = append(caps, "視覺")
+	}
+	if c.Tools {
+		caps = append(caps, "工具")
+	}
+	if c.Streaming {
+		caps = append(caps, "串流")
+	}
+	if c.Reasoning {
+		caps = append(caps, "推理")
+	}
+	if len(caps) == 0 {
+		return ""
+	}
+	return " [" + strings.Join(caps, ", ") + "]"
+}
+
+// handleGetCommand 處理一次性的查詢；以 /get 回覆訊息時，被回覆或引用的內容會一併送出。
+func (h *MergedHandler) handleGetCommand(ctx context.Context, roomConfig *models.RoomConfig, message *tgbotapi.Message, quote string) {
+	chatID := message.Chat.ID
+	prompt := strings.TrimSpace(message.CommandArguments())
 	if prompt == "" {
-		h.bot.Send(tgbotapi.NewMessage(chatID, "請在 `/get` 後面加上您想問的問題。"))
+		h.send(ctx, tgbotapi.NewMessage(chatID, "請在 `/get` 後面加上您想問的問題。"))
 		return
 	}
 	
-	// 修正: 始終使用預設部署名稱
-	deploymentName := h.cfg.DefaultOpenAIDeploymentName
+	deploymentName := h.deploymentFor(ctx, roomConfig)
 	if deploymentName == "" {
-		log.Printf("錯誤：預設模型部署名稱為空，無法處理 /get 請求。")
-		h.bot.Send(tgbotapi.NewMessage(chatID, "預設模型部署名稱未設定，無法處理您的請求。請檢查 `.env` 檔案。"))
+		slog.ErrorContext(ctx, "預設模型部署名稱為空，無法處理 /get 請求")
+		h.send(ctx, tgbotapi.NewMessage(chatID, "預設模型部署名稱未設定，無法處理您的請求。請檢查 `.env` 檔案。"))
 		return
 	}
 
-	messages := []models.Message{
-		{Role: "user", Content: prompt},
+	if !h.checkQuota(ctx, roomConfig, services.QuotaUnitTokens, 0) {
+		return
 	}
+
+	userMsg := userMessage(message, h.withReference(message, referencedText(message, quote), prompt))
+	messages := withSystemPrompt(h.systemPrompt(ctx, roomConfig), []models.Message{
+		{Role: "user", Content: userMsg.Content},
+	})
 	
-	response, err := h.openaiSvc.GetChatCompletion("", deploymentName, messages)
+	response, err := h.openaiSvc.GetChatCompletion(ctx, "", h.modelChain(ctx, roomConfig), messages)
 	if err != nil {
-		log.Printf("從 OpenAI 獲取回應失敗: %v", err)
-		h.bot.Send(tgbotapi.NewMessage(chatID, "從 AI 獲取回應時發生錯誤。"))
+		slog.ErrorContext(ctx, "從 OpenAI 獲取回應失敗", "chat_id", chatID, "error", err)
+		h.replyError(ctx, chatID, "從 AI 獲取回應時發生錯誤。")
 		return
 	}
+	h.recordChatUsage(ctx, chatID, senderID(message), response)
 	
-	h.bot.Send(tgbotapi.NewMessage(chatID, response))
+	turn := &models.Turn{
+		History:       models.HistoryKey{ChatID: chatID, TopicID: telegram.TopicID(ctx)},
+		UserMessageID: message.MessageID,
+		User:          userMsg,
+		Assistant:     assistantMessage(response.Content),
+		Standalone:    true,
+	}
+	msg := tgbotapi.NewMessage(chatID, response.Content)
+	if _, keep := h.historyRetention(roomConfig); keep {
+		// 不保存聊天歷史時沒有訊息索引，按鈕無法使用
+		msg.ReplyMarkup = replyKeyboard(turn)
+	}
+	sent, err := h.send(ctx, msg)
+	if err == nil {
+		turn.BotMessageID = sent.MessageID
+		h.saveTurn(ctx, roomConfig, turn)
+	}
+	h.warnQuota(ctx, roomConfig, services.QuotaUnitTokens)
 }
 
-func (h *MergedHandler) handleChatCompletion(chatID int64, text string) {
-	messages, err := h.redisSvc.GetMessages(chatID)
+// handleChatCompletion 以 prompt (已去除 @機器人 或觸發前綴的訊息內容) 延續聊天。
+// 回覆其他訊息時，被回覆或引用 (quote) 的內容會作為這一輪的上下文。
+func (h *MergedHandler) handleChatCompletion(ctx context.Context, roomConfig *models.RoomConfig, message *tgbotapi.Message, prompt, quote string) {
+	chatID := message.Chat.ID
+	historyKey, err := h.historyKey(ctx, roomConfig, message)
+	if err != nil {
+		slog.ErrorContext(ctx, "判斷聊天歷史範圍失敗", "chat_id", chatID, "error", err)
+		return
+	}
+	messages, err := h.redisSvc.GetMessages(ctx, historyKey)
 	if err != nil {
-		log.Printf("獲取聊天歷史失敗: %v", err)
+		slog.ErrorContext(ctx, "獲取聊天歷史失敗", "chat_id", chatID, "error", err)
 		return
 	}
-	messages = append(messages, models.Message{Role: "user", Content: text})
+	// restoreTurn 找回的一問一答與這一輪會附加在已保存的歷史之後
+	stored := len(messages)
+	messages, restored := h.restoreTurn(ctx, roomConfig, message, messages)
+	reference := referencedText(message, quote)
+	if restored && quote == "" {
+		// 被回覆的回答已在上下文中，不再重複附上
+		reference = ""
+	}
+	if prompt == "" {
+		// 只提及機器人並回覆某則訊息
+		prompt = "請針對上面的訊息回應。"
+	}
+	userMsg := userMessage(message, h.withReference(message, reference, prompt))
+	messages = append(messages, userMsg)
 	
-	deploymentName := h.cfg.DefaultOpenAIDeploymentName
+	deploymentName := h.deploymentFor(ctx, roomConfig)
 	if deploymentName == "" {
-		log.Printf("錯誤：預設模型部署名稱為空，無法處理聊天請求。")
-		h.bot.Send(tgbotapi.NewMessage(chatID, "預設模型部署名稱未設定，無法處理您的請求。請檢查 `.env` 檔案。"))
+		slog.ErrorContext(ctx, "預設模型部署名稱為空，無法處理聊天請求")
+		h.send(ctx, tgbotapi.NewMessage(chatID, "預設模型部署名稱未設定，無法處理您的請求。請檢查 `.env` 檔案。"))
 		return
 	}
 
-	trimmedMessages, _ := h.openaiSvc.TrimMessages(deploymentName, messages)
-	
-	response, err := h.openaiSvc.GetChatCompletion("", deploymentName, trimmedMessages)
+	if !h.checkQuota(ctx, roomConfig, services.QuotaUnitTokens, 0) {
+		return
+	}
+
+	response, err := h.openaiSvc.GetChatCompletion(ctx, "", h.modelChain(ctx, roomConfig),
+		withSystemPrompt(h.systemPrompt(ctx, roomConfig), h.attributeSpeakers(roomConfig, message.Chat, messages)))
 	if err != nil {
-		log.Printf("從 OpenAI 獲取回應失敗: %v", err)
-		h.bot.Send(tgbotapi.NewMessage(chatID, "從 AI 獲取回應時發生錯誤。"))
+		slog.ErrorContext(ctx, "從 OpenAI 獲取回應失敗", "chat_id", chatID, "error", err)
+		h.replyError(ctx, chatID, "從 AI 獲取回應時發生錯誤。")
 		return
 	}
-	messages = append(messages, models.Message{Role: "assistant", Content: response})
-	h.redisSvc.SaveMessages(chatID, messages)
+	h.recordChatUsage(ctx, chatID, senderID(message), response)
+	assistantMsg := assistantMessage(response.Content)
+	messages = append(messages, assistantMsg)
+	ttl, keep := h.historyRetention(roomConfig)
+	if keep {
+		if err := h.redisSvc.AppendMessages(ctx, historyKey, messages[stored:], h.cfg.Current().HistoryMaxMessages, ttl); err != nil {
+			slog.ErrorContext(ctx, "保存聊天歷史失敗", "chat_id", chatID, "error", err)
+		}
+		h.touchConversation(ctx, historyKey, prompt, ttl)
+	}
 	
-	msg := tgbotapi.NewMessage(chatID, response)
-	h.bot.Send(msg)
+	turn := &models.Turn{
+		History:       historyKey,
+		UserMessageID: message.MessageID,
+		User:          userMsg,
+		Assistant:     assistantMsg,
+	}
+	msg := tgbotapi.NewMessage(chatID, response.Content)
+	if keep {
+		msg.ReplyMarkup = replyKeyboard(turn)
+	}
+	scope := h.historyScope(roomConfig, message.Chat)
+	if scope != models.HistoryShared {
+		// 各自的歷史時以回覆標示是回答誰，回覆串範圍也靠回覆關係延續
+		msg.ReplyToMessageID = message.MessageID
+	}
+	sent, err := h.send(ctx, msg)
+	if err == nil {
+		turn.BotMessageID = sent.MessageID
+		h.saveTurn(ctx, roomConfig, turn)
+	}
+	if err == nil && keep && scope == models.HistoryPerThread {
+		if err := h.redisSvc.SetThreadRoot(ctx, chatID, historyKey.RootID, ttl, message.MessageID, sent.MessageID); err != nil {
+			slog.ErrorContext(ctx, "記錄回覆串失敗", "chat_id", chatID, "error", err)
+		}
+	}
+	h.warnQuota(ctx, roomConfig, services.QuotaUnitTokens)
 }
 
-func (h *MergedHandler) handleVideoCommand(chatID int64, text string) {
-	prompt := strings.TrimSpace(strings.TrimPrefix(text, "/video"))
+func (h *MergedHandler) handleVideoCommand(ctx context.Context, roomConfig *models.RoomConfig, message *tgbotapi.Message) {
+	chatID := message.Chat.ID
+	prompt := strings.TrimSpace(message.CommandArguments())
 	if prompt == "" {
-		h.bot.Send(tgbotapi.NewMessage(chatID, "請在 `/video` 後面加上影片描述。"))
+		h.send(ctx, tgbotapi.NewMessage(chatID, "請在 `/video` 後面加上影片描述。"))
 		return
 	}
 	
-	log.Printf("收到影片生成請求，提示詞：\"%s\"", prompt)
-	filePath, err := h.soraSvc.GenerateVideo(chatID, prompt)
+	if !h.checkQuota(ctx, roomConfig, services.QuotaUnitVideoSeconds, int64(h.cfg.Current().SoraDefaultNSeconds)) {
+		return
+	}
+
+	slog.InfoContext(ctx, "收到影片生成請求", "chat_id", chatID, logging.Content("prompt", prompt))
+	video, err := h.soraSvc.GenerateVideo(ctx, chatID, prompt)
 	if err != nil {
-		log.Printf("影片生成失敗: %v", err)
-		h.bot.Send(tgbotapi.NewMessage(chatID, fmt.Sprintf("影片生成失敗: %v", err)))
+		slog.ErrorContext(ctx, "影片生成失敗", "chat_id", chatID, "error", err)
+		h.replyError(ctx, chatID, fmt.Sprintf("影片生成失敗: %v", err))
 		return
 	}
+	if err := h.redisSvc.RecordVideoUsage(context.WithoutCancel(ctx), chatID, senderID(message), video); err != nil {
+		slog.ErrorContext(ctx, "記錄聊天室影片用量失敗", "chat_id", chatID, "error", err)
+	}
+	h.warnQuota(ctx, roomConfig, services.QuotaUnitVideoSeconds)
+	filePath := video.Path
 	
 	videoFile, err := os.Open(filePath)
 	if err != nil {
-		log.Printf("開啟影片檔案失敗: %v", err)
-		h.bot.Send(tgbotapi.NewMessage(chatID, "無法開啟生成的影片檔案。"))
+		slog.ErrorContext(ctx, "開啟影片檔案失敗", "path", filePath, "error", err)
+		h.send(ctx, tgbotapi.NewMessage(chatID, "無法開啟生成的影片檔案。"))
 		return
 	}
 	defer videoFile.Close()
 
 	videoBytes, err := io.ReadAll(videoFile)
 	if err != nil {
-		log.Printf("讀取影片檔案失敗: %v", err)
-		h.bot.Send(tgbotapi.NewMessage(chatID, "無法讀取生成的影片檔案。"))
+		slog.ErrorContext(ctx, "讀取影片檔案失敗", "path", filePath, "error", err)
+		h.send(ctx, tgbotapi.NewMessage(chatID, "無法讀取生成的影片檔案。"))
 		return
 	}
 	
@@ -196,12 +785,20 @@ func (h *MergedHandler) handleVideoCommand(chatID int64, text string) {
 	}
 	
 	videoMsg := tgbotapi.NewVideo(chatID, file)
-	_, err = h.bot.Send(videoMsg)
+	_, err = h.send(ctx, videoMsg)
 	if err != nil {
-		log.Printf("發送影片失敗: %v", err)
-		h.bot.Send(tgbotapi.NewMessage(chatID, "發送影片失敗。"))
+		slog.ErrorContext(ctx, "發送影片失敗", "chat_id", chatID, "error", err)
+		h.send(ctx, tgbotapi.NewMessage(chatID, "發送影片失敗。"))
 	}
 	
 	os.Remove(filePath)
-	log.Printf("已刪除臨時影片檔案：%s", filePath)
-}
\ No newline at end of file
+	slog.InfoContext(ctx, "已刪除臨時影片檔案", "path", filePath)
+}
+
+// withSystemPrompt 在送出前加上設定的系統提示詞；提示詞不會寫入聊天歷史。
+func withSystemPrompt(systemPrompt string, messages []models.Message) []models.Message {
+	if systemPrompt == "" {
+		return messages
+	}
+	return append([]models.Message{{Role: "system", Content: systemPrompt}}, messages...)
+}
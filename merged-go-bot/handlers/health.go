@@ -0,0 +1,232 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+
+	"merged-go-bot/config"
+	"merged-go-bot/logging"
+	"merged-go-bot/services"
+)
+
+const (
+	checkOK      = "ok"
+	checkFailed  = "failed"
+	checkSkipped = "skipped"
+)
+
+// videoTmpDir 與 SoraService 下載影片的暫存目錄相同
+const videoTmpDir = "tmp"
+
+type checkResult struct {
+	Status    string  `json:"status"`
+	LatencyMS float64 `json:"latency_ms"`
+	Detail    string  `json:"detail,omitempty"`
+	Error     string  `json:"error,omitempty"`
+	// CheckedAt 只在結果來自快取 (Azure 探測) 時填寫
+	CheckedAt *time.Time `json:"checked_at,omitempty"`
+}
+
+type healthResponse struct {
+	Status string                 `json:"status"`
+	Uptime string                 `json:"uptime,omitempty"`
+	Checks map[string]checkResult `json:"checks,omitempty"`
+}
+
+// HealthHandler 提供給協調器使用的 /healthz 與 /readyz。
+type HealthHandler struct {
+	cfg       *config.Store
+	redisSvc  *services.RedisService
+	openaiSvc *services.OpenAIService
+	bot       *tgbotapi.BotAPI
+	merged    *MergedHandler
+	started   time.Time
+
+	// Azure 探測會消耗 token，結果在 ReadinessProbeInterval 內重複使用
+	probeMu   sync.Mutex
+	lastProbe checkResult
+	probedAt  time.Time
+}
+
+func NewHealthHandler(cfg *config.Store, redisSvc *services.RedisService, openaiSvc *services.OpenAIService, bot *tgbotapi.BotAPI, merged *MergedHandler) *HealthHandler {
+	return &HealthHandler{
+		cfg:       cfg,
+		redisSvc:  redisSvc,
+		openaiSvc: openaiSvc,
+		bot:       bot,
+		merged:    merged,
+		started:   time.Now(),
+	}
+}
+
+// HandleHealthz 只表示程序仍在運作，不檢查任何外部依賴。
+func (h *HealthHandler) HandleHealthz(w http.ResponseWriter, r *http.Request) {
+	writeHealth(r.Context(), w, http.StatusOK, healthResponse{
+		Status: checkOK,
+		Uptime: time.Since(h.started).Round(time.Second).String(),
+	})
+}
+
+// HandleReadyz 同時執行所有就緒檢查，任一檢查失敗時回傳 503。
+func (h *HealthHandler) HandleReadyz(w http.ResponseWriter, r *http.Request) {
+	cfg := h.cfg.Current()
+	ctx, cancel := context.WithTimeout(r.Context(), cfg.ReadinessTimeout)
+	defer cancel()
+
+	checks := map[string]func(context.Context) checkResult{
+		"redis":       h.checkRedis,
+		"telegram":    h.checkTelegram,
+		"azure":       h.checkAzure,
+		"tmp_dir":     h.checkTmpDir,
+		"queue_depth": h.checkQueueDepth,
+	}
+
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	results := make(map[string]checkResult, len(checks))
+	for name, check := range checks {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			result := check(ctx)
+			mu.Lock()
+			results[name] = result
+			mu.Unlock()
+		}()
+	}
+	wg.Wait()
+
+	resp := healthResponse{Status: checkOK, Checks: results}
+	status := http.StatusOK
+	for name, result := range results {
+		if result.Status == checkFailed {
+			resp.Status = checkFailed
+			status = http.StatusServiceUnavailable
+			slog.WarnContext(r.Context(), "就緒檢查失敗", "check", name, "error", result.Error, "detail", result.Detail)
+		}
+	}
+	writeHealth(r.Context(), w, status, resp)
+}
+
+func (h *HealthHandler) checkRedis(ctx context.Context) checkResult {
+	return timed(func() (string, error) {
+		return "", h.redisSvc.Ping(ctx)
+	})
+}
+
+// checkTelegram 呼叫 getMe；tgbotapi 不支援 context，逾時後不等待請求結束。
+func (h *HealthHandler) checkTelegram(ctx context.Context) checkResult {
+	return timed(func() (string, error) {
+		type getMeResult struct {
+			user tgbotapi.User
+			err  error
+		}
+		done := make(chan getMeResult, 1)
+		go func() {
+			user, err := h.bot.GetMe()
+			done <- getMeResult{user, err}
+		}()
+		select {
+		case <-ctx.Done():
+			return "", ctx.Err()
+		case res := <-done:
+			if res.err != nil {
+				return "", res.err
+			}
+			return "@" + res.user.UserName, nil
+		}
+	})
+}
+
+func (h *HealthHandler) checkAzure(ctx context.Context) checkResult {
+	cfg := h.cfg.Current()
+	if !cfg.ReadinessAzureProbe {
+		return checkResult{Status: checkSkipped, Detail: "READINESS_AZURE_PROBE 未啟用"}
+	}
+
+	h.probeMu.Lock()
+	defer h.probeMu.Unlock()
+	if !h.probedAt.IsZero() && time.Since(h.probedAt) < cfg.ReadinessProbeInterval {
+		cached := h.lastProbe
+		checkedAt := h.probedAt
+		cached.CheckedAt = &checkedAt
+		return cached
+	}
+
+	deployment := cfg.DefaultOpenAIDeploymentName
+	result := timed(func() (string, error) {
+		return deployment, h.openaiSvc.Probe(ctx, deployment)
+	})
+	// 請求本身被取消時不快取結果，以免下次檢查沿用
+	if ctx.Err() == nil {
+		h.lastProbe = result
+		h.probedAt = time.Now()
+	}
+	return result
+}
+
+// checkTmpDir 確認 Sora 影片暫存目錄可以寫入。
+func (h *HealthHandler) checkTmpDir(ctx context.Context) checkResult {
+	return timed(func() (string, error) {
+		if err := os.MkdirAll(videoTmpDir, 0755); err != nil {
+			return videoTmpDir, err
+		}
+		f, err := os.CreateTemp(videoTmpDir, ".readyz-*")
+		if err != nil {
+			return videoTmpDir, err
+		}
+		name := f.Name()
+		_, werr := f.WriteString("ok")
+		cerr := f.Close()
+		os.Remove(name)
+		if werr != nil {
+			return videoTmpDir, werr
+		}
+		return videoTmpDir, cerr
+	})
+}
+
+func (h *HealthHandler) checkQueueDepth(ctx context.Context) checkResult {
+	return timed(func() (string, error) {
+		depth := h.merged.QueueDepth()
+		limit := h.cfg.Current().MaxQueueDepth
+		detail := fmt.Sprintf("%d/%d", depth, limit)
+		if depth >= int64(limit) {
+			return detail, fmt.Errorf("處理中的 update 數量已達上限")
+		}
+		return detail, nil
+	})
+}
+
+func timed(check func() (string, error)) checkResult {
+	start := time.Now()
+	detail, err := check()
+	result := checkResult{
+		Status:    checkOK,
+		LatencyMS: float64(time.Since(start).Microseconds()) / 1000,
+		Detail:    detail,
+	}
+	if err != nil {
+		result.Status = checkFailed
+		// 錯誤訊息可能含有請求網址 (Telegram 的網址帶有 bot token)
+		result.Error = logging.Redact(err.Error())
+	}
+	return result
+}
+
+func writeHealth(ctx context.Context, w http.ResponseWriter, status int, resp healthResponse) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(resp); err != nil {
+		slog.ErrorContext(ctx, "編碼健康檢查回應失敗", "error", err)
+	}
+}
@@ -0,0 +1,306 @@
+package handlers
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"strings"
+	"time"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+
+	"merged-go-bot/models"
+	"merged-go-bot/telegram"
+)
+
+// historyScope 回傳聊天室的聊天歷史範圍；私人聊天一律共用。
+func (h *MergedHandler) historyScope(roomConfig *models.RoomConfig, chat *tgbotapi.Chat) string {
+	if chat.IsPrivate() {
+		return models.HistoryShared
+	}
+	if roomConfig != nil && roomConfig.HistoryScope != "" {
+		return roomConfig.HistoryScope
+	}
+	return h.cfg.Current().GroupHistoryScope
+}
+
+// retentionSetting 回傳聊天室的聊天歷史保存時間設定，未設定時使用全域預設值。
+func (h *MergedHandler) retentionSetting(roomConfig *models.RoomConfig) string {
+	if roomConfig != nil && roomConfig.HistoryRetention != "" {
+		return roomConfig.HistoryRetention
+	}
+	return h.cfg.Current().HistoryRetention
+}
+
+// historyRetention 回傳聊天室的聊天歷史保存時間；keep 為 false 時不保存，ttl 為 0 時永久保存。
+// 無法解析的設定視為不保存。
+func (h *MergedHandler) historyRetention(roomConfig *models.RoomConfig) (ttl time.Duration, keep bool) {
+	ttl, keep, _ = models.ParseRetention(h.retentionSetting(roomConfig))
+	return ttl, keep
+}
+
+// historyKey 回傳訊息所屬的聊天歷史。回覆串範圍時，回覆已知訊息的人會接續該串，
+// 其他訊息則以自己為第一則訊息開始新的串；其他範圍使用目前切換到的具名對話。
+func (h *MergedHandler) historyKey(ctx context.Context, roomConfig *models.RoomConfig, message *tgbotapi.Message) (models.HistoryKey, error) {
+	key := models.HistoryKey{ChatID: message.Chat.ID, TopicID: telegram.TopicID(ctx)}
+	switch h.historyScope(roomConfig, message.Chat) {
+	case models.HistoryShared:
+		id, err := h.redisSvc.GetActiveConversation(ctx, key)
+		key.ConversationID = id
+		return key, err
+	case models.HistoryPerUser:
+		key.UserID = senderID(message)
+		id, err := h.redisSvc.GetActiveConversation(ctx, key)
+		key.ConversationID = id
+		return key, err
+	case models.HistoryPerThread:
+		key.RootID = message.MessageID
+		if reply := message.ReplyToMessage; reply != nil {
+			root, err := h.redisSvc.GetThreadRoot(ctx, message.Chat.ID, reply.MessageID)
+			if err != nil {
+				return key, err
+			}
+			if root == 0 {
+				root = reply.MessageID
+			}
+			key.RootID = root
+		}
+	}
+	return key, nil
+}
+
+// isChatAdmin 判斷傳送者是否為群組的建立者或管理員；匿名管理員以群組本身的身份發言。
+func (h *MergedHandler) isChatAdmin(ctx context.Context, message *tgbotapi.Message) bool {
+	if message.Chat.IsPrivate() {
+		return true
+	}
+	if message.SenderChat != nil && message.SenderChat.ID == message.Chat.ID {
+		return true
+	}
+	if message.From == nil {
+		return false
+	}
+	return h.isMemberAdmin(ctx, message.Chat.ID, message.From.ID)
+}
+
+// isMemberAdmin 查詢使用者是否為群組的建立者或管理員。
+func (h *MergedHandler) isMemberAdmin(ctx context.Context, chatID, userID int64) bool {
+	member, err := h.bot.GetChatMember(tgbotapi.GetChatMemberConfig{
+		ChatConfigWithUser: tgbotapi.ChatConfigWithUser{ChatID: chatID, UserID: userID},
+	})
+	if err != nil {
+		slog.ErrorContext(ctx, "查詢群組成員身份失敗", "chat_id", chatID, "user_id", userID, "error", err)
+		return false
+	}
+	return member.IsCreator() || member.IsAdministrator()
+}
+
+// handleClearCommand 清除呼叫者所屬範圍的聊天歷史；群組管理員可用 /clear all 清除整個聊天室。
+// 回覆串範圍時需回覆串中的訊息，才知道要清除哪一串。
+func (h *MergedHandler) handleClearCommand(ctx context.Context, roomConfig *models.RoomConfig, message *tgbotapi.Message) {
+	chatID := message.Chat.ID
+	if strings.EqualFold(strings.TrimSpace(message.CommandArguments()), "all") {
+		if !h.isChatAdmin(ctx, message) {
+			h.send(ctx, tgbotapi.NewMessage(chatID, "只有群組管理員可以清除所有人的聊天歷史。"))
+			return
+		}
+		// 在論壇主題中只清除該主題
+		topicID := telegram.TopicID(ctx)
+		n, err := h.redisSvc.ClearAllMessages(ctx, models.HistoryKey{ChatID: chatID, TopicID: topicID})
+		if err != nil {
+			slog.ErrorContext(ctx, "清除聊天室所有聊天歷史失敗", "chat_id", chatID, "error", err)
+			h.send(ctx, tgbotapi.NewMessage(chatID, "無法清除聊天歷史，請稍後再試。"))
+			return
+		}
+		slog.InfoContext(ctx, "已清除聊天室所有聊天歷史", "chat_id", chatID, "topic_id", topicID, "deleted", n)
+		if topicID != 0 {
+			h.send(ctx, tgbotapi.NewMessage(chatID, "此主題內所有聊天歷史已清除。"))
+		} else {
+			h.send(ctx, tgbotapi.NewMessage(chatID, "聊天室內所有聊天歷史已清除。"))
+		}
+		return
+	}
+
+	scope := h.historyScope(roomConfig, message.Chat)
+	if scope == models.HistoryShared && !h.isChatAdmin(ctx, message) {
+		h.send(ctx, tgbotapi.NewMessage(chatID, "此群組共用聊天歷史，只有群組管理員可以清除。"))
+		return
+	}
+	if scope == models.HistoryPerThread && message.ReplyToMessage == nil {
+		h.send(ctx, tgbotapi.NewMessage(chatID, "請以 /clear 回覆要清除的對話串中的訊息，或由管理員使用 /clear all 清除全部。"))
+		return
+	}
+	key, err := h.historyKey(ctx, roomConfig, message)
+	if err == nil {
+		err = h.redisSvc.ClearMessages(ctx, key)
+	}
+	if err != nil {
+		slog.ErrorContext(ctx, "清除聊天歷史失敗", "chat_id", chatID, "error", err)
+		h.send(ctx, tgbotapi.NewMessage(chatID, "無法清除聊天歷史，請稍後再試。"))
+		return
+	}
+
+	text := "聊天歷史已清除。"
+	switch scope {
+	case models.HistoryPerUser:
+		text = "您的聊天歷史已清除。"
+	case models.HistoryPerThread:
+		text = "此對話串的聊天歷史已清除。"
+	}
+	h.send(ctx, tgbotapi.NewMessage(chatID, text))
+}
+
+// handleScopeCommand 顯示或設定群組的聊天歷史範圍：/scope、/scope shared|per_user|per_thread、/scope default。
+// 變更範圍等於隱藏或分開所有人的聊天歷史，只有管理員可以變更。
+func (h *MergedHandler) handleScopeCommand(ctx context.Context, roomConfig *models.RoomConfig, message *tgbotapi.Message) {
+	chatID := message.Chat.ID
+	if message.Chat.IsPrivate() {
+		h.send(ctx, tgbotapi.NewMessage(chatID, "私人聊天只有一段聊天歷史，歷史範圍只適用於群組。"))
+		return
+	}
+
+	arg := strings.ToLower(strings.TrimSpace(message.CommandArguments()))
+	if arg == "" {
+		h.send(ctx, tgbotapi.NewMessage(chatID, fmt.Sprintf("目前的聊天歷史範圍: %s\n\n%s", describeScope(h.historyScope(roomConfig, message.Chat)),
+			"使用 /scope shared|per_user|per_thread 設定，/scope default 改回預設。")))
+		return
+	}
+	if !h.isChatAdmin(ctx, message) {
+		h.send(ctx, tgbotapi.NewMessage(chatID, "只有群組管理員可以變更聊天歷史範圍。"))
+		return
+	}
+	if arg == "default" {
+		arg = ""
+	} else if !models.ValidHistoryScope(arg) {
+		h.send(ctx, tgbotapi.NewMessage(chatID, fmt.Sprintf("未知的歷史範圍 %s。可用範圍: shared、per_user、per_thread。", arg)))
+		return
+	}
+
+	roomConfig.HistoryScope = arg
+	if err := h.redisSvc.SaveRoomConfig(ctx, roomConfig); err != nil {
+		slog.ErrorContext(ctx, "保存聊天室歷史範圍失敗", "chat_id", chatID, "error", err)
+		h.send(ctx, tgbotapi.NewMessage(chatID, "無法保存歷史範圍，請稍後再試。"))
+		return
+	}
+	scope := h.historyScope(roomConfig, message.Chat)
+	slog.InfoContext(ctx, "聊天室歷史範圍已設定", "chat_id", chatID, "history_scope", scope)
+	h.send(ctx, tgbotapi.NewMessage(chatID, fmt.Sprintf("聊天歷史範圍已設定為: %s", describeScope(scope))))
+}
+
+func describeScope(scope string) string {
+	switch scope {
+	case models.HistoryShared:
+		return "shared (整個群組共用)"
+	case models.HistoryPerUser:
+		return "per_user (每位成員各自的歷史)"
+	case models.HistoryPerThread:
+		return "per_thread (每個回覆串各自的歷史)"
+	}
+	return scope
+}
+
+// handleRetentionCommand 顯示或設定聊天歷史的保存時間：/retention、/retention ephemeral|12h|7d|forever、/retention default。
+// 群組中只有管理員可以變更；改為 ephemeral 時立即刪除既有的聊天歷史，其他設定立即套用到既有的歷史。
+func (h *MergedHandler) handleRetentionCommand(ctx context.Context, roomConfig *models.RoomConfig, message *tgbotapi.Message) {
+	chatID := message.Chat.ID
+	arg := strings.ToLower(strings.TrimSpace(message.CommandArguments()))
+	if arg == "" {
+		h.send(ctx, tgbotapi.NewMessage(chatID, fmt.Sprintf("目前的聊天歷史保存時間: %s\n\n%s", describeRetention(h.retentionSetting(roomConfig)),
+			"使用 /retention ephemeral|12h|7d|forever 設定，/retention default 改回預設。")))
+		return
+	}
+	if !h.isChatAdmin(ctx, message) {
+		h.send(ctx, tgbotapi.NewMessage(chatID, "只有群組管理員可以變更聊天歷史的保存時間。"))
+		return
+	}
+	if arg == "default" {
+		arg = ""
+	} else if _, _, err := models.ParseRetention(arg); err != nil {
+		h.send(ctx, tgbotapi.NewMessage(chatID, fmt.Sprintf("未知的保存時間 %s。可用設定: ephemeral (不保存)、forever (永久保存)、N 小時 (例如 12h) 或 N 天 (例如 7d)。", arg)))
+		return
+	}
+
+	roomConfig.HistoryRetention = arg
+	if err := h.redisSvc.SaveRoomConfig(ctx, roomConfig); err != nil {
+		slog.ErrorContext(ctx, "保存聊天歷史保存時間失敗", "chat_id", chatID, "error", err)
+		h.send(ctx, tgbotapi.NewMessage(chatID, "無法保存聊天歷史的保存時間，請稍後再試。"))
+		return
+	}
+	setting := h.retentionSetting(roomConfig)
+	slog.InfoContext(ctx, "聊天歷史保存時間已設定", "chat_id", chatID, "history_retention", setting)
+
+	text := fmt.Sprintf("聊天歷史保存時間已設定為: %s", describeRetention(setting))
+	ttl, keep := h.historyRetention(roomConfig)
+	var err error
+	if !keep {
+		if _, err = h.redisSvc.ClearAllMessages(ctx, models.HistoryKey{ChatID: chatID}); err == nil {
+			_, err = h.redisSvc.ClearTurns(ctx, chatID)
+		}
+		text += "\n既有的聊天歷史已全部刪除。"
+	} else {
+		_, err = h.redisSvc.ExpireAllMessages(ctx, chatID, ttl)
+	}
+	if err != nil {
+		slog.ErrorContext(ctx, "套用聊天歷史保存時間失敗", "chat_id", chatID, "error", err)
+		text = fmt.Sprintf("聊天歷史保存時間已設定為: %s，但無法套用到既有的聊天歷史，請稍後再試一次。", describeRetention(setting))
+	}
+	h.send(ctx, tgbotapi.NewMessage(chatID, text))
+}
+
+// retentionStatus 描述聊天歷史的保存時間與目前對話的剩餘時間，顯示在 /start。
+func (h *MergedHandler) retentionStatus(ctx context.Context, roomConfig *models.RoomConfig, message *tgbotapi.Message) string {
+	ttl, keep := h.historyRetention(roomConfig)
+	if !keep {
+		return "此聊天室不保存聊天歷史，每則訊息都會單獨處理。"
+	}
+	setting := fmt.Sprintf("聊天歷史保存時間: %s", describeRetention(h.retentionSetting(roomConfig)))
+	key, err := h.historyKey(ctx, roomConfig, message)
+	var remaining time.Duration
+	var exists bool
+	if err == nil {
+		remaining, exists, err = h.redisSvc.HistoryTTL(ctx, key)
+	}
+	switch {
+	case err != nil:
+		slog.WarnContext(ctx, "查詢聊天歷史保存時間失敗", "chat_id", message.Chat.ID, "error", err)
+		return setting + "。"
+	case !exists:
+		return setting + "，目前沒有聊天歷史。"
+	case ttl == 0 || remaining == 0:
+		return setting + "，可用 /clear 清除。"
+	}
+	return fmt.Sprintf("%s (每次對話後重新計算)，目前的對話將在 %s後清除。", setting, formatDuration(remaining))
+}
+
+func describeRetention(setting string) string {
+	ttl, keep, err := models.ParseRetention(setting)
+	switch {
+	case err != nil:
+		return setting
+	case !keep:
+		return "ephemeral (不保存)"
+	case ttl == 0:
+		return "forever (永久保存)"
+	}
+	return formatDuration(ttl)
+}
+
+// formatDuration 以天、小時與分鐘描述時間長度，例如「1 天 12 小時」。
+func formatDuration(d time.Duration) string {
+	d = d.Round(time.Minute)
+	days, hours, minutes := int(d/(24*time.Hour)), int(d%(24*time.Hour)/time.Hour), int(d%time.Hour/time.Minute)
+	var parts []string
+	if days > 0 {
+		parts = append(parts, fmt.Sprintf("%d 天", days))
+	}
+	if hours > 0 {
+		parts = append(parts, fmt.Sprintf("%d 小時", hours))
+	}
+	if minutes > 0 {
+		parts = append(parts, fmt.Sprintf("%d 分鐘", minutes))
+	}
+	if len(parts) == 0 {
+		return "不到 1 分鐘"
+	}
+	return strings.Join(parts, " ")
+}
@@ -0,0 +1,316 @@
+package handlers
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+
+	"merged-go-bot/models"
+)
+
+// maxImportBytes 限制 /import 下載的檔案大小
+const maxImportBytes = 10 << 20
+
+// openAIConversation 為 ChatGPT 匯出檔 (conversations.json) 中的一段對話。訊息以樹狀的 mapping 保存，
+// 從 current_node 沿著 parent 往回走就是畫面上顯示的那一條分支。
+type openAIConversation struct {
+	Title       string                `json:"title"`
+	CurrentNode string                `json:"current_node"`
+	Mapping     map[string]openAINode `json:"mapping"`
+}
+
+type openAINode struct {
+	Parent  string `json:"parent"`
+	Message *struct {
+		Author struct {
+			Role string `json:"role"`
+		} `json:"author"`
+		Content struct {
+			Parts []json.RawMessage `json:"parts"`
+		} `json:"content"`
+		CreateTime float64 `json:"create_time"`
+	} `json:"message"`
+}
+
+// messages 回傳 current_node 所在分支的訊息，由舊到新。
+func (c *openAIConversation) messages() ([]models.Message, error) {
+	var messages []models.Message
+	for id, steps := c.CurrentNode, 0; id != ""; steps++ {
+		// 沒有訊息的節點 (例如根節點) 也要計入，否則只由這類節點組成的循環不會被發現
+		if steps > len(c.Mapping) {
+			return nil, errors.New("對話的訊息樹有循環")
+		}
+		node, ok := c.Mapping[id]
+		if !ok {
+			return nil, fmt.Errorf("找不到訊息節點 %s", id)
+		}
+		if m := node.Message; m != nil {
+			var parts []string
+			for _, raw := range m.Content.Parts {
+				// 圖片等非文字內容略過
+				var text string
+				if json.Unmarshal(raw, &text) == nil && text != "" {
+					parts = append(parts, text)
+				}
+			}
+			messages = append(messages, models.Message{Role: m.Author.Role, Content: strings.Join(parts, "\n"), Timestamp: int64(m.CreateTime)})
+		}
+		id = node.Parent
+	}
+	for i, j := 0, len(messages)-1; i < j; i, j = i+1, j-1 {
+		messages[i], messages[j] = messages[j], messages[i]
+	}
+	return messages, nil
+}
+
+// parseImport 解析 /import 上傳的 JSON，支援：
+//   - 本機器人 /export json 的匯出檔
+//   - ChatGPT 匯出的 conversations.json (多段對話時以 index 選擇，從 1 開始) 或其中的單一對話
+//   - OpenAI Chat Completions 格式的 {"messages": [...]} 或訊息陣列
+//
+// 只保留 user 與 assistant 的文字訊息；system、tool 等訊息與空白訊息會被略過。
+func parseImport(data []byte, index int) (string, []models.Message, error) {
+	data = bytes.TrimSpace(data)
+	var title string
+	var messages []models.Message
+	switch {
+	case bytes.HasPrefix(data, []byte("[")):
+		var items []json.RawMessage
+		if err := json.Unmarshal(data, &items); err != nil {
+			return "", nil, fmt.Errorf("不是有效的 JSON: %w", err)
+		}
+		if len(items) == 0 {
+			return "", nil, errors.New("檔案中沒有任何對話")
+		}
+		var probe struct {
+			Mapping json.RawMessage `json:"mapping"`
+		}
+		if json.Unmarshal(items[0], &probe) == nil && probe.Mapping != nil {
+			if index < 1 || index > len(items) {
+				return "", nil, fmt.Errorf("檔案中有 %d 段對話，請指定 1 到 %d 之間的編號", len(items), len(items))
+			}
+			var conv openAIConversation
+			if err := json.Unmarshal(items[index-1], &conv); err != nil {
+				return "", nil, fmt.Errorf("無法解析 ChatGPT 對話: %w", err)
+			}
+			msgs, err := conv.messages()
+			if err != nil {
+				return "", nil, err
+			}
+			title, messages = conv.Title, msgs
+		} else if err := json.Unmarshal(data, &messages); err != nil {
+			return "", nil, fmt.Errorf("無法解析訊息陣列: %w", err)
+		}
+	case bytes.HasPrefix(data, []byte("{")):
+		var probe struct {
+			Format      string                `json:"format"`
+			Version     int                   `json:"version"`
+			Title       string                `json:"title"`
+			Messages    []models.Message      `json:"messages"`
+			CurrentNode string                `json:"current_node"`
+			Mapping     map[string]openAINode `json:"mapping"`
+		}
+		if err := json.Unmarshal(data, &probe); err != nil {
+			return "", nil, fmt.Errorf("不是有效的 JSON: %w", err)
+		}
+		switch {
+		case probe.Format != "":
+			if probe.Format != exportFormatName {
+				return "", nil, fmt.Errorf("不支援的匯出格式 %q", probe.Format)
+			}
+			if probe.Version > 1 {
+				return "", nil, fmt.Errorf("不支援的匯出版本 %d", probe.Version)
+			}
+			title, messages = probe.Title, probe.Messages
+		case probe.Mapping != nil:
+			conv := openAIConversation{Title: probe.Title, CurrentNode: probe.CurrentNode, Mapping: probe.Mapping}
+			msgs, err := conv.messages()
+			if err != nil {
+				return "", nil, err
+			}
+			title, messages = conv.Title, msgs
+		case probe.Messages != nil:
+			messages = probe.Messages
+		default:
+			return "", nil, errors.New("無法辨識的檔案格式")
+		}
+	default:
+		return "", nil, errors.New("不是 JSON 檔案")
+	}
+
+	valid := make([]models.Message, 0, len(messages))
+	for _, msg := range messages {
+		if (msg.Role != "user" && msg.Role != "assistant") || strings.TrimSpace(msg.Content) == "" {
+			continue
+		}
+		valid = append(valid, models.Message{
+			Role:       msg.Role,
+			Content:    msg.Content,
+			UserID:     msg.UserID,
+			SenderName: msg.SenderName,
+			Timestamp:  msg.Timestamp,
+		})
+	}
+	if len(valid) == 0 {
+		return "", nil, errors.New("檔案中沒有可匯入的訊息")
+	}
+	return title, valid, nil
+}
+
+// importDocument 回傳 /import 要匯入的檔案：隨指令一起上傳，或指令所回覆的訊息中的檔案。
+func importDocument(message *tgbotapi.Message) *tgbotapi.Document {
+	if message.Document != nil {
+		return message.Document
+	}
+	if message.ReplyToMessage != nil {
+		return message.ReplyToMessage.Document
+	}
+	return nil
+}
+
+// downloadDocument 下載 Telegram 上的檔案。下載網址含有 bot token，錯誤中不保留網址。
+func (h *MergedHandler) downloadDocument(ctx context.Context, doc *tgbotapi.Document) ([]byte, error) {
+	if doc.FileSize > maxImportBytes {
+		return nil, fmt.Errorf("檔案大小 %d bytes 超過上限 %d bytes", doc.FileSize, maxImportBytes)
+	}
+	link, err := h.bot.GetFileDirectURL(doc.FileID)
+	if err != nil {
+		return nil, fmt.Errorf("取得檔案位置失敗: %w", err)
+	}
+	req, err := http.NewRequestWithContext(ctx, "GET", link, nil)
+	if err != nil {
+		return nil, errors.New("建立下載請求失敗")
+	}
+	resp, err := h.bot.Client.Do(req)
+	if err != nil {
+		var urlErr *url.Error
+		if errors.As(err, &urlErr) {
+			err = urlErr.Err
+		}
+		return nil, fmt.Errorf("下載檔案失敗: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("下載檔案失敗，狀態碼 %d", resp.StatusCode)
+	}
+	data, err := io.ReadAll(io.LimitReader(resp.Body, maxImportBytes+1))
+	if err != nil {
+		return nil, fmt.Errorf("讀取檔案失敗: %w", err)
+	}
+	if len(data) > maxImportBytes {
+		return nil, fmt.Errorf("檔案大小超過上限 %d bytes", maxImportBytes)
+	}
+	return data, nil
+}
+
+// captionCommand 讓隨檔案上傳、以指令 (例如 /import) 作為說明的訊息也當作指令處理。
+func captionCommand(message *tgbotapi.Message) {
+	if message.Text != "" || message.Document == nil || len(message.CaptionEntities) == 0 {
+		return
+	}
+	if entity := message.CaptionEntities[0]; entity.Offset == 0 && entity.IsCommand() {
+		message.Text, message.Entities = message.Caption, message.CaptionEntities
+	}
+}
+
+// handleImportCommand 以上傳的 JSON 檔取代目前對話的聊天歷史：隨檔案上傳並以 /import 為說明，
+// 或以 /import [編號] 回覆檔案。超過模型上下文的部分從最舊的訊息開始捨棄。
+func (h *MergedHandler) handleImportCommand(ctx context.Context, roomConfig *models.RoomConfig, message *tgbotapi.Message) {
+	chatID := message.Chat.ID
+	doc := importDocument(message)
+	if doc == nil {
+		h.send(ctx, tgbotapi.NewMessage(chatID, "請上傳 JSON 檔並以 `/import` 作為說明，或以 `/import` 回覆該檔案。支援 /export json 的匯出檔與 ChatGPT 的 conversations.json。"))
+		return
+	}
+	index := 1
+	if args := strings.TrimSpace(message.CommandArguments()); args != "" {
+		n, err := strconv.Atoi(args)
+		if err != nil || n < 1 {
+			h.send(ctx, tgbotapi.NewMessage(chatID, "對話編號必須是正整數，例如 `/import 2` 匯入 conversations.json 中的第 2 段對話。"))
+			return
+		}
+		index = n
+	}
+	ttl, keep := h.historyRetention(roomConfig)
+	if !keep {
+		h.send(ctx, tgbotapi.NewMessage(chatID, "此聊天室設定為不保存聊天歷史 (ephemeral)，無法匯入。"))
+		return
+	}
+	scope := h.historyScope(roomConfig, message.Chat)
+	if scope == models.HistoryPerThread {
+		h.send(ctx, tgbotapi.NewMessage(chatID, "此群組使用回覆串範圍，每個回覆串就是一段對話，不支援匯入聊天歷史。"))
+		return
+	}
+	if scope == models.HistoryShared && !h.isChatAdmin(ctx, message) {
+		h.send(ctx, tgbotapi.NewMessage(chatID, "此群組共用聊天歷史，只有群組管理員可以匯入。"))
+		return
+	}
+
+	data, err := h.downloadDocument(ctx, doc)
+	if err != nil {
+		slog.ErrorContext(ctx, "下載匯入檔案失敗", "chat_id", chatID, "file_name", doc.FileName, "error", err)
+		h.send(ctx, tgbotapi.NewMessage(chatID, fmt.Sprintf("匯入失敗: %v", err)))
+		return
+	}
+	title, messages, err := parseImport(data, index)
+	if err != nil {
+		slog.WarnContext(ctx, "匯入檔案格式錯誤", "chat_id", chatID, "file_name", doc.FileName, "error", err)
+		h.send(ctx, tgbotapi.NewMessage(chatID, fmt.Sprintf("匯入失敗: %v", err)))
+		return
+	}
+
+	// 先套用聊天歷史的則數上限，回報的數量才會與實際保存的相同
+	total := len(messages)
+	maxMessages := h.cfg.Current().HistoryMaxMessages
+	capped := 0
+	if maxMessages > 0 && len(messages) > maxMessages {
+		capped = len(messages) - maxMessages
+		messages = messages[capped:]
+	}
+
+	model := h.deploymentFor(ctx, roomConfig)
+	tokens, err := h.openaiSvc.CountTokens(model, messages)
+	if err != nil {
+		slog.ErrorContext(ctx, "計算匯入訊息的 token 失敗", "chat_id", chatID, "error", err)
+		h.send(ctx, tgbotapi.NewMessage(chatID, "無法計算匯入內容的 token 數，請稍後再試。"))
+		return
+	}
+	if budget := h.openaiSvc.GetModelMaxTokens(model) - h.cfg.Current().ReservedForResponseTokens; tokens > budget {
+		messages, tokens = h.openaiSvc.TrimMessages(ctx, model, messages)
+	}
+	if len(messages) == 0 {
+		h.send(ctx, tgbotapi.NewMessage(chatID, "匯入失敗: 最新的訊息就已超過模型的上下文上限。"))
+		return
+	}
+
+	key, err := h.historyKey(ctx, roomConfig, message)
+	if err == nil {
+		err = h.redisSvc.SaveMessages(ctx, key, messages, maxMessages, ttl)
+	}
+	if err != nil {
+		slog.ErrorContext(ctx, "保存匯入的聊天歷史失敗", "chat_id", chatID, "error", err)
+		h.send(ctx, tgbotapi.NewMessage(chatID, "無法保存匯入的聊天歷史，請稍後再試。"))
+		return
+	}
+	h.touchConversation(ctx, key, title, ttl)
+	slog.InfoContext(ctx, "已匯入聊天歷史", "chat_id", chatID, "file_name", doc.FileName, "messages", len(messages), "dropped", total-len(messages), "tokens", tokens)
+
+	text := fmt.Sprintf("已匯入 %d 則訊息 (%d tokens) 到目前的對話，原本的聊天歷史已被取代。", len(messages), tokens)
+	if capped > 0 {
+		text += fmt.Sprintf("\n超過聊天歷史上限 %d 則，已捨棄最舊的 %d 則訊息。", maxMessages, capped)
+	}
+	if dropped := total - capped - len(messages); dropped > 0 {
+		text += fmt.Sprintf("\n超過模型 %s 的上下文上限，再捨棄最舊的 %d 則訊息。", model, dropped)
+	}
+	h.send(ctx, tgbotapi.NewMessage(chatID, text))
+}
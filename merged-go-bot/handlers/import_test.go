@@ -0,0 +1,108 @@
+package handlers
+
+import (
+	"reflect"
+	"testing"
+
+	"merged-go-bot/models"
+)
+
+// chatGPTConversation 為 ChatGPT 匯出檔中的一段對話：root → u1 → a1 → u2 → a2，
+// 另有一條從 a1 分出、未被選取的分支 u2b。
+const chatGPTConversation = `{
+	"title": "旅行計畫",
+	"current_node": "a2",
+	"mapping": {
+		"root": {"parent": "", "message": null},
+		"sys": {"parent": "root", "message": {"author": {"role": "system"}, "content": {"parts": ["你是助理"]}, "create_time": 1700000000}},
+		"u1": {"parent": "sys", "message": {"author": {"role": "user"}, "content": {"parts": ["去哪裡玩？"]}, "create_time": 1700000001.5}},
+		"a1": {"parent": "u1", "message": {"author": {"role": "assistant"}, "content": {"parts": ["京都", {"asset_pointer": "file-1"}, "或大阪"]}, "create_time": 1700000002}},
+		"u2b": {"parent": "a1", "message": {"author": {"role": "user"}, "content": {"parts": ["被放棄的分支"]}, "create_time": 1700000003}},
+		"u2": {"parent": "a1", "message": {"author": {"role": "user"}, "content": {"parts": ["幾天？"]}, "create_time": 1700000004}},
+		"a2": {"parent": "u2", "message": {"author": {"role": "assistant"}, "content": {"parts": ["三天"]}, "create_time": 1700000005}}
+	}
+}`
+
+func TestParseImport(t *testing.T) {
+	chatGPTMessages := []models.Message{
+		{Role: "user", Content: "去哪裡玩？", Timestamp: 1700000001},
+		{Role: "assistant", Content: "京都\n或大阪", Timestamp: 1700000002},
+		{Role: "user", Content: "幾天？", Timestamp: 1700000004},
+		{Role: "assistant", Content: "三天", Timestamp: 1700000005},
+	}
+	cases := []struct {
+		name      string
+		data      string
+		index     int
+		wantTitle string
+		want      []models.Message
+		wantErr   bool
+	}{
+		{
+			name: "本機器人的匯出檔",
+			data: `{"format": "merged-go-bot/chat-export", "version": 1, "title": "匯出", "history": {"chat_id": 1},
+				"messages": [
+					{"role": "system", "content": "略過"},
+					{"role": "user", "content": "你好", "user_id": 7, "sender_name": "小明", "timestamp": 1700000000},
+					{"role": "assistant", "content": "嗨", "timestamp": 1700000001}
+				]}`,
+			index:     1,
+			wantTitle: "匯出",
+			want: []models.Message{
+				{Role: "user", Content: "你好", UserID: 7, SenderName: "小明", Timestamp: 1700000000},
+				{Role: "assistant", Content: "嗨", Timestamp: 1700000001},
+			},
+		},
+		{name: "不支援的匯出格式", data: `{"format": "other-bot", "messages": [{"role": "user", "content": "x"}]}`, index: 1, wantErr: true},
+		{name: "較新的匯出版本", data: `{"format": "merged-go-bot/chat-export", "version": 2, "messages": [{"role": "user", "content": "x"}]}`, index: 1, wantErr: true},
+		{name: "ChatGPT 單一對話", data: chatGPTConversation, index: 1, wantTitle: "旅行計畫", want: chatGPTMessages},
+		{
+			name:      "ChatGPT conversations.json 選擇第 2 段",
+			data:      `[{"title": "第一段", "current_node": "x", "mapping": {"x": {"parent": "", "message": {"author": {"role": "user"}, "content": {"parts": ["one"]}}}}}, ` + chatGPTConversation + `]`,
+			index:     2,
+			wantTitle: "旅行計畫",
+			want:      chatGPTMessages,
+		},
+		{name: "ChatGPT 編號超出範圍", data: `[` + chatGPTConversation + `]`, index: 2, wantErr: true},
+		{name: "ChatGPT 訊息樹有循環", data: `{"current_node": "a", "mapping": {"a": {"parent": "b", "message": null}, "b": {"parent": "a", "message": null}}}`, index: 1, wantErr: true},
+		{name: "ChatGPT 缺少節點", data: `{"current_node": "a", "mapping": {"a": {"parent": "missing", "message": null}}}`, index: 1, wantErr: true},
+		{
+			name:  "Chat Completions 物件",
+			data:  `{"messages": [{"role": "system", "content": "s"}, {"role": "user", "content": "q"}, {"role": "assistant", "content": "a"}]}`,
+			index: 1,
+			want:  []models.Message{{Role: "user", Content: "q"}, {Role: "assistant", Content: "a"}},
+		},
+		{
+			name:  "訊息陣列",
+			data:  `  [{"role": "user", "content": "q"}, {"role": "tool", "content": "t"}, {"role": "assistant", "content": "  "}, {"role": "assistant", "content": "a", "name": "bot"}]`,
+			index: 1,
+			want:  []models.Message{{Role: "user", Content: "q"}, {Role: "assistant", Content: "a"}},
+		},
+		{name: "空陣列", data: `[]`, index: 1, wantErr: true},
+		{name: "沒有可匯入的訊息", data: `{"messages": [{"role": "system", "content": "s"}]}`, index: 1, wantErr: true},
+		{name: "無法辨識的物件", data: `{"foo": 1}`, index: 1, wantErr: true},
+		{name: "損壞的 JSON 物件", data: `{"messages": [`, index: 1, wantErr: true},
+		{name: "損壞的 JSON 陣列", data: `[{"role": "user"`, index: 1, wantErr: true},
+		{name: "不是 JSON", data: "# 標題\n\n內容", index: 1, wantErr: true},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			title, messages, err := parseImport([]byte(tc.data), tc.index)
+			if tc.wantErr {
+				if err == nil {
+					t.Fatalf("應回傳錯誤，得到 %d 則訊息", len(messages))
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("回傳錯誤: %v", err)
+			}
+			if title != tc.wantTitle {
+				t.Errorf("標題 = %q，預期 %q", title, tc.wantTitle)
+			}
+			if !reflect.DeepEqual(messages, tc.want) {
+				t.Errorf("訊息 = %+v\n預期 %+v", messages, tc.want)
+			}
+		})
+	}
+}
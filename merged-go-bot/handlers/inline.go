@@ -0,0 +1,196 @@
+package handlers
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"slices"
+	"strings"
+	"time"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+
+	"merged-go-bot/logging"
+	"merged-go-bot/models"
+	"merged-go-bot/services"
+	"merged-go-bot/tracing"
+)
+
+const (
+	// Telegram 訊息文字上限為 4096 個字元
+	maxInlineAnswerRunes = 4096
+	maxInlineDescRunes   = 100
+)
+
+// handleInlineQuery 回應 @機器人 問題 形式的 inline 查詢，與 /get 相同為一次性的問答，不使用聊天歷史。
+// 使用者輸入時每個字都會產生一個查詢，因此等待 InlineDebounce 沒有新的查詢後才呼叫模型。
+func (h *MergedHandler) handleInlineQuery(parent trace.SpanContext, updateID int, query *tgbotapi.InlineQuery) {
+	cfg := h.cfg.Current()
+	if !cfg.InlineEnabled || query.From == nil {
+		return
+	}
+	prompt := strings.TrimSpace(query.Query)
+	if prompt == "" {
+		return
+	}
+	userID := query.From.ID
+
+	ctx, cancel := context.WithTimeout(h.baseCtx, cfg.UpdateTimeout)
+	defer cancel()
+	ctx = logging.WithCorrelationID(ctx, fmt.Sprintf("tg-%d", updateID))
+	ctx, span := tracing.Start(trace.ContextWithSpanContext(ctx, parent), "telegram.inline_query",
+		attribute.Int("telegram.update_id", updateID), attribute.Int64("user.id", userID))
+	defer span.End()
+
+	if !h.debounceInline(ctx, userID, query.ID, cfg.InlineDebounce) {
+		return
+	}
+	slog.InfoContext(ctx, "收到 inline 查詢", "user_id", userID, logging.Content("query", prompt))
+
+	roomConfig, ok := h.authorizeInline(ctx, userID)
+	if !ok {
+		h.answerInline(ctx, query.ID, "無法使用", "此功能僅限已授權聊天室的成員使用。請聯繫管理員。", 0)
+		return
+	}
+
+	model := h.deploymentFor(ctx, roomConfig)
+	if model == "" {
+		slog.ErrorContext(ctx, "預設模型部署名稱為空，無法處理 inline 查詢")
+		return
+	}
+	// 先計算頻率再查快取，快取命中也算一次查詢
+	allowed, err := h.redisSvc.AllowRequest(ctx, fmt.Sprintf("inline:%d", userID), cfg.InlineRateLimit, cfg.InlineRateWindow)
+	if err != nil {
+		// 頻率計算失敗時不阻擋使用者，只記錄錯誤
+		slog.ErrorContext(ctx, "計算 inline 查詢頻率失敗", "user_id", userID, "error", err)
+	} else if !allowed {
+		slog.InfoContext(ctx, "inline 查詢過於頻繁", "user_id", userID, "limit", cfg.InlineRateLimit, "window", cfg.InlineRateWindow)
+		h.answerInline(ctx, query.ID, "查詢太頻繁", fmt.Sprintf("每 %s 最多查詢 %d 次，請稍後再試。", cfg.InlineRateWindow, cfg.InlineRateLimit), 0)
+		return
+	}
+
+	systemPrompt := h.systemPrompt(ctx, roomConfig)
+	if answer, err := h.redisSvc.GetInlineAnswer(ctx, model, systemPrompt, prompt); err != nil {
+		slog.ErrorContext(ctx, "查詢 inline 快取失敗", "user_id", userID, "error", err)
+	} else if answer != "" {
+		h.answerInline(ctx, query.ID, prompt, answer, int(cfg.InlineCacheTTL.Seconds()))
+		return
+	}
+
+	// 用量記在授權的聊天室；只在允許名單中的使用者記在自己的私人聊天
+	chatID := userID
+	if roomConfig != nil {
+		chatID = roomConfig.ChatID
+		if exhausted, err := h.quotaSvc.Check(ctx, roomConfig, services.QuotaUnitTokens, 0); err != nil {
+			slog.ErrorContext(ctx, "檢查聊天室額度失敗", "chat_id", chatID, "error", err)
+		} else if exhausted != nil {
+			h.answerInline(ctx, query.ID, "額度已用完", fmt.Sprintf("聊天室%s的%s額度已用完。", periodLabel(exhausted.Period), unitLabel(exhausted.Unit)), 0)
+			return
+		}
+	}
+
+	messages := withSystemPrompt(systemPrompt, []models.Message{{Role: "user", Content: prompt}})
+	response, err := h.openaiSvc.GetChatCompletion(ctx, "", h.modelChain(ctx, roomConfig), messages)
+	if err != nil {
+		slog.ErrorContext(ctx, "inline 查詢從 OpenAI 獲取回應失敗", "user_id", userID, "error", err)
+		h.answerInline(ctx, query.ID, "發生錯誤", "從 AI 獲取回應時發生錯誤。", 0)
+		return
+	}
+	if err := h.redisSvc.RecordChatUsage(context.WithoutCancel(ctx), chatID, userID, response); err != nil {
+		slog.ErrorContext(ctx, "記錄聊天室用量失敗", "chat_id", chatID, "error", err)
+	}
+	if err := h.redisSvc.SaveInlineAnswer(ctx, model, systemPrompt, prompt, response.Content, cfg.InlineCacheTTL); err != nil {
+		slog.ErrorContext(ctx, "保存 inline 快取失敗", "user_id", userID, "error", err)
+	}
+	h.answerInline(ctx, query.ID, prompt, response.Content, int(cfg.InlineCacheTTL.Seconds()))
+}
+
+// debounceInline 等待 delay 後確認 queryID 仍是使用者最新的查詢；期間有新的查詢或 ctx 結束時回傳 false。
+func (h *MergedHandler) debounceInline(ctx context.Context, userID int64, queryID string, delay time.Duration) bool {
+	h.mu.Lock()
+	h.inlineIDs[userID] = queryID
+	h.mu.Unlock()
+
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return false
+	case <-timer.C:
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.inlineIDs[userID] != queryID {
+		return false
+	}
+	delete(h.inlineIDs, userID)
+	return true
+}
+
+// authorizeInline 判斷使用者能否使用 inline 模式：在允許名單中，或最近在已授權的聊天室發言過。
+// 回傳使用者所屬的已授權聊天室 (用於模型、系統提示詞與額度)，只在允許名單中時為 nil。
+func (h *MergedHandler) authorizeInline(ctx context.Context, userID int64) (*models.RoomConfig, bool) {
+	rooms, err := h.redisSvc.GetUserRooms(ctx, userID)
+	if err != nil {
+		slog.ErrorContext(ctx, "查詢使用者所屬聊天室失敗", "user_id", userID, "error", err)
+	}
+	// 私人聊天的 chat ID 與使用者 ID 相同，優先使用
+	slices.SortFunc(rooms, func(a, b int64) int {
+		switch {
+		case a == userID:
+			return -1
+		case b == userID:
+			return 1
+		}
+		return 0
+	})
+	for _, chatID := range rooms {
+		roomConfig, err := h.redisSvc.GetRoomConfig(ctx, chatID)
+		if err != nil {
+			slog.ErrorContext(ctx, "從 Redis 獲取聊天室配置失敗", "chat_id", chatID, "error", err)
+			continue
+		}
+		if roomConfig != nil && roomConfig.Approved {
+			return roomConfig, true
+		}
+	}
+	return nil, slices.Contains(h.cfg.Current().InlineAllowedUsers, userID)
+}
+
+// rememberMember 記錄傳送者在已授權的聊天室中發言，讓該使用者之後可以使用 inline 模式。
+func (h *MergedHandler) rememberMember(ctx context.Context, message *tgbotapi.Message) {
+	if message.From == nil || message.From.IsBot {
+		return
+	}
+	if err := h.redisSvc.RecordRoomMember(ctx, message.From.ID, message.Chat.ID); err != nil {
+		slog.ErrorContext(ctx, "記錄聊天室成員失敗", "chat_id", message.Chat.ID, "user_id", message.From.ID, "error", err)
+	}
+}
+
+// answerInline 以單一文章結果回應 inline 查詢。結果依使用者個別快取，因為授權與額度因人而異。
+func (h *MergedHandler) answerInline(ctx context.Context, queryID, title, text string, cacheTime int) {
+	article := tgbotapi.NewInlineQueryResultArticle(queryID, truncateRunes(title, maxInlineDescRunes), truncateRunes(text, maxInlineAnswerRunes))
+	article.Description = truncateRunes(text, maxInlineDescRunes)
+	_, span := tracing.Start(ctx, "telegram.AnswerInlineQuery")
+	_, err := h.bot.Request(tgbotapi.InlineConfig{
+		InlineQueryID: queryID,
+		Results:       []interface{}{article},
+		CacheTime:     cacheTime,
+		IsPersonal:    true,
+	})
+	tracing.End(span, err)
+	if err != nil {
+		// 查詢過期 (使用者已繼續輸入) 時 Telegram 也會回傳錯誤
+		slog.WarnContext(ctx, "回應 inline 查詢失敗", "error", err)
+	}
+}
+
+func truncateRunes(s string, n int) string {
+	if runes := []rune(s); len(runes) > n {
+		return string(runes[:n-1]) + "…"
+	}
+	return s
+}
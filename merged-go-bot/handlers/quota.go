@@ -0,0 +1,89 @@
+package handlers
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"strings"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+	"merged-go-bot/models"
+	"merged-go-bot/services"
+)
+
+// checkQuota 在呼叫 Azure 前確認聊天室仍有額度，額度用盡時會回覆使用者並回傳 false。
+func (h *MergedHandler) checkQuota(ctx context.Context, roomConfig *models.RoomConfig, unit string, requested int64) bool {
+	chatID := roomConfig.ChatID
+	exhausted, err := h.quotaSvc.Check(ctx, roomConfig, unit, requested)
+	if err != nil {
+		// 額度查詢失敗時不阻擋使用者，只記錄錯誤
+		slog.ErrorContext(ctx, "檢查聊天室額度失敗", "chat_id", chatID, "error", err)
+		return true
+	}
+	if exhausted == nil {
+		return true
+	}
+
+	slog.InfoContext(ctx, "聊天室額度已用盡", "chat_id", chatID, "period", exhausted.Period, "unit", exhausted.Unit, "used", exhausted.Used, "limit", exhausted.Limit)
+	var text string
+	if unit == services.QuotaUnitVideoSeconds && exhausted.Used < exhausted.Limit {
+		text = fmt.Sprintf("抱歉，本聊天室%s影片額度剩餘 %d 秒，不足以生成 %d 秒的影片。請聯繫管理員調整額度。",
+			periodLabel(exhausted.Period), exhausted.Remaining(), requested)
+	} else {
+		text = fmt.Sprintf("抱歉，本聊天室%s的%s額度已用完 (已使用 %d / 上限 %d)。%s",
+			periodLabel(exhausted.Period), unitLabel(exhausted.Unit), exhausted.Used, exhausted.Limit, resetHint(exhausted.Period))
+	}
+	h.send(ctx, tgbotapi.NewMessage(chatID, text))
+	return false
+}
+
+// warnQuota 在用量首次跨過設定的門檻 (例如 80%) 時提醒聊天室。
+func (h *MergedHandler) warnQuota(ctx context.Context, roomConfig *models.RoomConfig, unit string) {
+	statuses, thresholds, err := h.quotaSvc.CrossedThresholds(ctx, roomConfig, unit)
+	if err != nil {
+		slog.ErrorContext(ctx, "檢查聊天室額度門檻失敗", "chat_id", roomConfig.ChatID, "error", err)
+		return
+	}
+	for i, status := range statuses {
+		text := fmt.Sprintf("⚠️ 本聊天室%s的%s已使用 %.0f%% (已使用 %d / 上限 %d)。",
+			periodLabel(status.Period), unitLabel(status.Unit), thresholds[i]*100, status.Used, status.Limit)
+		h.send(ctx, tgbotapi.NewMessage(roomConfig.ChatID, text))
+	}
+}
+
+func (h *MergedHandler) formatQuota(ctx context.Context, roomConfig *models.RoomConfig) string {
+	var sb strings.Builder
+	for _, unit := range []string{services.QuotaUnitTokens, services.QuotaUnitVideoSeconds} {
+		statuses, err := h.quotaSvc.Status(ctx, roomConfig, unit)
+		if err != nil {
+			slog.ErrorContext(ctx, "獲取聊天室額度狀態失敗", "chat_id", roomConfig.ChatID, "error", err)
+			continue
+		}
+		for _, status := range statuses {
+			sb.WriteString(fmt.Sprintf("  %s%s: 已使用 %d / 上限 %d (剩餘 %d)\n",
+				periodLabel(status.Period), unitLabel(status.Unit), status.Used, status.Limit, status.Remaining()))
+		}
+	}
+	return sb.String()
+}
+
+func periodLabel(period string) string {
+	if period == services.QuotaPeriodMonthly {
+		return "本月"
+	}
+	return "今日"
+}
+
+func unitLabel(unit string) string {
+	if unit == services.QuotaUnitVideoSeconds {
+		return "影片秒數"
+	}
+	return "Token"
+}
+
+func resetHint(period string) string {
+	if period == services.QuotaPeriodMonthly {
+		return "額度將於下個月重置，或請聯繫管理員。"
+	}
+	return "額度將於明天重置，或請聯繫管理員。"
+}
@@ -0,0 +1,106 @@
+package handlers
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"strings"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+
+	"merged-go-bot/models"
+)
+
+// maxReferenceRunes 限制被回覆或引用的內容放入提示詞的長度
+const maxReferenceRunes = 2000
+
+// referencedText 回傳使用者引用的片段，沒有引用時為被回覆訊息的文字或說明。
+func referencedText(message *tgbotapi.Message, quote string) string {
+	if quote != "" {
+		return quote
+	}
+	reply := message.ReplyToMessage
+	if reply == nil {
+		return ""
+	}
+	if reply.Text != "" {
+		return reply.Text
+	}
+	return reply.Caption
+}
+
+// withReference 將被回覆或引用的內容加在提示詞前面，作為這一輪的上下文。被回覆的傳送者
+// 與 attributeSpeakers 一樣以 speakerLabel 稱呼，開啟化名時不會把真實名稱送出或存入歷史。
+func (h *MergedHandler) withReference(message *tgbotapi.Message, reference, prompt string) string {
+	if reference == "" {
+		return prompt
+	}
+	source := "一則訊息"
+	if reply := message.ReplyToMessage; reply != nil {
+		name := senderName(reply)
+		if reply.SenderChat == nil && reply.From != nil && !reply.From.IsBot {
+			name = h.speakerLabel(message.Chat.ID, reply.From.ID, name)
+		}
+		if name != "" {
+			source = name + " 的訊息"
+		}
+	}
+	if runes := []rune(reference); len(runes) > maxReferenceRunes {
+		reference = string(runes[:maxReferenceRunes]) + "…"
+	}
+	quoted := "> " + strings.ReplaceAll(reference, "\n", "\n> ")
+	return fmt.Sprintf("(回覆%s)\n%s\n\n%s", source, quoted, prompt)
+}
+
+// restoreTurn 在使用者回覆機器人的舊回答時，確保該回答及其提問在送出的上下文中。
+// 回答仍在歷史中且不會被裁剪時不做任何事；否則從訊息 ID 索引找回這一輪，移到歷史的最後。
+// 回傳 true 表示被回覆的內容已在上下文中，不需要再以引用的方式附上。
+func (h *MergedHandler) restoreTurn(ctx context.Context, roomConfig *models.RoomConfig, message *tgbotapi.Message, history []models.Message) ([]models.Message, bool) {
+	if !h.isReplyToBot(message) {
+		return history, false
+	}
+	chatID := message.Chat.ID
+	turn, err := h.redisSvc.GetTurn(ctx, chatID, message.ReplyToMessage.MessageID)
+	if err != nil {
+		slog.ErrorContext(ctx, "查詢被回覆的對話失敗", "chat_id", chatID, "message_id", message.ReplyToMessage.MessageID, "error", err)
+		return history, false
+	}
+	if turn == nil {
+		return history, false
+	}
+
+	idx := -1
+	for i := len(history) - 1; i >= 0; i-- {
+		if history[i].Role == "assistant" && history[i].Content == turn.Assistant.Content {
+			idx = i
+			break
+		}
+	}
+	if idx >= 0 {
+		model := h.deploymentFor(ctx, roomConfig)
+		budget := h.openaiSvc.GetModelMaxTokens(model) - h.cfg.Current().ReservedForResponseTokens
+		if tokens, err := h.openaiSvc.CountTokens(model, history[idx:]); err == nil && tokens < budget {
+			return history, true
+		}
+		// 會被裁剪掉：把這一輪移到最後
+		start := idx
+		if idx > 0 && history[idx-1].Role == "user" && history[idx-1].Content == turn.User.Content {
+			start = idx - 1
+		}
+		history = append(history[:start:start], history[idx+1:]...)
+	}
+
+	slog.InfoContext(ctx, "已從訊息索引找回被回覆的對話", "chat_id", chatID, "message_id", message.ReplyToMessage.MessageID)
+	return append(history, turn.User, turn.Assistant), true
+}
+
+// saveTurn 以訊息 ID 索引這一輪問答，供之後回覆或編輯時使用。不保存聊天歷史的聊天室也不建立索引。
+func (h *MergedHandler) saveTurn(ctx context.Context, roomConfig *models.RoomConfig, turn *models.Turn) {
+	ttl, keep := h.historyRetention(roomConfig)
+	if !keep {
+		return
+	}
+	if err := h.redisSvc.SaveTurn(context.WithoutCancel(ctx), turn, ttl); err != nil {
+		slog.ErrorContext(ctx, "保存對話索引失敗", "chat_id", turn.History.ChatID, "error", err)
+	}
+}
@@ -0,0 +1,98 @@
+package handlers
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"regexp"
+	"strings"
+	"time"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+
+	"merged-go-bot/models"
+)
+
+// invalidNameChars 為 Chat Completions name 欄位不接受的字元 (只允許 ^[a-zA-Z0-9_-]{1,64}$)
+var invalidNameChars = regexp.MustCompile(`[^a-zA-Z0-9_-]+`)
+
+// senderName 回傳訊息傳送者的顯示名稱；匿名管理員或頻道以聊天室名稱表示。
+func senderName(message *tgbotapi.Message) string {
+	if message.SenderChat != nil {
+		return message.SenderChat.Title
+	}
+	if message.From == nil {
+		return ""
+	}
+	name := strings.TrimSpace(message.From.FirstName + " " + message.From.LastName)
+	if name == "" {
+		name = message.From.UserName
+	}
+	return name
+}
+
+// userMessage 建立帶有傳送者資訊與傳送時間的使用者訊息，寫入聊天歷史。
+func userMessage(message *tgbotapi.Message, content string) models.Message {
+	return models.Message{
+		Role:       "user",
+		Content:    content,
+		UserID:     senderID(message),
+		SenderName: senderName(message),
+		Timestamp:  int64(message.Date),
+	}
+}
+
+func assistantMessage(content string) models.Message {
+	return models.Message{Role: "assistant", Content: content, Timestamp: time.Now().Unix()}
+}
+
+// attributeSpeakers 在群組共用的歷史中標示每則使用者訊息的說話者，回傳送給 Azure 的副本。
+// 私人聊天與每位成員各自的歷史只有一位說話者，不需要標示。
+func (h *MergedHandler) attributeSpeakers(roomConfig *models.RoomConfig, chat *tgbotapi.Chat, messages []models.Message) []models.Message {
+	cfg := h.cfg.Current()
+	if cfg.SpeakerAttribution == models.AttributionOff || h.historyScope(roomConfig, chat) == models.HistoryPerUser || chat.IsPrivate() {
+		return messages
+	}
+
+	out := make([]models.Message, len(messages))
+	for i, msg := range messages {
+		out[i] = msg
+		if msg.Role != "user" || (msg.UserID == 0 && msg.SenderName == "") {
+			continue
+		}
+		name := h.speakerLabel(chat.ID, msg.UserID, msg.SenderName)
+		switch cfg.SpeakerAttribution {
+		case models.AttributionName:
+			out[i].Name = apiName(name, msg.UserID)
+		case models.AttributionPrefix:
+			out[i].Content = fmt.Sprintf("[%s] %s", name, msg.Content)
+		}
+	}
+	return out
+}
+
+// speakerLabel 回傳送給 Azure 的提示詞中稱呼使用者的名稱；開啟 PSEUDONYMIZE_SPEAKERS 或沒有名稱時使用化名。
+func (h *MergedHandler) speakerLabel(chatID, userID int64, name string) string {
+	if h.cfg.Current().PseudonymizeSpeakers || name == "" {
+		return pseudonym(chatID, userID)
+	}
+	return name
+}
+
+// pseudonym 回傳同一聊天室內固定的化名，讓模型仍可分辨不同的人而不知道真實名稱。
+func pseudonym(chatID, userID int64) string {
+	sum := sha256.Sum256([]byte(fmt.Sprintf("%d:%d", chatID, userID)))
+	return "User-" + hex.EncodeToString(sum[:3])
+}
+
+// apiName 將名稱轉為 name 欄位可接受的格式；非英數字的名稱 (例如中文) 改用使用者 ID。
+func apiName(name string, userID int64) string {
+	name = strings.Trim(invalidNameChars.ReplaceAllString(name, "_"), "_")
+	if name == "" {
+		name = fmt.Sprintf("user_%d", userID)
+	}
+	if len(name) > 64 {
+		name = name[:64]
+	}
+	return name
+}
@@ -0,0 +1,39 @@
+package handlers
+
+import (
+	"context"
+	"log/slog"
+
+	"merged-go-bot/models"
+	"merged-go-bot/telegram"
+)
+
+// rememberTopic 記錄論壇主題的名稱，供管理員 API 列出主題。
+// 只有在訊息帶有主題名稱且與記錄不同時才寫入 Redis。
+func (h *MergedHandler) rememberTopic(ctx context.Context, roomConfig *models.RoomConfig, topic telegram.Topic) {
+	if topic.ThreadID == 0 {
+		return
+	}
+	existing := roomConfig.Topic(topic.ThreadID)
+	if existing != nil && (topic.Name == "" || existing.Name == topic.Name) {
+		return
+	}
+	roomConfig.SetTopic(topic.ThreadID, func(t *models.TopicConfig) {
+		if topic.Name != "" {
+			t.Name = topic.Name
+		}
+	})
+	if err := h.redisSvc.SaveRoomConfig(ctx, roomConfig); err != nil {
+		slog.ErrorContext(ctx, "保存論壇主題失敗", "chat_id", roomConfig.ChatID, "topic_id", topic.ThreadID, "error", err)
+		return
+	}
+	slog.InfoContext(ctx, "已記錄論壇主題", "chat_id", roomConfig.ChatID, "topic_id", topic.ThreadID, "name", topic.Name)
+}
+
+// systemPrompt 回傳 ctx 中論壇主題的系統提示詞，未設定時使用全域設定。
+func (h *MergedHandler) systemPrompt(ctx context.Context, roomConfig *models.RoomConfig) string {
+	if topic := roomConfig.Topic(telegram.TopicID(ctx)); topic != nil && topic.SystemPrompt != "" {
+		return topic.SystemPrompt
+	}
+	return h.cfg.Current().SystemPrompt
+}
@@ -0,0 +1,173 @@
+package handlers
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"strings"
+	"unicode/utf16"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+
+	"merged-go-bot/models"
+)
+
+// triggerSettings 回傳聊天室的觸發模式與前綴，未設定時使用全域預設值。
+func (h *MergedHandler) triggerSettings(roomConfig *models.RoomConfig) (string, string) {
+	cfg := h.cfg.Current()
+	mode, prefix := cfg.GroupTriggerMode, cfg.GroupTriggerPrefix
+	if roomConfig != nil && roomConfig.TriggerMode != "" {
+		mode = roomConfig.TriggerMode
+		if roomConfig.TriggerPrefix != "" {
+			prefix = roomConfig.TriggerPrefix
+		}
+	}
+	return mode, prefix
+}
+
+// triggerPrompt 判斷一般文字訊息是否應交給模型，並回傳去除 @機器人 或前綴後的提示詞。
+// 私人聊天一律回應；群組依聊天室的觸發模式決定。
+func (h *MergedHandler) triggerPrompt(roomConfig *models.RoomConfig, message *tgbotapi.Message) (string, bool) {
+	text := message.Text
+	if message.Chat.IsPrivate() {
+		return text, text != ""
+	}
+
+	mode, prefix := h.triggerSettings(roomConfig)
+	mentioned, stripped := h.stripMentions(message)
+	prompt := strings.TrimSpace(stripped)
+
+	switch mode {
+	case models.TriggerAll:
+	case models.TriggerMention:
+		if !mentioned {
+			return "", false
+		}
+	case models.TriggerReply:
+		if !h.isReplyToBot(message) {
+			return "", false
+		}
+	case models.TriggerPrefix:
+		if prefix == "" || len(prompt) < len(prefix) || !strings.EqualFold(prompt[:len(prefix)], prefix) {
+			return "", false
+		}
+		prompt = strings.TrimSpace(prompt[len(prefix):])
+	default:
+		// TriggerCommands 或未知的模式：只處理指令
+		return "", false
+	}
+	// 只提及機器人但回覆了某則訊息時，以被回覆的內容作為提問
+	return prompt, prompt != "" || (mentioned && message.ReplyToMessage != nil)
+}
+
+// stripMentions 移除訊息中提及機器人的部分 (@username 或沒有使用者名稱時的 text_mention)。
+// Telegram 的 entity offset 以 UTF-16 code unit 計算。
+func (h *MergedHandler) stripMentions(message *tgbotapi.Message) (bool, string) {
+	if len(message.Entities) == 0 {
+		return false, message.Text
+	}
+	units := utf16.Encode([]rune(message.Text))
+	botMention := "@" + strings.ToLower(h.bot.Self.UserName)
+
+	var out []uint16
+	last := 0
+	mentioned := false
+	for _, e := range message.Entities {
+		if e.Offset < last || e.Offset+e.Length > len(units) {
+			continue
+		}
+		isBot := false
+		switch e.Type {
+		case "mention":
+			isBot = strings.ToLower(string(utf16.Decode(units[e.Offset:e.Offset+e.Length]))) == botMention
+		case "text_mention":
+			isBot = e.User != nil && e.User.ID == h.bot.Self.ID
+		}
+		if !isBot {
+			continue
+		}
+		mentioned = true
+		out = append(out, units[last:e.Offset]...)
+		last = e.Offset + e.Length
+	}
+	if !mentioned {
+		return false, message.Text
+	}
+	out = append(out, units[last:]...)
+	return true, strings.Join(strings.Fields(string(utf16.Decode(out))), " ")
+}
+
+func (h *MergedHandler) isReplyToBot(message *tgbotapi.Message) bool {
+	reply := message.ReplyToMessage
+	return reply != nil && reply.From != nil && reply.From.ID == h.bot.Self.ID
+}
+
+// addressedToOtherBot 判斷群組中的指令是否以 /command@其他機器人 的形式送給別的機器人。
+func (h *MergedHandler) addressedToOtherBot(message *tgbotapi.Message) bool {
+	_, target, found := strings.Cut(message.CommandWithAt(), "@")
+	return found && !strings.EqualFold(target, h.bot.Self.UserName)
+}
+
+// handleTriggerCommand 顯示或設定群組的觸發模式：
+// /trigger、/trigger all|mention|reply|commands、/trigger prefix <前綴>、/trigger default。只有管理員可以變更。
+func (h *MergedHandler) handleTriggerCommand(ctx context.Context, roomConfig *models.RoomConfig, message *tgbotapi.Message) {
+	chatID := message.Chat.ID
+	if message.Chat.IsPrivate() {
+		h.send(ctx, tgbotapi.NewMessage(chatID, "私人聊天會回應所有訊息，觸發模式只適用於群組。"))
+		return
+	}
+
+	args := strings.Fields(message.CommandArguments())
+	if len(args) == 0 {
+		mode, prefix := h.triggerSettings(roomConfig)
+		h.send(ctx, tgbotapi.NewMessage(chatID, fmt.Sprintf("目前的觸發模式: %s\n\n%s", describeTrigger(mode, prefix),
+			"使用 /trigger all|mention|reply|commands、/trigger prefix <前綴> 設定，/trigger default 改回預設。")))
+		return
+	}
+	if !h.isChatAdmin(ctx, message) {
+		h.send(ctx, tgbotapi.NewMessage(chatID, "只有群組管理員可以變更觸發模式。"))
+		return
+	}
+
+	mode, prefix := strings.ToLower(args[0]), ""
+	switch {
+	case mode == "default":
+		mode = ""
+	case mode == models.TriggerPrefix:
+		if len(args) < 2 {
+			h.send(ctx, tgbotapi.NewMessage(chatID, "請在 `/trigger prefix` 後面加上前綴，例如 `/trigger prefix !ai`。"))
+			return
+		}
+		prefix = args[1]
+	case !models.ValidTriggerMode(mode):
+		h.send(ctx, tgbotapi.NewMessage(chatID, fmt.Sprintf("未知的觸發模式 %s。可用模式: all、mention、reply、prefix、commands。", args[0])))
+		return
+	}
+
+	roomConfig.TriggerMode = mode
+	roomConfig.TriggerPrefix = prefix
+	if err := h.redisSvc.SaveRoomConfig(ctx, roomConfig); err != nil {
+		slog.ErrorContext(ctx, "保存聊天室觸發模式失敗", "chat_id", chatID, "error", err)
+		h.send(ctx, tgbotapi.NewMessage(chatID, "無法保存觸發模式，請稍後再試。"))
+		return
+	}
+	mode, prefix = h.triggerSettings(roomConfig)
+	slog.InfoContext(ctx, "聊天室觸發模式已設定", "chat_id", chatID, "trigger_mode", mode, "trigger_prefix", prefix)
+	h.send(ctx, tgbotapi.NewMessage(chatID, fmt.Sprintf("觸發模式已設定為: %s", describeTrigger(mode, prefix))))
+}
+
+func describeTrigger(mode, prefix string) string {
+	switch mode {
+	case models.TriggerAll:
+		return "all (回應所有訊息)"
+	case models.TriggerMention:
+		return "mention (只在 @機器人 時回應)"
+	case models.TriggerReply:
+		return "reply (只在回覆機器人的訊息時回應)"
+	case models.TriggerPrefix:
+		return fmt.Sprintf("prefix (只回應以 %q 開頭的訊息)", prefix)
+	case models.TriggerCommands:
+		return "commands (只處理指令)"
+	}
+	return mode
+}
@@ -0,0 +1,59 @@
+package handlers
+
+import (
+	"testing"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+)
+
+func TestStripMentions(t *testing.T) {
+	h := &MergedHandler{bot: &tgbotapi.BotAPI{Self: tgbotapi.User{ID: 42, UserName: "AzureBot", IsBot: true}}}
+	mention := func(offset, length int) tgbotapi.MessageEntity {
+		return tgbotapi.MessageEntity{Type: "mention", Offset: offset, Length: length}
+	}
+	cases := []struct {
+		name      string
+		text      string
+		entities  []tgbotapi.MessageEntity
+		mentioned bool
+		want      string
+	}{
+		{name: "沒有 entity", text: "@AzureBot 你好", want: "@AzureBot 你好"},
+		{name: "開頭提及", text: "@AzureBot 你好", entities: []tgbotapi.MessageEntity{mention(0, 9)}, mentioned: true, want: "你好"},
+		{name: "不分大小寫", text: "@azurebot hi", entities: []tgbotapi.MessageEntity{mention(0, 9)}, mentioned: true, want: "hi"},
+		// 😀 與 𝐀 各佔兩個 UTF-16 code unit，以 rune 或 byte 計算 offset 都會切錯位置
+		{name: "前面有表情符號", text: "😀 @AzureBot 翻譯", entities: []tgbotapi.MessageEntity{mention(3, 9)}, mentioned: true, want: "😀 翻譯"},
+		{name: "前面有多個非 BMP 字元", text: "𝐀𝐁😀 請 @AzureBot 解釋", entities: []tgbotapi.MessageEntity{mention(9, 9)}, mentioned: true, want: "𝐀𝐁😀 請 解釋"},
+		{name: "提及在句尾", text: "這是什麼？😀 @AzureBot", entities: []tgbotapi.MessageEntity{mention(8, 9)}, mentioned: true, want: "這是什麼？😀"},
+		{
+			name:      "提及兩次",
+			text:      "@AzureBot 😀 問題 @AzureBot",
+			entities:  []tgbotapi.MessageEntity{mention(0, 9), mention(16, 9)},
+			mentioned: true,
+			want:      "😀 問題",
+		},
+		{name: "提及其他人", text: "😀 @someone 你好", entities: []tgbotapi.MessageEntity{mention(3, 8)}, want: "😀 @someone 你好"},
+		{
+			name:      "text_mention 指向機器人",
+			text:      "嗨 Azure 幫忙",
+			entities:  []tgbotapi.MessageEntity{{Type: "text_mention", Offset: 2, Length: 5, User: &tgbotapi.User{ID: 42}}},
+			mentioned: true,
+			want:      "嗨 幫忙",
+		},
+		{
+			name:     "text_mention 指向其他使用者",
+			text:     "嗨 小明 幫忙",
+			entities: []tgbotapi.MessageEntity{{Type: "text_mention", Offset: 2, Length: 2, User: &tgbotapi.User{ID: 7}}},
+			want:     "嗨 小明 幫忙",
+		},
+		{name: "超出範圍的 entity", text: "@AzureBot", entities: []tgbotapi.MessageEntity{mention(0, 20)}, want: "@AzureBot"},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			mentioned, got := h.stripMentions(&tgbotapi.Message{Text: tc.text, Entities: tc.entities})
+			if mentioned != tc.mentioned || got != tc.want {
+				t.Errorf("stripMentions(%q) = (%v, %q)，預期 (%v, %q)", tc.text, mentioned, got, tc.mentioned, tc.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,104 @@
+package handlers
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"sort"
+	"strings"
+	"time"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+	"merged-go-bot/models"
+)
+
+func senderID(message *tgbotapi.Message) int64 {
+	if message.From == nil {
+		return 0
+	}
+	return message.From.ID
+}
+
+// recordChatUsage 記錄已完成的請求；Azure 已經計費，因此即使請求隨後被取消也要寫入用量。
+func (h *MergedHandler) recordChatUsage(ctx context.Context, chatID, userID int64, completion *models.ChatCompletion) {
+	if err := h.redisSvc.RecordChatUsage(context.WithoutCancel(ctx), chatID, userID, completion); err != nil {
+		slog.ErrorContext(ctx, "記錄聊天室用量失敗", "chat_id", chatID, "error", err)
+	}
+}
+
+func (h *MergedHandler) handleUsageCommand(ctx context.Context, roomConfig *models.RoomConfig, message *tgbotapi.Message) {
+	chatID := message.Chat.ID
+	today := startOfDay(time.Now())
+	monthStart := time.Date(today.Year(), today.Month(), 1, 0, 0, 0, 0, today.Location())
+
+	roomToday, err := h.redisSvc.GetRoomUsage(ctx, chatID, today, today)
+	if err != nil {
+		slog.ErrorContext(ctx, "獲取聊天室今日用量失敗", "chat_id", chatID, "error", err)
+		h.send(ctx, tgbotapi.NewMessage(chatID, "無法獲取用量資料，請稍後再試。"))
+		return
+	}
+	roomMonth, err := h.redisSvc.GetRoomUsage(ctx, chatID, monthStart, today)
+	if err != nil {
+		slog.ErrorContext(ctx, "獲取聊天室本月用量失敗", "chat_id", chatID, "error", err)
+		h.send(ctx, tgbotapi.NewMessage(chatID, "無法獲取用量資料，請稍後再試。"))
+		return
+	}
+
+	currency := h.cfg.Current().Currency
+	var sb strings.Builder
+	sb.WriteString("📊 聊天室用量\n\n今日:\n")
+	sb.WriteString(formatUsage(roomToday, currency))
+	sb.WriteString("\n本月:\n")
+	sb.WriteString(formatUsage(roomMonth, currency))
+
+	if quota := h.formatQuota(ctx, roomConfig); quota != "" {
+		sb.WriteString("\n額度:\n")
+		sb.WriteString(quota)
+	}
+
+	if userID := senderID(message); userID != 0 {
+		userMonth, err := h.redisSvc.GetRoomUserUsage(ctx, chatID, userID, monthStart, today)
+		if err != nil {
+			slog.ErrorContext(ctx, "獲取使用者本月用量失敗", "user_id", userID, "error", err)
+		} else {
+			sb.WriteString("\n您在本聊天室的本月用量:\n")
+			sb.WriteString(formatUsage(userMonth, currency))
+		}
+	}
+
+	h.send(ctx, tgbotapi.NewMessage(chatID, sb.String()))
+}
+
+func formatUsage(u *models.UsageSummary, currency string) string {
+	var sb strings.Builder
+	sb.WriteString(fmt.Sprintf("  請求次數: %d\n", u.Requests))
+	if u.FallbackRequests > 0 {
+		sb.WriteString(fmt.Sprintf("  由備援模型回應: %d 次\n", u.FallbackRequests))
+		deployments := make([]string, 0, len(u.RequestsByDeployment))
+		for deployment := range u.RequestsByDeployment {
+			deployments = append(deployments, deployment)
+		}
+		sort.Strings(deployments)
+		for _, deployment := range deployments {
+			sb.WriteString(fmt.Sprintf("    %s: %d 次\n", deployment, u.RequestsByDeployment[deployment]))
+		}
+	}
+	sb.WriteString(fmt.Sprintf("  Token: %d (提示 %d / 回應 %d)\n", u.TotalTokens, u.PromptTokens, u.CompletionTokens))
+	if u.VideoJobs > 0 {
+		sb.WriteString(fmt.Sprintf("  影片: %d 部，共 %d 秒\n", u.VideoJobs, u.VideoSeconds))
+		resolutions := make([]string, 0, len(u.VideoSecondsByResolution))
+		for resolution := range u.VideoSecondsByResolution {
+			resolutions = append(resolutions, resolution)
+		}
+		sort.Strings(resolutions)
+		for _, resolution := range resolutions {
+			sb.WriteString(fmt.Sprintf("    %s: %d 秒\n", resolution, u.VideoSecondsByResolution[resolution]))
+		}
+	}
+	sb.WriteString(fmt.Sprintf("  預估費用: %.4f %s\n", u.EstimatedCost, currency))
+	return sb.String()
+}
+
+func startOfDay(t time.Time) time.Time {
+	return time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, t.Location())
+}
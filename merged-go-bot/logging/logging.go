@@ -0,0 +1,187 @@
+// Package logging 設定 log/slog 結構化日誌，負責遮蔽密鑰與使用者內容，
+// 並在每一行日誌加上 Telegram update 的 correlation ID。
+package logging
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"log/slog"
+	"regexp"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"go.opentelemetry.io/otel/trace"
+)
+
+const redacted = "[REDACTED]"
+
+var (
+	level       = new(slog.LevelVar)
+	userContent atomic.Bool
+
+	secretsMu sync.RWMutex
+	secrets   []string
+
+	// Telegram bot token、Bearer token 與 URL 中的 api-key 參數
+	secretPatterns = []*regexp.Regexp{
+		regexp.MustCompile(`\d{6,}:[A-Za-z0-9_-]{30,}`),
+		regexp.MustCompile(`(?i)(bearer\s+)[A-Za-z0-9._~+/=-]+`),
+		regexp.MustCompile(`(?i)(api[-_]?key[=:]\s*)[^\s&"']+`),
+	}
+)
+
+// Setup 建立 JSON 或文字格式的 slog handler 並設為預設 logger；
+// 標準 log 套件的輸出也會經過同一個 handler，因此同樣會被遮蔽。
+func Setup(w io.Writer, format string) {
+	opts := &slog.HandlerOptions{Level: level}
+	var h slog.Handler
+	if format == "text" {
+		h = slog.NewTextHandler(w, opts)
+	} else {
+		h = slog.NewJSONHandler(w, opts)
+	}
+	slog.SetDefault(slog.New(&redactingHandler{next: h}))
+}
+
+// Configure 設定日誌等級與是否記錄使用者內容，可在重新載入設定時呼叫。
+func Configure(levelName string, logUserContent bool) error {
+	var l slog.Level
+	if err := l.UnmarshalText([]byte(levelName)); err != nil {
+		return fmt.Errorf("無效的日誌等級 %q: %w", levelName, err)
+	}
+	level.Set(l)
+	userContent.Store(logUserContent)
+	return nil
+}
+
+// AddSecrets 登記需要從日誌中遮蔽的字串，例如 API 金鑰與 bot token。
+func AddSecrets(values ...string) {
+	secretsMu.Lock()
+	defer secretsMu.Unlock()
+	for _, v := range values {
+		// 太短的值容易誤遮一般文字
+		if len(v) >= 8 {
+			secrets = append(secrets, v)
+		}
+	}
+}
+
+// Redact 遮蔽字串中已登記的密鑰與常見的 token 格式。
+func Redact(s string) string {
+	secretsMu.RLock()
+	for _, secret := range secrets {
+		s = strings.ReplaceAll(s, secret, redacted)
+	}
+	secretsMu.RUnlock()
+	for _, p := range secretPatterns {
+		if p.NumSubexp() > 0 {
+			s = p.ReplaceAllString(s, "${1}"+redacted)
+		} else {
+			s = p.ReplaceAllString(s, redacted)
+		}
+	}
+	return s
+}
+
+// Content 標記使用者內容 (提示詞、訊息、模型回應)。預設只記錄長度，
+// 設定 LOG_USER_CONTENT=true 時才記錄原文。
+func Content(key, value string) slog.Attr {
+	return slog.Any(key, contentValue(value))
+}
+
+type contentValue string
+
+func (c contentValue) LogValue() slog.Value {
+	if userContent.Load() {
+		return slog.StringValue(string(c))
+	}
+	return slog.StringValue(fmt.Sprintf("[%d chars]", len([]rune(string(c)))))
+}
+
+type correlationKey struct{}
+
+// WithCorrelationID 將 correlation ID 放入 context，之後以該 context 記錄的日誌都會帶上它。
+func WithCorrelationID(ctx context.Context, id string) context.Context {
+	return context.WithValue(ctx, correlationKey{}, id)
+}
+
+func CorrelationID(ctx context.Context) string {
+	if ctx == nil {
+		return ""
+	}
+	id, _ := ctx.Value(correlationKey{}).(string)
+	return id
+}
+
+// NewCorrelationID 產生隨機的 correlation ID，用於沒有 update ID 的請求。
+func NewCorrelationID() string {
+	b := make([]byte, 8)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// redactingHandler 在輸出前遮蔽訊息與字串屬性中的密鑰，並加上 correlation ID。
+type redactingHandler struct {
+	next slog.Handler
+}
+
+func (h *redactingHandler) Enabled(ctx context.Context, l slog.Level) bool {
+	return h.next.Enabled(ctx, l)
+}
+
+func (h *redactingHandler) Handle(ctx context.Context, r slog.Record) error {
+	out := slog.NewRecord(r.Time, r.Level, Redact(r.Message), r.PC)
+	if id := CorrelationID(ctx); id != "" {
+		out.AddAttrs(slog.String("correlation_id", id))
+	}
+	if ctx != nil {
+		if sc := trace.SpanContextFromContext(ctx); sc.IsValid() {
+			out.AddAttrs(slog.String("trace_id", sc.TraceID().String()))
+		}
+	}
+	r.Attrs(func(a slog.Attr) bool {
+		out.AddAttrs(redactAttr(a))
+		return true
+	})
+	return h.next.Handle(ctx, out)
+}
+
+func (h *redactingHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	redactedAttrs := make([]slog.Attr, len(attrs))
+	for i, a := range attrs {
+		redactedAttrs[i] = redactAttr(a)
+	}
+	return &redactingHandler{next: h.next.WithAttrs(redactedAttrs)}
+}
+
+func (h *redactingHandler) WithGroup(name string) slog.Handler {
+	return &redactingHandler{next: h.next.WithGroup(name)}
+}
+
+func redactAttr(a slog.Attr) slog.Attr {
+	switch strings.ToLower(a.Key) {
+	case "api_key", "api-key", "apikey", "token", "password", "authorization":
+		return slog.String(a.Key, redacted)
+	}
+	v := a.Value.Resolve()
+	switch v.Kind() {
+	case slog.KindString:
+		return slog.String(a.Key, Redact(v.String()))
+	case slog.KindGroup:
+		group := v.Group()
+		redactedGroup := make([]any, len(group))
+		for i, ga := range group {
+			redactedGroup[i] = redactAttr(ga)
+		}
+		return slog.Group(a.Key, redactedGroup...)
+	case slog.KindAny:
+		if err, ok := v.Any().(error); ok {
+			return slog.String(a.Key, Redact(err.Error()))
+		}
+	}
+	return slog.Attr{Key: a.Key, Value: v}
+}
@@ -1,43 +1,151 @@
 package main
 
 import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
 	"log"
+	"log/slog"
 	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
 
 	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
 	"github.com/joho/godotenv"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 
 	"merged-go-bot/config"
 	"merged-go-bot/handlers"
+	"merged-go-bot/logging"
 	"merged-go-bot/services"
+	"merged-go-bot/tracing"
 )
 
 func main() {
-	err := godotenv.Load(".env")
+	configPath := flag.String("config", os.Getenv("CONFIG_FILE"), "YAML 設定檔路徑 (預設讀取 config.yaml，若存在)")
+	checkConfig := flag.Bool("check-config", false, "只檢查設定是否有效，然後結束")
+	flag.Parse()
+
+	if err := godotenv.Load(".env"); err != nil {
+		log.Printf("Warning: 無法載入 .env 檔案，使用系統環境變數: %v", err)
+	}
+
+	cfg, err := config.LoadConfig(*configPath)
+	if *checkConfig {
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "設定檢查失敗:\n%v\n", err)
+			os.Exit(1)
+		}
+		fmt.Printf("設定檢查通過。設定檔: %q，模型數量: %d，預設模型: %s\n", cfg.ConfigFile, len(cfg.Models.Models), cfg.DefaultOpenAIDeploymentName)
+		return
+	}
 	if err != nil {
-		log.Fatal("錯誤：無法載入 .env 檔案")
+		log.Fatalf("設定載入失敗:\n%v", err)
+	}
+	cfgStore := config.NewStore(cfg)
+
+	logging.Setup(os.Stdout, cfg.LogFormat)
+	if err := logging.Configure(cfg.LogLevel, cfg.LogUserContent); err != nil {
+		log.Fatalf("日誌設定失敗: %v", err)
+	}
+	logging.AddSecrets(cfg.TelegramBotToken, cfg.AzureOpenAIAPIKey, cfg.AdminAPIToken, cfg.RedisPassword)
+	for _, spec := range cfg.Models.Models {
+		if spec.APIKeyEnv != "" {
+			logging.AddSecrets(os.Getenv(spec.APIKeyEnv))
+		}
+	}
+	tgbotapi.SetLogger(slog.NewLogLogger(slog.Default().Handler(), slog.LevelWarn))
+
+	shutdownTracing, err := tracing.Setup(context.Background(), cfg.TracingEndpoint, cfg.TracingInsecure, cfg.TracingSampleRatio)
+	if err != nil {
+		slog.Error("追蹤設定失敗", "error", err)
+		os.Exit(1)
+	}
+	if cfg.TracingEndpoint != "" {
+		slog.Info("已啟用 OpenTelemetry 追蹤", "endpoint", cfg.TracingEndpoint, "sample_ratio", cfg.TracingSampleRatio)
 	}
 
-	cfg := config.LoadConfig()
-	
 	bot, err := tgbotapi.NewBotAPI(cfg.TelegramBotToken)
 	if err != nil {
-		log.Fatalf("無法連接到 Telegram 機器人: %v", err)
+		slog.Error("無法連接到 Telegram 機器人", "error", err)
+		os.Exit(1)
 	}
-	bot.Debug = true
-	log.Printf("已授權帳號: %s", bot.Self.UserName)
+	slog.Info("已授權帳號", "username", bot.Self.UserName)
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
 
-	redisSvc := services.NewRedisService(cfg.RedisAddr, cfg.RedisPassword, cfg.RedisDB)
+	redisSvc := services.NewRedisService(ctx, cfg.RedisAddr, cfg.RedisPassword, cfg.RedisDB)
 	defer redisSvc.Close()
 
-	openaiSvc := services.NewOpenAIService(cfg)
-	soraSvc := services.NewSoraService(cfg, bot)
+	azureClient := services.NewAzureClient(cfgStore)
+	openaiSvc := services.NewOpenAIService(cfgStore, azureClient)
+	soraSvc := services.NewSoraService(cfgStore, azureClient, bot)
+	quotaSvc := services.NewQuotaService(cfgStore, redisSvc)
+
+	handler := handlers.NewMergedHandler(cfgStore, redisSvc, openaiSvc, soraSvc, quotaSvc, bot)
+	adminHandler := handlers.NewAdminHandler(cfgStore, redisSvc)
+	healthHandler := handlers.NewHealthHandler(cfgStore, redisSvc, openaiSvc, bot, handler)
+
+	go func() {
+		hup := make(chan os.Signal, 1)
+		signal.Notify(hup, syscall.SIGHUP)
+		// 環境變數在程序執行期間不會改變，重新載入主要用於設定檔與模型註冊表的變更
+		for range hup {
+			slog.Info("收到 SIGHUP，正在重新載入設定")
+			if err := cfgStore.Reload(); err != nil {
+				slog.Error("重新載入設定失敗，繼續使用目前設定", "error", err)
+				continue
+			}
+			current := cfgStore.Current()
+			for _, spec := range current.Models.Models {
+				if spec.APIKeyEnv != "" {
+					logging.AddSecrets(os.Getenv(spec.APIKeyEnv))
+				}
+			}
+			if err := logging.Configure(current.LogLevel, current.LogUserContent); err != nil {
+				slog.Error("重新套用日誌設定失敗", "error", err)
+			}
+		}
+	}()
+
+	// webhook URL 含有 bot token，只記錄基底網址
+	slog.Info("Webhook 已設定", "base_url", cfg.TelegramWebhookBaseURL)
+	mux := http.NewServeMux()
+	mux.HandleFunc(cfg.TelegramWebhookPath, handler.HandleTelegramWebhook)
+	mux.HandleFunc("/admin/usage", adminHandler.HandleUsage)
+	mux.HandleFunc("/admin/set_room_quota", adminHandler.HandleSetRoomQuota)
+	mux.HandleFunc("/admin/usage/export", adminHandler.HandleUsageExport)
+	mux.HandleFunc("/admin/topics", adminHandler.HandleTopics)
+	mux.HandleFunc("/admin/set_topic_config", adminHandler.HandleSetTopicConfig)
+	mux.HandleFunc("/admin/history/export", adminHandler.HandleExportHistory)
+	mux.Handle("/metrics", promhttp.Handler())
+	mux.HandleFunc("/healthz", healthHandler.HandleHealthz)
+	mux.HandleFunc("/readyz", healthHandler.HandleReadyz)
 
-	handler := handlers.NewMergedHandler(cfg, redisSvc, openaiSvc, soraSvc, bot)
-	
-	log.Printf("Webhook URL: %s", cfg.TelegramWebhookURL)
-	http.HandleFunc(cfg.TelegramWebhookPath, handler.HandleTelegramWebhook)
-	
-	log.Printf("伺服器正在 %s 上監聽...", cfg.ListenAddr)
-	log.Fatal(http.ListenAndServe(cfg.ListenAddr, nil))
+	server := &http.Server{Addr: cfg.ListenAddr, Handler: mux}
+	go func() {
+		slog.Info("伺服器開始監聽", "addr", cfg.ListenAddr)
+		if err := server.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			slog.Error("HTTP 伺服器錯誤", "error", err)
+			os.Exit(1)
+		}
+	}()
+
+	<-ctx.Done()
+	stop()
+	slog.Info("收到結束訊號，停止接收新的請求並等待進行中的工作完成")
+
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), cfgStore.Current().ShutdownTimeout)
+	defer cancel()
+	if err := server.Shutdown(shutdownCtx); err != nil {
+		slog.Error("關閉 HTTP 伺服器失敗", "error", err)
+	}
+	handler.Shutdown(shutdownCtx)
+	if err := shutdownTracing(shutdownCtx); err != nil {
+		slog.Error("匯出剩餘的追蹤資料失敗", "error", err)
+	}
+	slog.Info("伺服器已關閉")
 }
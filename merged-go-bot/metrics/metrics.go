@@ -0,0 +1,83 @@
+// Package metrics 定義 /metrics 輸出的 Prometheus 指標。
+package metrics
+
+import (
+	"strconv"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+const namespace = "merged_bot"
+
+var (
+	UpdatesReceived = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "telegram_updates_received_total",
+		Help:      "收到的 Telegram update 數量，依類型區分。",
+	}, []string{"type"})
+
+	CommandsHandled = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "commands_handled_total",
+		Help:      "處理的指令數量，一般聊天訊息記為 chat。",
+	}, []string{"command"})
+
+	AzureRequestDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "azure_request_duration_seconds",
+		Help:      "每次 Azure HTTP 嘗試的延遲，依部署與狀態碼區分 (網路錯誤記為 error)。",
+		Buckets:   []float64{0.1, 0.25, 0.5, 1, 2.5, 5, 10, 20, 40, 60, 120},
+	}, []string{"deployment", "status"})
+
+	TokensConsumed = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "tokens_consumed_total",
+		Help:      "Azure 回報的 token 用量，依部署與類型 (prompt/completion) 區分。",
+	}, []string{"deployment", "type"})
+
+	TrimEvents = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "trim_events_total",
+		Help:      "TrimMessages 因超過上下文長度而裁剪訊息的次數。",
+	}, []string{"deployment"})
+
+	TrimmedMessages = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "trimmed_messages_total",
+		Help:      "TrimMessages 移除的訊息數量。",
+	}, []string{"deployment"})
+
+	SoraJobs = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "sora_jobs_total",
+		Help:      "Sora 影片任務數量，依最終狀態區分。",
+	}, []string{"status"})
+
+	SoraJobDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "sora_job_duration_seconds",
+		Help:      "Sora 影片任務從提交到結束的時間，依最終狀態區分。",
+		Buckets:   []float64{15, 30, 60, 120, 180, 300, 600, 900, 1200},
+	}, []string{"status"})
+
+	TelegramSendFailures = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "telegram_send_failures_total",
+		Help:      "發送到 Telegram 失敗的次數，依訊息類型區分。",
+	}, []string{"kind"})
+
+	RedisErrors = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "redis_errors_total",
+		Help:      "失敗的 Redis 指令數量 (不含 key 不存在)。",
+	}, []string{"command"})
+)
+
+// StatusLabel 將 HTTP 狀態碼轉為指標標籤，0 代表請求沒有收到回應。
+func StatusLabel(status int) string {
+	if status == 0 {
+		return "error"
+	}
+	return strconv.Itoa(status)
+}
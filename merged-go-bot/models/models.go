@@ -1,13 +1,256 @@
 package models
 
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
 type RoomConfig struct {
-	ChatID    int64  `json:"chat_id"`
-	APIKey    string `json:"api_key"`
-	Approved  bool   `json:"approved"`
-	ModelName string `json:"model_name"`
+	ChatID    int64      `json:"chat_id"`
+	APIKey    string     `json:"api_key"`
+	Approved  bool       `json:"approved"`
+	ModelName string     `json:"model_name"`
+	Quota     *RoomQuota `json:"quota,omitempty"`
+	// FallbackModels 為主要模型失敗時依序嘗試的模型；未設定時使用模型註冊表中的 fallbacks。
+	FallbackModels []string `json:"fallback_models,omitempty"`
+	// TriggerMode 決定群組中哪些訊息會交給模型回應，空字串表示使用全域預設值；私人聊天一律回應。
+	TriggerMode   string `json:"trigger_mode,omitempty"`
+	TriggerPrefix string `json:"trigger_prefix,omitempty"`
+	// HistoryScope 決定群組成員是否共用聊天歷史，空字串表示使用全域預設值；私人聊天一律共用。
+	HistoryScope string `json:"history_scope,omitempty"`
+	// HistoryRetention 為聊天歷史的保存時間 (見 ParseRetention)，空字串表示使用全域預設值。
+	HistoryRetention string `json:"history_retention,omitempty"`
+	// Topics 為論壇主題的個別設定，以 message_thread_id 為鍵。
+	Topics map[int]*TopicConfig `json:"topics,omitempty"`
+}
+
+// TopicConfig 為論壇主題的設定，空白欄位沿用聊天室或全域設定。
+type TopicConfig struct {
+	Name         string `json:"name,omitempty"`
+	ModelName    string `json:"model_name,omitempty"`
+	SystemPrompt string `json:"system_prompt,omitempty"`
+}
+
+// Topic 回傳主題的設定，未設定時為 nil。
+func (c *RoomConfig) Topic(threadID int) *TopicConfig {
+	if c == nil || threadID == 0 {
+		return nil
+	}
+	return c.Topics[threadID]
+}
+
+// SetTopic 以 update 修改主題設定，主題不存在時先建立。
+func (c *RoomConfig) SetTopic(threadID int, update func(*TopicConfig)) {
+	if c.Topics == nil {
+		c.Topics = make(map[int]*TopicConfig)
+	}
+	topic := c.Topics[threadID]
+	if topic == nil {
+		topic = &TopicConfig{}
+		c.Topics[threadID] = topic
+	}
+	update(topic)
+}
+
+const (
+	TriggerAll      = "all"      // 回應所有文字訊息
+	TriggerMention  = "mention"  // 只在 @機器人 時回應
+	TriggerReply    = "reply"    // 只在回覆機器人的訊息時回應
+	TriggerPrefix   = "prefix"   // 只回應以 TriggerPrefix 開頭的訊息
+	TriggerCommands = "commands" // 只處理指令
+)
+
+const (
+	HistoryShared    = "shared"     // 整個聊天室共用一段歷史
+	HistoryPerUser   = "per_user"   // 每位成員各自的歷史
+	HistoryPerThread = "per_thread" // 每個回覆串各自的歷史，以串的第一則訊息識別
+)
+
+func ValidHistoryScope(scope string) bool {
+	switch scope {
+	case HistoryShared, HistoryPerUser, HistoryPerThread:
+		return true
+	}
+	return false
 }
 
+const (
+	RetentionEphemeral = "ephemeral" // 不保存聊天歷史，每則訊息各自獨立
+	RetentionForever   = "forever"   // 永久保存，直到 /clear
+)
+
+// ParseRetention 解析聊天歷史保存時間：ephemeral、forever、N 小時 (例如 12h) 或 N 天 (例如 7d)。
+// keep 為 false 時不保存；ttl 為 0 時永久保存。
+func ParseRetention(s string) (ttl time.Duration, keep bool, err error) {
+	switch s = strings.ToLower(strings.TrimSpace(s)); s {
+	case RetentionEphemeral:
+		return 0, false, nil
+	case RetentionForever:
+		return 0, true, nil
+	}
+	unit := time.Hour
+	n, err := strconv.Atoi(strings.TrimSuffix(s, "h"))
+	if strings.HasSuffix(s, "d") {
+		unit = 24 * time.Hour
+		n, err = strconv.Atoi(strings.TrimSuffix(s, "d"))
+	} else if !strings.HasSuffix(s, "h") {
+		err = fmt.Errorf("缺少單位")
+	}
+	if err != nil || n <= 0 {
+		return 0, false, fmt.Errorf("無效的保存時間 %q，必須是 ephemeral、forever、N 小時 (例如 12h) 或 N 天 (例如 7d)", s)
+	}
+	return time.Duration(n) * unit, true, nil
+}
+
+// HistoryKey 識別一段聊天歷史：TopicID 為論壇主題 (0 為一般聊天室)，
+// UserID 與 RootID 皆為 0 時為聊天室或主題共用的歷史。
+// ConversationID 為同一範圍內的具名對話，0 為預設對話。
+type HistoryKey struct {
+	ChatID         int64 `json:"chat_id"`
+	TopicID        int   `json:"topic_id,omitempty"`
+	UserID         int64 `json:"user_id,omitempty"`
+	RootID         int   `json:"root_id,omitempty"`
+	ConversationID int   `json:"conversation_id,omitempty"`
+}
+
+// Conversation 為 /new 建立的具名對話。Title 未命名時以第一個提問自動產生。
+type Conversation struct {
+	ID        int       `json:"id"`
+	Title     string    `json:"title"`
+	CreatedAt time.Time `json:"created_at"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+// Turn 為一問一答，以使用者訊息與機器人回覆的 Telegram 訊息 ID 索引，
+// 讓回覆舊訊息時可以找回已被裁剪的內容。
+type Turn struct {
+	History       HistoryKey `json:"history"`
+	UserMessageID int        `json:"user_message_id"`
+	BotMessageID  int        `json:"bot_message_id"`
+	User          Message    `json:"user"`
+	Assistant     Message    `json:"assistant"`
+	// Standalone 為 /get 等不寫入聊天歷史的一問一答，History 只標示所在的聊天室與主題
+	Standalone bool `json:"standalone,omitempty"`
+}
+
+func ValidTriggerMode(mode string) bool {
+	switch mode {
+	case TriggerAll, TriggerMention, TriggerReply, TriggerPrefix, TriggerCommands:
+		return true
+	}
+	return false
+}
+
+// RoomQuota 為聊天室的用量上限，0 表示不限制；未設定時使用全域預設值。
+type RoomQuota struct {
+	DailyTokens         int64 `json:"daily_tokens" yaml:"daily_tokens"`
+	MonthlyTokens       int64 `json:"monthly_tokens" yaml:"monthly_tokens"`
+	DailyVideoSeconds   int64 `json:"daily_video_seconds" yaml:"daily_video_seconds"`
+	MonthlyVideoSeconds int64 `json:"monthly_video_seconds" yaml:"monthly_video_seconds"`
+}
+
+// QuotaStatus 描述某個期間的額度使用情況。
+type QuotaStatus struct {
+	Period string `json:"period"`
+	Unit   string `json:"unit"`
+	Limit  int64  `json:"limit"`
+	Used   int64  `json:"used"`
+}
+
+func (q QuotaStatus) Remaining() int64 {
+	if q.Used >= q.Limit {
+		return 0
+	}
+	return q.Limit - q.Used
+}
+
+// Message 為聊天歷史中的一則訊息。UserID 與 SenderName 記錄群組中說話的人；
+// Name 為送給 Azure 的 name 欄位，只在送出前依設定填入，不寫入歷史。
 type Message struct {
-	Role    string `json:"role"`
-	Content string `json:"content"`
+	Role       string `json:"role"`
+	Content    string `json:"content"`
+	Name       string `json:"name,omitempty"`
+	UserID     int64  `json:"user_id,omitempty"`
+	SenderName string `json:"sender_name,omitempty"`
+	// Timestamp 為訊息時間 (Unix 秒)，只用於匯出與匯入，不會送給 Azure
+	Timestamp int64 `json:"timestamp,omitempty"`
+}
+
+const (
+	AttributionOff    = "off"    // 不標示說話者
+	AttributionName   = "name"   // 使用 Chat Completions 的 name 欄位
+	AttributionPrefix = "prefix" // 在內容前加上 [名稱]
+)
+
+func ValidAttribution(mode string) bool {
+	switch mode {
+	case AttributionOff, AttributionName, AttributionPrefix:
+		return true
+	}
+	return false
+}
+
+type Usage struct {
+	PromptTokens     int `json:"prompt_tokens"`
+	CompletionTokens int `json:"completion_tokens"`
+	TotalTokens      int `json:"total_tokens"`
+}
+
+// ChatCompletion 的 Deployment 為實際回應的模型；由備援模型回應時 FallbackFrom 記錄原本要求的模型。
+type ChatCompletion struct {
+	Content      string  `json:"content"`
+	Deployment   string  `json:"deployment"`
+	FallbackFrom string  `json:"fallback_from,omitempty"`
+	Usage        Usage   `json:"usage"`
+	Cost         float64 `json:"cost"`
+}
+
+type VideoGeneration struct {
+	Path    string  `json:"path"`
+	Width   int     `json:"width"`
+	Height  int     `json:"height"`
+	Seconds int     `json:"seconds"`
+	Cost    float64 `json:"cost"`
+}
+
+// UsageSummary 為一段期間內的用量加總。
+type UsageSummary struct {
+	From                     string           `json:"from"`
+	To                       string           `json:"to"`
+	Requests                 int64            `json:"requests"`
+	RequestsByDeployment     map[string]int64 `json:"requests_by_deployment,omitempty"`
+	FallbackRequests         int64            `json:"fallback_requests"`
+	PromptTokens             int64            `json:"prompt_tokens"`
+	CompletionTokens         int64            `json:"completion_tokens"`
+	TotalTokens              int64            `json:"total_tokens"`
+	VideoJobs                int64            `json:"video_jobs"`
+	VideoSeconds             int64            `json:"video_seconds"`
+	VideoSecondsByResolution map[string]int64 `json:"video_seconds_by_resolution,omitempty"`
+	EstimatedCost            float64          `json:"estimated_cost"`
+	Currency                 string           `json:"currency,omitempty"`
+}
+
+func (u *UsageSummary) Add(other *UsageSummary) {
+	u.Requests += other.Requests
+	u.FallbackRequests += other.FallbackRequests
+	u.PromptTokens += other.PromptTokens
+	u.CompletionTokens += other.CompletionTokens
+	u.TotalTokens += other.TotalTokens
+	u.VideoJobs += other.VideoJobs
+	u.VideoSeconds += other.VideoSeconds
+	u.EstimatedCost += other.EstimatedCost
+	for deployment, requests := range other.RequestsByDeployment {
+		if u.RequestsByDeployment == nil {
+			u.RequestsByDeployment = make(map[string]int64)
+		}
+		u.RequestsByDeployment[deployment] += requests
+	}
+	for resolution, seconds := range other.VideoSecondsByResolution {
+		if u.VideoSecondsByResolution == nil {
+			u.VideoSecondsByResolution = make(map[string]int64)
+		}
+		u.VideoSecondsByResolution[resolution] += seconds
+	}
 }
@@ -0,0 +1,53 @@
+package models
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseRetention(t *testing.T) {
+	cases := []struct {
+		in      string
+		ttl     time.Duration
+		keep    bool
+		wantErr bool
+	}{
+		{in: "ephemeral", ttl: 0, keep: false},
+		{in: "forever", ttl: 0, keep: true},
+		{in: " Forever ", ttl: 0, keep: true},
+		{in: "12h", ttl: 12 * time.Hour, keep: true},
+		{in: "24H", ttl: 24 * time.Hour, keep: true},
+		{in: "7d", ttl: 7 * 24 * time.Hour, keep: true},
+		{in: "1d", ttl: 24 * time.Hour, keep: true},
+		{in: "", wantErr: true},
+		{in: "12", wantErr: true},
+		{in: "h", wantErr: true},
+		{in: "d", wantErr: true},
+		{in: "0h", wantErr: true},
+		{in: "-1d", wantErr: true},
+		{in: "1.5d", wantErr: true},
+		{in: "30m", wantErr: true},
+		{in: "7dd", wantErr: true},
+		{in: "never", wantErr: true},
+	}
+	for _, tc := range cases {
+		t.Run(tc.in, func(t *testing.T) {
+			ttl, keep, err := ParseRetention(tc.in)
+			if tc.wantErr {
+				if err == nil {
+					t.Fatalf("ParseRetention(%q) 應回傳錯誤，得到 ttl=%v keep=%v", tc.in, ttl, keep)
+				}
+				if keep {
+					t.Errorf("ParseRetention(%q) 錯誤時 keep 應為 false", tc.in)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("ParseRetention(%q) 回傳錯誤: %v", tc.in, err)
+			}
+			if ttl != tc.ttl || keep != tc.keep {
+				t.Errorf("ParseRetention(%q) = (%v, %v)，預期 (%v, %v)", tc.in, ttl, keep, tc.ttl, tc.keep)
+			}
+		})
+	}
+}
@@ -0,0 +1,192 @@
+package services
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"math/rand"
+	"net/http"
+	"net/http/httptrace"
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+
+	"merged-go-bot/config"
+	"merged-go-bot/metrics"
+	"merged-go-bot/tracing"
+)
+
+// RetryPolicy 決定單次 Azure 呼叫的逾時與重試方式。
+// 非冪等的請求 (例如建立 Sora 任務) 只在確定伺服器沒有處理時才重試：
+// 429、503，或請求尚未完整送出前發生的網路錯誤。
+type RetryPolicy struct {
+	Timeout    time.Duration
+	Idempotent bool
+	// Deployment 只用於指標標籤
+	Deployment string
+}
+
+type AzureClient struct {
+	httpClient *http.Client
+	cfg        *config.Store
+}
+
+func NewAzureClient(cfg *config.Store) *AzureClient {
+	return &AzureClient{
+		httpClient: &http.Client{},
+		cfg:        cfg,
+	}
+}
+
+// cancelOnClose 在讀取完回應後才取消逾時 context。
+type cancelOnClose struct {
+	io.ReadCloser
+	cancel context.CancelFunc
+}
+
+func (c cancelOnClose) Close() error {
+	err := c.ReadCloser.Close()
+	c.cancel()
+	return err
+}
+
+// Do 送出請求並依 policy 重試。newRequest 每次嘗試都會被呼叫，以便重新建立請求內容。
+// 回傳的 Response 由呼叫端負責關閉。
+func (c *AzureClient) Do(ctx context.Context, policy RetryPolicy, newRequest func(ctx context.Context) (*http.Request, error)) (*http.Response, error) {
+	cfg := c.cfg.Current()
+	maxAttempts := cfg.AzureMaxRetries + 1
+
+	for attempt := 1; ; attempt++ {
+		attemptCtx, cancel := context.WithTimeout(ctx, policy.Timeout)
+
+		var wroteRequest atomic.Bool
+		clientTrace := &httptrace.ClientTrace{
+			WroteRequest: func(httptrace.WroteRequestInfo) { wroteRequest.Store(true) },
+		}
+		req, err := newRequest(httptrace.WithClientTrace(attemptCtx, clientTrace))
+		if err != nil {
+			cancel()
+			return nil, err
+		}
+
+		_, span := tracing.Start(ctx, "azure.http", attribute.String("http.method", req.Method),
+			attribute.String("url.path", req.URL.Path), attribute.String("deployment", policy.Deployment), attribute.Int("attempt", attempt))
+		start := time.Now()
+		resp, err := c.httpClient.Do(req)
+		status := 0
+		if err == nil {
+			status = resp.StatusCode
+			span.SetAttributes(attribute.Int("http.status_code", status), attribute.String("apim_request_id", resp.Header.Get("apim-request-id")))
+		}
+		tracing.End(span, err)
+		metrics.AzureRequestDuration.WithLabelValues(policy.Deployment, metrics.StatusLabel(status)).Observe(time.Since(start).Seconds())
+		if err != nil {
+			cancel()
+			if ctx.Err() != nil || attempt >= maxAttempts || (!policy.Idempotent && wroteRequest.Load()) {
+				return nil, err
+			}
+			delay := backoff(attempt, cfg.AzureRetryBaseDelay, cfg.AzureRetryMaxDelay)
+			trace.SpanFromContext(ctx).AddEvent("retry", trace.WithAttributes(attribute.Int("attempt", attempt), attribute.String("delay", delay.String())))
+			slog.WarnContext(ctx, "Azure 請求失敗，稍後重試", "method", req.Method, "path", req.URL.Path, "attempt", attempt, "delay", delay, "error", err)
+			if !sleepContext(ctx, delay) {
+				return nil, ctx.Err()
+			}
+			continue
+		}
+
+		slog.DebugContext(ctx, "Azure 回應", "method", req.Method, "path", req.URL.Path, "status", resp.StatusCode,
+			"attempt", attempt, "duration", time.Since(start), "apim_request_id", resp.Header.Get("apim-request-id"))
+		if !shouldRetryStatus(resp.StatusCode, policy.Idempotent) || attempt >= maxAttempts {
+			resp.Body = cancelOnClose{ReadCloser: resp.Body, cancel: cancel}
+			return resp, nil
+		}
+
+		delay, ok := retryAfter(resp.Header)
+		if !ok {
+			delay = backoff(attempt, cfg.AzureRetryBaseDelay, cfg.AzureRetryMaxDelay)
+		} else if delay > cfg.AzureRetryMaxDelay {
+			// 伺服器要求等待的時間超過上限，不如直接回報錯誤
+			slog.WarnContext(ctx, "Azure 要求等待的時間超過上限，放棄重試", "path", req.URL.Path, "retry_after", delay, "max_delay", cfg.AzureRetryMaxDelay)
+			resp.Body = cancelOnClose{ReadCloser: resp.Body, cancel: cancel}
+			return resp, nil
+		}
+
+		io.Copy(io.Discard, resp.Body)
+		resp.Body.Close()
+		cancel()
+
+		trace.SpanFromContext(ctx).AddEvent("retry", trace.WithAttributes(attribute.Int("attempt", attempt),
+			attribute.Int("http.status_code", resp.StatusCode), attribute.String("delay", delay.String())))
+		slog.WarnContext(ctx, "Azure 回應可重試的狀態碼，稍後重試", "method", req.Method, "path", req.URL.Path, "status", resp.StatusCode,
+			"attempt", attempt, "delay", delay, "apim_request_id", resp.Header.Get("apim-request-id"))
+		if !sleepContext(ctx, delay) {
+			return nil, ctx.Err()
+		}
+	}
+}
+
+func shouldRetryStatus(status int, idempotent bool) bool {
+	switch status {
+	case http.StatusTooManyRequests, http.StatusServiceUnavailable:
+		return true
+	case http.StatusInternalServerError, http.StatusBadGateway, http.StatusGatewayTimeout:
+		return idempotent
+	}
+	return false
+}
+
+// retryAfter 解析 retry-after-ms、x-ms-retry-after-ms 與 Retry-After (秒數或 HTTP 日期)。
+func retryAfter(h http.Header) (time.Duration, bool) {
+	for _, name := range []string{"retry-after-ms", "x-ms-retry-after-ms"} {
+		if v := h.Get(name); v != "" {
+			if ms, err := strconv.ParseFloat(v, 64); err == nil && ms >= 0 {
+				return time.Duration(ms * float64(time.Millisecond)), true
+			}
+		}
+	}
+	if v := h.Get("Retry-After"); v != "" {
+		if secs, err := strconv.Atoi(v); err == nil && secs >= 0 {
+			return time.Duration(secs) * time.Second, true
+		}
+		if t, err := http.ParseTime(v); err == nil {
+			if d := time.Until(t); d > 0 {
+				return d, true
+			}
+			return 0, true
+		}
+	}
+	return 0, false
+}
+
+// backoff 回傳帶有 full jitter 的指數退避時間。
+func backoff(attempt int, base, max time.Duration) time.Duration {
+	d := base << (attempt - 1)
+	if d <= 0 || d > max {
+		d = max
+	}
+	return time.Duration(rand.Int63n(int64(d) + 1))
+}
+
+func sleepContext(ctx context.Context, d time.Duration) bool {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return false
+	case <-timer.C:
+		return true
+	}
+}
+
+func readBody(resp *http.Response) ([]byte, error) {
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("讀取回應失敗: %w", err)
+	}
+	return body, nil
+}
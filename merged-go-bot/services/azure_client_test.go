@@ -0,0 +1,89 @@
+package services
+
+import (
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestRetryAfter(t *testing.T) {
+	cases := []struct {
+		name    string
+		headers map[string]string
+		want    time.Duration
+		// slack 為 HTTP 日期與目前時間相減時允許的誤差
+		slack time.Duration
+		ok    bool
+	}{
+		{name: "沒有標頭"},
+		{name: "Retry-After 秒數", headers: map[string]string{"Retry-After": "7"}, want: 7 * time.Second, ok: true},
+		{name: "Retry-After 0 秒", headers: map[string]string{"Retry-After": "0"}, want: 0, ok: true},
+		{name: "Retry-After 負數", headers: map[string]string{"Retry-After": "-3"}},
+		{name: "Retry-After 無法解析", headers: map[string]string{"Retry-After": "soon"}},
+		{
+			name:    "Retry-After HTTP 日期",
+			headers: map[string]string{"Retry-After": time.Now().Add(30 * time.Second).UTC().Format(http.TimeFormat)},
+			want:    30 * time.Second,
+			slack:   2 * time.Second,
+			ok:      true,
+		},
+		{
+			name:    "Retry-After 已過去的 HTTP 日期",
+			headers: map[string]string{"Retry-After": time.Now().Add(-time.Minute).UTC().Format(http.TimeFormat)},
+			want:    0,
+			ok:      true,
+		},
+		{name: "retry-after-ms", headers: map[string]string{"retry-after-ms": "1500"}, want: 1500 * time.Millisecond, ok: true},
+		{name: "retry-after-ms 小數", headers: map[string]string{"retry-after-ms": "2.5"}, want: 2500 * time.Microsecond, ok: true},
+		{name: "x-ms-retry-after-ms", headers: map[string]string{"x-ms-retry-after-ms": "250"}, want: 250 * time.Millisecond, ok: true},
+		{
+			name:    "毫秒標頭優先於 Retry-After",
+			headers: map[string]string{"retry-after-ms": "100", "Retry-After": "9"},
+			want:    100 * time.Millisecond,
+			ok:      true,
+		},
+		{
+			name:    "無效的毫秒標頭改用 Retry-After",
+			headers: map[string]string{"retry-after-ms": "abc", "Retry-After": "2"},
+			want:    2 * time.Second,
+			ok:      true,
+		},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			h := make(http.Header)
+			for k, v := range tc.headers {
+				h.Set(k, v)
+			}
+			got, ok := retryAfter(h)
+			if ok != tc.ok {
+				t.Fatalf("retryAfter ok = %v，預期 %v", ok, tc.ok)
+			}
+			if got < tc.want-tc.slack || got > tc.want {
+				t.Errorf("retryAfter = %v，預期 %v (誤差 %v)", got, tc.want, tc.slack)
+			}
+		})
+	}
+}
+
+func TestBackoff(t *testing.T) {
+	base, max := 100*time.Millisecond, time.Second
+	cases := []struct {
+		attempt int
+		limit   time.Duration
+	}{
+		{1, 100 * time.Millisecond},
+		{2, 200 * time.Millisecond},
+		{4, 800 * time.Millisecond},
+		{5, time.Second},
+		// 位移溢位時也不能超過上限
+		{80, time.Second},
+	}
+	for _, tc := range cases {
+		for i := 0; i < 50; i++ {
+			if d := backoff(tc.attempt, base, max); d < 0 || d > tc.limit {
+				t.Fatalf("backoff(%d) = %v，超出 [0, %v]", tc.attempt, d, tc.limit)
+			}
+		}
+	}
+}
@@ -0,0 +1,112 @@
+package services
+
+import (
+	"log/slog"
+	"sync"
+	"time"
+)
+
+const (
+	breakerClosed   = "closed"
+	breakerOpen     = "open"
+	breakerHalfOpen = "half-open"
+)
+
+// CircuitBreaker 記錄單一部署的連續失敗次數。連續失敗達到門檻後跳脫 (open)，
+// 冷卻時間過後進入半開 (half-open) 狀態，只放行一個試探請求，成功則恢復、失敗則再次跳脫。
+type CircuitBreaker struct {
+	mu       sync.Mutex
+	name     string
+	state    string
+	failures int
+	openedAt time.Time
+	probing  bool
+}
+
+// Allow 回傳目前是否可以送出請求。
+func (b *CircuitBreaker) Allow(cooldown time.Duration) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	switch b.state {
+	case breakerOpen:
+		if time.Since(b.openedAt) < cooldown {
+			return false
+		}
+		b.state = breakerHalfOpen
+		b.probing = true
+		slog.Info("斷路器冷卻結束，進入半開狀態並送出試探請求", "deployment", b.name)
+		return true
+	case breakerHalfOpen:
+		if b.probing {
+			return false
+		}
+		b.probing = true
+		return true
+	default:
+		return true
+	}
+}
+
+func (b *CircuitBreaker) Success() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.state != breakerClosed {
+		slog.Info("斷路器試探成功，恢復為關閉狀態", "deployment", b.name)
+	}
+	b.state = breakerClosed
+	b.failures = 0
+	b.probing = false
+}
+
+func (b *CircuitBreaker) Failure(threshold int) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.failures++
+	b.probing = false
+	if b.state == breakerHalfOpen || b.failures >= threshold {
+		if b.state != breakerOpen {
+			slog.Warn("斷路器跳脫", "deployment", b.name, "consecutive_failures", b.failures)
+		}
+		b.state = breakerOpen
+		b.openedAt = time.Now()
+	}
+}
+
+// Release 在請求因呼叫端取消而中止時歸還半開狀態的試探名額，不影響失敗計數。
+func (b *CircuitBreaker) Release() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.probing = false
+}
+
+func (b *CircuitBreaker) State() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.state == "" {
+		return breakerClosed
+	}
+	return b.state
+}
+
+// breakerSet 依部署名稱保存斷路器。
+type breakerSet struct {
+	mu       sync.Mutex
+	breakers map[string]*CircuitBreaker
+}
+
+func (s *breakerSet) get(name string) *CircuitBreaker {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.breakers == nil {
+		s.breakers = make(map[string]*CircuitBreaker)
+	}
+	b, ok := s.breakers[name]
+	if !ok {
+		b = &CircuitBreaker{name: name, state: breakerClosed}
+		s.breakers[name] = b
+	}
+	return b
+}
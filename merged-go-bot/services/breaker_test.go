@@ -0,0 +1,124 @@
+package services
+
+import (
+	"testing"
+	"time"
+)
+
+func TestCircuitBreaker(t *testing.T) {
+	const threshold = 3
+	const cooldown = time.Minute
+
+	// expired 讓跳脫時間早於冷卻時間，不必真的等待
+	expired := func(b *CircuitBreaker) { b.openedAt = time.Now().Add(-2 * cooldown) }
+	// open 連續失敗到門檻，讓斷路器跳脫
+	open := func(b *CircuitBreaker) {
+		for i := 0; i < threshold; i++ {
+			b.Failure(threshold)
+		}
+	}
+
+	cases := []struct {
+		name  string
+		steps func(t *testing.T, b *CircuitBreaker)
+		want  string
+	}{
+		{
+			name: "未達門檻維持關閉",
+			steps: func(t *testing.T, b *CircuitBreaker) {
+				b.Failure(threshold)
+				b.Failure(threshold)
+				if !b.Allow(cooldown) {
+					t.Fatal("關閉狀態應放行請求")
+				}
+			},
+			want: breakerClosed,
+		},
+		{
+			name: "成功會重設連續失敗次數",
+			steps: func(t *testing.T, b *CircuitBreaker) {
+				b.Failure(threshold)
+				b.Failure(threshold)
+				b.Success()
+				b.Failure(threshold)
+				b.Failure(threshold)
+			},
+			want: breakerClosed,
+		},
+		{
+			name: "達到門檻跳脫並在冷卻中拒絕",
+			steps: func(t *testing.T, b *CircuitBreaker) {
+				open(b)
+				if b.Allow(cooldown) {
+					t.Fatal("冷卻中應拒絕請求")
+				}
+			},
+			want: breakerOpen,
+		},
+		{
+			name: "冷卻後半開只放行一個試探",
+			steps: func(t *testing.T, b *CircuitBreaker) {
+				open(b)
+				expired(b)
+				if !b.Allow(cooldown) {
+					t.Fatal("冷卻結束後應放行試探請求")
+				}
+				if b.Allow(cooldown) {
+					t.Fatal("試探進行中應拒絕其他請求")
+				}
+			},
+			want: breakerHalfOpen,
+		},
+		{
+			name: "半開試探成功後關閉",
+			steps: func(t *testing.T, b *CircuitBreaker) {
+				open(b)
+				expired(b)
+				b.Allow(cooldown)
+				b.Success()
+				if !b.Allow(cooldown) || !b.Allow(cooldown) {
+					t.Fatal("恢復關閉後應放行所有請求")
+				}
+				// 失敗次數已重設，一次失敗不會再跳脫
+				b.Failure(threshold)
+			},
+			want: breakerClosed,
+		},
+		{
+			name: "半開試探失敗後再次跳脫",
+			steps: func(t *testing.T, b *CircuitBreaker) {
+				open(b)
+				expired(b)
+				b.Allow(cooldown)
+				b.Failure(threshold)
+				if b.Allow(cooldown) {
+					t.Fatal("再次跳脫後應重新冷卻")
+				}
+			},
+			want: breakerOpen,
+		},
+		{
+			name: "取消的試探歸還名額",
+			steps: func(t *testing.T, b *CircuitBreaker) {
+				open(b)
+				expired(b)
+				b.Allow(cooldown)
+				b.Release()
+				if !b.Allow(cooldown) {
+					t.Fatal("歸還名額後應放行新的試探")
+				}
+			},
+			want: breakerHalfOpen,
+		},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			var set breakerSet
+			b := set.get("gpt-4o")
+			tc.steps(t, b)
+			if got := b.State(); got != tc.want {
+				t.Errorf("狀態 = %s，預期 %s", got, tc.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,169 @@
+package services
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+	"go.opentelemetry.io/otel/attribute"
+	"merged-go-bot/models"
+	"merged-go-bot/tracing"
+)
+
+// 具名對話的資料：conversations:<範圍> 為對話 ID 到對話資訊的 hash，
+// conversations:<範圍>:seq 為下一個對話 ID，active_conversation:<範圍> 為目前使用中的對話。
+// 範圍為 scopeID (聊天室、論壇主題與每位成員)，聊天歷史本身存放在 historyKey 加上 :conv:<id>。
+// 這些 key 與聊天歷史使用相同的保存時間，每次保存對話資訊時一併延長。
+
+func conversationsKey(scope models.HistoryKey) string {
+	return "conversations:" + scopeID(scope)
+}
+
+func activeConversationKey(scope models.HistoryKey) string {
+	return "active_conversation:" + scopeID(scope)
+}
+
+// GetActiveConversation 回傳範圍內目前使用中的對話 ID，未切換過時為 0 (預設對話)。
+func (s *RedisService) GetActiveConversation(ctx context.Context, scope models.HistoryKey) (int, error) {
+	id, err := s.client.Get(ctx, activeConversationKey(scope)).Int()
+	if err == redis.Nil {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, fmt.Errorf("查詢使用中的對話失敗: %w", err)
+	}
+	return id, nil
+}
+
+// SetActiveConversation 切換範圍內使用中的對話；id 為 0 時切回預設對話。ttl 為 0 時永久保存。
+func (s *RedisService) SetActiveConversation(ctx context.Context, scope models.HistoryKey, id int, ttl time.Duration) error {
+	var err error
+	if id == 0 {
+		err = s.client.Del(ctx, activeConversationKey(scope)).Err()
+	} else {
+		err = s.client.Set(ctx, activeConversationKey(scope), id, ttl).Err()
+	}
+	if err != nil {
+		return fmt.Errorf("切換對話失敗: %w", err)
+	}
+	return nil
+}
+
+// CreateConversation 建立新的具名對話並設為使用中。ttl 為 0 時永久保存。
+func (s *RedisService) CreateConversation(ctx context.Context, scope models.HistoryKey, title string, ttl time.Duration) (_ *models.Conversation, err error) {
+	ctx, span := tracing.Start(ctx, "redis.CreateConversation", attribute.Int64("chat.id", scope.ChatID))
+	defer func() { tracing.End(span, err) }()
+
+	id, err := s.client.Incr(ctx, conversationsKey(scope)+":seq").Result()
+	if err != nil {
+		return nil, fmt.Errorf("建立對話失敗: %w", err)
+	}
+	now := time.Now()
+	conv := &models.Conversation{ID: int(id), Title: title, CreatedAt: now, UpdatedAt: now}
+	data, err := json.Marshal(conv)
+	if err != nil {
+		return nil, fmt.Errorf("序列化對話失敗: %w", err)
+	}
+	_, err = s.client.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.HSet(ctx, conversationsKey(scope), strconv.Itoa(conv.ID), data)
+		pipe.Set(ctx, activeConversationKey(scope), conv.ID, ttl)
+		expireConversations(ctx, pipe, scope, ttl)
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("建立對話失敗: %w", err)
+	}
+	return conv, nil
+}
+
+// GetConversation 回傳對話資訊，不存在時回傳 nil。預設對話 (ID 0) 在命名或使用前沒有資料。
+func (s *RedisService) GetConversation(ctx context.Context, scope models.HistoryKey, id int) (*models.Conversation, error) {
+	data, err := s.client.HGet(ctx, conversationsKey(scope), strconv.Itoa(id)).Bytes()
+	if err == redis.Nil {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("查詢對話失敗: %w", err)
+	}
+	var conv models.Conversation
+	if err := json.Unmarshal(data, &conv); err != nil {
+		return nil, fmt.Errorf("反序列化對話失敗: %w", err)
+	}
+	return &conv, nil
+}
+
+// ListConversations 依最後使用時間 (新到舊) 列出範圍內的對話。
+func (s *RedisService) ListConversations(ctx context.Context, scope models.HistoryKey) (_ []models.Conversation, err error) {
+	ctx, span := tracing.Start(ctx, "redis.ListConversations", attribute.Int64("chat.id", scope.ChatID))
+	defer func() { tracing.End(span, err) }()
+
+	all, err := s.client.HGetAll(ctx, conversationsKey(scope)).Result()
+	if err != nil {
+		return nil, fmt.Errorf("列出對話失敗: %w", err)
+	}
+	convs := make([]models.Conversation, 0, len(all))
+	for _, data := range all {
+		var conv models.Conversation
+		if err := json.Unmarshal([]byte(data), &conv); err != nil {
+			continue
+		}
+		convs = append(convs, conv)
+	}
+	sort.Slice(convs, func(i, j int) bool { return convs[i].UpdatedAt.After(convs[j].UpdatedAt) })
+	return convs, nil
+}
+
+// SaveConversation 新增或更新對話資訊 (例如重新命名或更新最後使用時間)，並將範圍內對話相關 key
+// 的保存時間延長為 ttl；ttl 為 0 時永久保存。
+func (s *RedisService) SaveConversation(ctx context.Context, scope models.HistoryKey, conv *models.Conversation, ttl time.Duration) error {
+	data, err := json.Marshal(conv)
+	if err != nil {
+		return fmt.Errorf("序列化對話失敗: %w", err)
+	}
+	_, err = s.client.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.HSet(ctx, conversationsKey(scope), strconv.Itoa(conv.ID), data)
+		expireConversations(ctx, pipe, scope, ttl)
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("保存對話失敗: %w", err)
+	}
+	return nil
+}
+
+// expireConversations 設定範圍內對話資訊、對話 ID 序號與使用中對話的保存時間。
+// 序號必須與對話資訊一起保存，否則過期後會重複發出仍在使用的對話 ID。
+func expireConversations(ctx context.Context, pipe redis.Pipeliner, scope models.HistoryKey, ttl time.Duration) {
+	for _, key := range []string{conversationsKey(scope), conversationsKey(scope) + ":seq", activeConversationKey(scope)} {
+		expireHistory(ctx, pipe, key, ttl)
+	}
+}
+
+// DeleteConversation 刪除對話及其聊天歷史；刪除的是使用中的對話時切回預設對話。
+func (s *RedisService) DeleteConversation(ctx context.Context, scope models.HistoryKey, id int) (err error) {
+	ctx, span := tracing.Start(ctx, "redis.DeleteConversation", attribute.Int64("chat.id", scope.ChatID), attribute.Int("conversation.id", id))
+	defer func() { tracing.End(span, err) }()
+
+	active, err := s.GetActiveConversation(ctx, scope)
+	if err != nil {
+		return err
+	}
+	history := scope
+	history.ConversationID = id
+	_, err = s.client.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.HDel(ctx, conversationsKey(scope), strconv.Itoa(id))
+		pipe.Del(ctx, historyKey(history))
+		if active == id {
+			pipe.Del(ctx, activeConversationKey(scope))
+		}
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("刪除對話失敗: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,241 @@
+package services
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+	"go.opentelemetry.io/otel/attribute"
+	"merged-go-bot/models"
+	"merged-go-bot/tracing"
+)
+
+// 聊天歷史以 Redis list 保存，每個元素為一則 JSON 訊息。新的一問一答以 MULTI 中的 RPUSH 一起附加，
+// 並以 LTRIM 限制長度；編輯與重新產生以 WATCH/MULTI 改寫個別元素，不會整段重寫，也不會蓋掉並行附加的訊息。
+// 舊版以單一 JSON 字串保存的歷史會在第一次讀寫時轉換為 list。
+
+// maxEditRetries 為改寫聊天歷史時遇到並行寫入的重試次數
+const maxEditRetries = 3
+
+// ErrHistoryConflict 表示聊天歷史持續被並行修改，重試後仍無法改寫。
+var ErrHistoryConflict = errors.New("聊天歷史正在被其他請求修改")
+
+func isWrongType(err error) bool {
+	return err != nil && strings.HasPrefix(err.Error(), "WRONGTYPE")
+}
+
+func encodeMessages(messages []models.Message) ([]interface{}, error) {
+	values := make([]interface{}, 0, len(messages))
+	for _, msg := range messages {
+		data, err := json.Marshal(msg)
+		if err != nil {
+			return nil, fmt.Errorf("序列化聊天歷史失敗: %w", err)
+		}
+		values = append(values, data)
+	}
+	return values, nil
+}
+
+func decodeMessages(items []string) ([]models.Message, error) {
+	messages := make([]models.Message, 0, len(items))
+	for _, item := range items {
+		var msg models.Message
+		if err := json.Unmarshal([]byte(item), &msg); err != nil {
+			return nil, fmt.Errorf("反序列化聊天歷史失敗: %w", err)
+		}
+		messages = append(messages, msg)
+	}
+	return messages, nil
+}
+
+// expireHistory 在交易中設定聊天歷史的保存時間，ttl 為 0 時永久保存。
+func expireHistory(ctx context.Context, pipe redis.Pipeliner, key string, ttl time.Duration) {
+	if ttl > 0 {
+		pipe.Expire(ctx, key, ttl)
+	} else {
+		pipe.Persist(ctx, key)
+	}
+}
+
+// migrateHistory 將舊版以 JSON 字串保存的聊天歷史轉換為 list，保留原本的剩餘保存時間。
+func (s *RedisService) migrateHistory(ctx context.Context, key string) error {
+	err := s.client.Watch(ctx, func(tx *redis.Tx) error {
+		data, err := tx.Get(ctx, key).Bytes()
+		if err == redis.Nil || isWrongType(err) {
+			// 已被刪除或已轉換
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		var messages []models.Message
+		if err := json.Unmarshal(data, &messages); err != nil {
+			return fmt.Errorf("反序列化聊天歷史失敗: %w", err)
+		}
+		values, err := encodeMessages(messages)
+		if err != nil {
+			return err
+		}
+		ttl, err := tx.PTTL(ctx, key).Result()
+		if err != nil {
+			return err
+		}
+		_, err = tx.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+			pipe.Del(ctx, key)
+			if len(values) > 0 {
+				pipe.RPush(ctx, key, values...)
+			}
+			if ttl > 0 {
+				pipe.PExpire(ctx, key, ttl)
+			}
+			return nil
+		})
+		return err
+	}, key)
+	if err == redis.TxFailedErr {
+		// 轉換期間被其他請求修改，由呼叫端重試
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("轉換舊版聊天歷史失敗: %w", err)
+	}
+	return nil
+}
+
+func (s *RedisService) GetMessages(ctx context.Context, hk models.HistoryKey) (_ []models.Message, err error) {
+	ctx, span := tracing.Start(ctx, "redis.GetMessages", historyAttributes(hk)...)
+	defer func() { tracing.End(span, err) }()
+	key := historyKey(hk)
+	items, err := s.client.LRange(ctx, key, 0, -1).Result()
+	if isWrongType(err) {
+		if err = s.migrateHistory(ctx, key); err == nil {
+			items, err = s.client.LRange(ctx, key, 0, -1).Result()
+		}
+	}
+	if err != nil {
+		return nil, fmt.Errorf("從 Redis 獲取聊天歷史失敗: %w", err)
+	}
+	return decodeMessages(items)
+}
+
+// AppendMessages 在同一個交易中附加訊息 (通常是一問一答)、只保留最新的 maxLen 則並更新保存時間。
+// maxLen 為 0 時不限制長度，ttl 為 0 時永久保存。
+func (s *RedisService) AppendMessages(ctx context.Context, hk models.HistoryKey, messages []models.Message, maxLen int, ttl time.Duration) (err error) {
+	ctx, span := tracing.Start(ctx, "redis.AppendMessages", historyAttributes(hk)...)
+	defer func() { tracing.End(span, err) }()
+	span.SetAttributes(attribute.Int("messages.count", len(messages)))
+	if len(messages) == 0 {
+		return nil
+	}
+	key := historyKey(hk)
+	values, err := encodeMessages(messages)
+	if err != nil {
+		return err
+	}
+	push := func() error {
+		_, err := s.client.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+			pipe.RPush(ctx, key, values...)
+			if maxLen > 0 {
+				pipe.LTrim(ctx, key, int64(-maxLen), -1)
+			}
+			expireHistory(ctx, pipe, key, ttl)
+			return nil
+		})
+		return err
+	}
+	err = push()
+	if isWrongType(err) {
+		if err = s.migrateHistory(ctx, key); err == nil {
+			err = push()
+		}
+	}
+	if err != nil {
+		return fmt.Errorf("附加聊天歷史失敗: %w", err)
+	}
+	return nil
+}
+
+// SaveMessages 以 messages 取代整段聊天歷史 (例如匯入)，只保留最新的 maxLen 則；ttl 為 0 時永久保存。
+func (s *RedisService) SaveMessages(ctx context.Context, hk models.HistoryKey, messages []models.Message, maxLen int, ttl time.Duration) (err error) {
+	ctx, span := tracing.Start(ctx, "redis.SaveMessages", historyAttributes(hk)...)
+	defer func() { tracing.End(span, err) }()
+	span.SetAttributes(attribute.Int("messages.count", len(messages)))
+	if maxLen > 0 && len(messages) > maxLen {
+		messages = messages[len(messages)-maxLen:]
+	}
+	key := historyKey(hk)
+	values, err := encodeMessages(messages)
+	if err != nil {
+		return err
+	}
+	_, err = s.client.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.Del(ctx, key)
+		if len(values) > 0 {
+			pipe.RPush(ctx, key, values...)
+			expireHistory(ctx, pipe, key, ttl)
+		}
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("保存聊天歷史失敗: %w", err)
+	}
+	return nil
+}
+
+// EditMessages 以樂觀鎖定改寫聊天歷史中的個別訊息：edit 收到目前的歷史，回傳要取代的位置與新訊息，
+// 沒有要改寫的訊息時回傳空的 map。歷史在讀取後被其他請求修改時會以新的內容重新呼叫 edit，
+// 重試 maxEditRetries 次後回傳 ErrHistoryConflict。changed 表示是否有訊息被改寫。
+func (s *RedisService) EditMessages(ctx context.Context, hk models.HistoryKey, ttl time.Duration, edit func([]models.Message) map[int]models.Message) (changed bool, err error) {
+	ctx, span := tracing.Start(ctx, "redis.EditMessages", historyAttributes(hk)...)
+	defer func() { tracing.End(span, err) }()
+	key := historyKey(hk)
+
+	for attempt := 0; attempt < maxEditRetries; attempt++ {
+		changed = false
+		err = s.client.Watch(ctx, func(tx *redis.Tx) error {
+			items, err := tx.LRange(ctx, key, 0, -1).Result()
+			if err != nil {
+				return err
+			}
+			history, err := decodeMessages(items)
+			if err != nil {
+				return err
+			}
+			updates := edit(history)
+			if len(updates) == 0 {
+				return nil
+			}
+			_, err = tx.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+				for idx, msg := range updates {
+					data, err := json.Marshal(msg)
+					if err != nil {
+						return fmt.Errorf("序列化聊天歷史失敗: %w", err)
+					}
+					pipe.LSet(ctx, key, int64(idx), data)
+				}
+				expireHistory(ctx, pipe, key, ttl)
+				return nil
+			})
+			changed = err == nil
+			return err
+		}, key)
+		switch {
+		case err == redis.TxFailedErr:
+			span.SetAttributes(attribute.Int("retries", attempt+1))
+			continue
+		case isWrongType(err):
+			if err = s.migrateHistory(ctx, key); err != nil {
+				return false, err
+			}
+			continue
+		case err != nil:
+			return false, fmt.Errorf("改寫聊天歷史失敗: %w", err)
+		}
+		return changed, nil
+	}
+	return false, ErrHistoryConflict
+}
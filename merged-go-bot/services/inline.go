@@ -0,0 +1,106 @@
+package services
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+	"go.opentelemetry.io/otel/attribute"
+	"merged-go-bot/tracing"
+)
+
+// memberTTL 為使用者與聊天室關係的保存時間，使用者每次在聊天室發言都會重新計算
+const memberTTL = 30 * 24 * time.Hour
+
+func userRoomsKey(userID int64) string {
+	return fmt.Sprintf("user_rooms:%d", userID)
+}
+
+// RecordRoomMember 記錄使用者最近在哪些聊天室發言，供 inline 模式判斷使用者是否屬於已授權的聊天室。
+func (s *RedisService) RecordRoomMember(ctx context.Context, userID, chatID int64) error {
+	key := userRoomsKey(userID)
+	_, err := s.client.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.SAdd(ctx, key, chatID)
+		pipe.Expire(ctx, key, memberTTL)
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("記錄聊天室成員失敗: %w", err)
+	}
+	return nil
+}
+
+// GetUserRooms 回傳使用者最近發言過的聊天室 ID。
+func (s *RedisService) GetUserRooms(ctx context.Context, userID int64) ([]int64, error) {
+	members, err := s.client.SMembers(ctx, userRoomsKey(userID)).Result()
+	if err != nil {
+		return nil, fmt.Errorf("查詢使用者所屬聊天室失敗: %w", err)
+	}
+	rooms := make([]int64, 0, len(members))
+	for _, m := range members {
+		id, err := strconv.ParseInt(m, 10, 64)
+		if err != nil {
+			continue
+		}
+		rooms = append(rooms, id)
+	}
+	return rooms, nil
+}
+
+// inlineCacheKey 以模型、系統提示詞與正規化後的問題雜湊作為快取鍵，問題本身不會出現在鍵中。
+// 不同聊天室可能設定不同的系統提示詞，同一個問題的回答不能共用。
+func inlineCacheKey(model, systemPrompt, query string) string {
+	h := sha256.New()
+	h.Write([]byte(systemPrompt))
+	h.Write([]byte{0})
+	h.Write([]byte(strings.ToLower(strings.Join(strings.Fields(query), " "))))
+	return fmt.Sprintf("inline_cache:%s:%s", model, hex.EncodeToString(h.Sum(nil)))
+}
+
+// GetInlineAnswer 回傳快取的 inline 回答，沒有快取時回傳空字串。
+func (s *RedisService) GetInlineAnswer(ctx context.Context, model, systemPrompt, query string) (_ string, err error) {
+	ctx, span := tracing.Start(ctx, "redis.GetInlineAnswer", attribute.String("model", model))
+	defer func() { tracing.End(span, err) }()
+	answer, err := s.client.Get(ctx, inlineCacheKey(model, systemPrompt, query)).Result()
+	if err == redis.Nil {
+		return "", nil
+	}
+	if err != nil {
+		return "", fmt.Errorf("查詢 inline 快取失敗: %w", err)
+	}
+	return answer, nil
+}
+
+func (s *RedisService) SaveInlineAnswer(ctx context.Context, model, systemPrompt, query, answer string, ttl time.Duration) error {
+	if ttl <= 0 {
+		return nil
+	}
+	if err := s.client.Set(ctx, inlineCacheKey(model, systemPrompt, query), answer, ttl).Err(); err != nil {
+		return fmt.Errorf("保存 inline 快取失敗: %w", err)
+	}
+	return nil
+}
+
+// AllowRequest 以固定時間區間計算 key 的請求次數，超過 limit 時回傳 false。limit 為 0 表示不限制。
+func (s *RedisService) AllowRequest(ctx context.Context, key string, limit int, window time.Duration) (bool, error) {
+	if limit <= 0 {
+		return true, nil
+	}
+	bucket := time.Now().UnixNano() / int64(window)
+	rateKey := fmt.Sprintf("rate:%s:%d", key, bucket)
+	var incr *redis.IntCmd
+	_, err := s.client.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		incr = pipe.Incr(ctx, rateKey)
+		pipe.Expire(ctx, rateKey, window)
+		return nil
+	})
+	if err != nil {
+		return false, fmt.Errorf("計算請求頻率失敗: %w", err)
+	}
+	return incr.Val() <= int64(limit), nil
+}
@@ -2,59 +2,66 @@ package services
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
-	"io"
-	"log"
+	"log/slog"
 	"net/http"
+	"os"
 	"strings"
 
 	tokenizer "github.com/pkoukk/tiktoken-go"
+	"go.opentelemetry.io/otel/attribute"
 	"merged-go-bot/config"
+	"merged-go-bot/logging"
+	"merged-go-bot/metrics"
 	"merged-go-bot/models"
+	"merged-go-bot/tracing"
 )
 
 type OpenAIService struct {
-	endpoint          string
-	apiVersion        string
-	defaultDeployment string
-	modelTokenLimits  map[string]int
-	reservedTokens    int
-	apiKey            string
+	cfg      *config.Store
+	azure    *AzureClient
+	breakers breakerSet
 }
 
-func NewOpenAIService(cfg *config.Config) *OpenAIService {
+func NewOpenAIService(cfg *config.Store, azure *AzureClient) *OpenAIService {
 	return &OpenAIService{
-		endpoint:          cfg.AzureOpenAIEndpoint,
-		apiVersion:        cfg.AzureOpenAIAPIVersionChat,
-		defaultDeployment: cfg.DefaultOpenAIDeploymentName,
-		modelTokenLimits:  cfg.ModelTokenLimits,
-		reservedTokens:    cfg.ReservedForResponseTokens,
-		apiKey:            cfg.AzureOpenAIAPIKey,
+		cfg:   cfg,
+		azure: azure,
 	}
 }
 
-func (s *OpenAIService) GetModelMaxTokens(modelName string) int {
-	if limit, ok := s.modelTokenLimits[modelName]; ok {
-		return limit
+// ModelSpec 回傳部署的模型描述；未註冊的部署會以保守的 4096 token 上限處理。
+func (s *OpenAIService) ModelSpec(modelName string) config.ModelSpec {
+	if spec, ok := s.cfg.Current().Models.Lookup(modelName); ok {
+		return spec
+	}
+	slog.Warn("模型部署不在模型註冊表中，使用保守設定", "deployment", modelName)
+	return config.ModelSpec{
+		Name:          modelName,
+		Deployment:    modelName,
+		Model:         modelName,
+		ContextWindow: 4096,
+		Tokenizer:     "cl100k_base",
 	}
-	return 4096
+}
+
+func (s *OpenAIService) Models() *config.ModelRegistry {
+	return s.cfg.Current().Models
+}
+
+func (s *OpenAIService) GetModelMaxTokens(modelName string) int {
+	return s.ModelSpec(modelName).ContextWindow
 }
 
 func (s *OpenAIService) CountTokens(modelName string, messages []models.Message) (int, error) {
-	var encodingName string
-	switch modelName {
-	case "gpt-35-turbo", "gpt-4", "gpt-4o-mini":
-		encodingName = "cl100k_base"
-	case "gpt-4o":
-		encodingName = "o200k_base"
-	default:
-		encodingName = "cl100k_base"
-	}
+	encodingName := s.ModelSpec(modelName).Tokenizer
 
 	enc, err := tokenizer.GetEncoding(encodingName)
 	if err != nil {
-		log.Printf("Warning: Could not get tiktoken encoding for model %s (encoding name: %s). Using cl100k_base fallback. Error: %v", modelName, encodingName, err)
+		slog.Warn("無法取得 tiktoken 編碼，改用 cl100k_base", "deployment", modelName, "encoding", encodingName, "error", err)
 		enc, err = tokenizer.GetEncoding("cl100k_base")
 		if err != nil {
 			return 0, fmt.Errorf("無法獲取 cl100k_base 編碼: %w", err)
@@ -66,28 +73,36 @@ func (s *OpenAIService) CountTokens(modelName string, messages []models.Message)
 	for _, msg := range messages {
 		totalTokens += len(enc.Encode(msg.Role, emptySpecial, emptySpecial))
 		totalTokens += len(enc.Encode(msg.Content, emptySpecial, emptySpecial))
+		if msg.Name != "" {
+			totalTokens += len(enc.Encode(msg.Name, emptySpecial, emptySpecial)) + 1
+		}
 	}
 	totalTokens += 3
 	return totalTokens, nil
 }
 
-func (s *OpenAIService) TrimMessages(modelName string, messages []models.Message) ([]models.Message, int) {
-	maxTokens := s.GetModelMaxTokens(modelName) - s.reservedTokens
+func (s *OpenAIService) TrimMessages(ctx context.Context, modelName string, messages []models.Message) ([]models.Message, int) {
+	ctx, span := tracing.Start(ctx, "openai.TrimMessages",
+		attribute.String("deployment", modelName), attribute.Int("messages.count", len(messages)))
+	defer span.End()
+
+	maxTokens := s.GetModelMaxTokens(modelName) - s.cfg.Current().ReservedForResponseTokens
 	if maxTokens <= 0 {
 		return []models.Message{}, 0
 	}
 
 	currentTokens, err := s.CountTokens(modelName, messages)
 	if err != nil {
-		log.Printf("Error counting tokens for trimming: %v", err)
+		slog.ErrorContext(ctx, "裁剪訊息時計算 token 失敗", "error", err)
 		return messages, currentTokens
 	}
 
+	span.SetAttributes(attribute.Int("tokens.count", currentTokens), attribute.Int("tokens.limit", maxTokens))
 	if currentTokens <= maxTokens {
 		return messages, currentTokens
 	}
 
-	log.Printf("Messages (tokens: %d) exceed limit (%d) for model %s. Trimming...", currentTokens, maxTokens, modelName)
+	slog.InfoContext(ctx, "訊息超過模型上下文上限，開始裁剪", "deployment", modelName, "tokens", currentTokens, "limit", maxTokens)
 
 	trimmedMessages := make([]models.Message, 0, len(messages))
 	systemMessageCount := 0
@@ -103,7 +118,7 @@ func (s *OpenAIService) TrimMessages(modelName string, messages []models.Message
 		tempMessages := append(trimmedMessages, messages[i])
 		tokens, err := s.CountTokens(modelName, tempMessages)
 		if err != nil {
-			log.Printf("Error counting tokens during trimming loop: %v", err)
+			slog.ErrorContext(ctx, "裁剪訊息時計算 token 失敗", "error", err)
 			break
 		}
 		if tokens > maxTokens {
@@ -112,98 +127,225 @@ func (s *OpenAIService) TrimMessages(modelName string, messages []models.Message
 		trimmedMessages = append([]models.Message{messages[i]}, trimmedMessages...)
 	}
 
-	finalTokens, _ := s.CountTokens(modelName, trimmedMessages);
-	log.Printf("Trimmed messages down to %d tokens.", finalTokens)
+	finalTokens, _ := s.CountTokens(modelName, trimmedMessages)
+	span.SetAttributes(attribute.Bool("trimmed", true), attribute.Int("tokens.trimmed_count", finalTokens),
+		attribute.Int("messages.trimmed_count", len(trimmedMessages)))
+	metrics.TrimEvents.WithLabelValues(modelName).Inc()
+	metrics.TrimmedMessages.WithLabelValues(modelName).Add(float64(len(messages) - len(trimmedMessages)))
+	slog.InfoContext(ctx, "訊息裁剪完成", "deployment", modelName, "tokens", finalTokens, "messages", len(trimmedMessages))
 	return trimmedMessages, finalTokens
 }
 
-func (s *OpenAIService) GetChatCompletion(apiKey, deploymentName string, messages []models.Message) (string, error) {
-	if apiKey == "" {
-		apiKey = s.apiKey
+// AzureStatusError 為 Azure 回應非 200 狀態碼時的錯誤。
+type AzureStatusError struct {
+	StatusCode int
+	Body       string
+}
+
+func (e *AzureStatusError) Error() string {
+	return fmt.Sprintf("OpenAI 請求失敗，狀態碼: %d，回應內容: %s", e.StatusCode, e.Body)
+}
+
+// isDeploymentFailure 判斷錯誤是否代表部署本身無法服務 (網路錯誤、逾時、429、5xx)，
+// 只有這類錯誤會計入斷路器並改用備援模型；其他 4xx 代表請求本身有問題，換部署也無濟於事。
+func isDeploymentFailure(err error) bool {
+	if errors.Is(err, context.Canceled) {
+		return false
 	}
-	
-	if deploymentName == "" {
-		return "", fmt.Errorf("模型部署名稱為空")
+	var statusErr *AzureStatusError
+	if errors.As(err, &statusErr) {
+		return statusErr.StatusCode == http.StatusTooManyRequests || statusErr.StatusCode >= 500
 	}
+	var parseErr *responseParseError
+	return !errors.As(err, &parseErr)
+}
 
-	url := fmt.Sprintf("%s/openai/deployments/%s/chat/completions?api-version=%s", strings.TrimSuffix(s.endpoint, "/"), deploymentName, s.apiVersion)
+type responseParseError struct{ err error }
 
-	log.Printf("--- 正在發送 OpenAI 請求 ---")
-	log.Printf("URL: %s", url)
-	log.Printf("Deployment Name: %s", deploymentName) // 新增的日誌
-	if len(apiKey) > 4 {
-		log.Printf("API-KEY (後四碼): ...%s", apiKey[len(apiKey)-4:])
-	} else {
-		log.Printf("API-KEY (後四碼): %s", apiKey)
+func (e *responseParseError) Error() string { return e.err.Error() }
+func (e *responseParseError) Unwrap() error { return e.err }
+
+// BreakerState 回傳部署斷路器目前的狀態 (closed、open 或 half-open)。
+func (s *OpenAIService) BreakerState(modelName string) string {
+	return s.breakers.get(modelName).State()
+}
+
+// GetChatCompletion 依序嘗試 chain 中的模型 (第一個為主要模型，其餘為備援)，
+// 跳過斷路器已跳脫的部署，並依各模型的上下文長度重新裁剪訊息。
+func (s *OpenAIService) GetChatCompletion(ctx context.Context, apiKey string, chain []string, messages []models.Message) (_ *models.ChatCompletion, err error) {
+	ctx, span := tracing.Start(ctx, "openai.GetChatCompletion", attribute.StringSlice("deployment.chain", chain))
+	defer func() { tracing.End(span, err) }()
+
+	if len(chain) == 0 || chain[0] == "" {
+		return nil, fmt.Errorf("模型部署名稱為空")
 	}
 
+	cfg := s.cfg.Current()
+	var lastErr error
+	for _, modelName := range chain {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		breaker := s.breakers.get(modelName)
+		if !breaker.Allow(cfg.BreakerCooldown) {
+			slog.WarnContext(ctx, "部署的斷路器未關閉，略過", "deployment", modelName, "breaker", breaker.State())
+			if lastErr == nil {
+				lastErr = fmt.Errorf("模型 %s 暫時無法使用 (斷路器已跳脫)", modelName)
+			}
+			continue
+		}
+
+		trimmed, _ := s.TrimMessages(ctx, modelName, messages)
+		completion, err := s.complete(ctx, apiKey, s.ModelSpec(modelName), trimmed, 0)
+		if err == nil {
+			breaker.Success()
+			if modelName != chain[0] {
+				completion.FallbackFrom = chain[0]
+			}
+			metrics.TokensConsumed.WithLabelValues(modelName, "prompt").Add(float64(completion.Usage.PromptTokens))
+			metrics.TokensConsumed.WithLabelValues(modelName, "completion").Add(float64(completion.Usage.CompletionTokens))
+			span.SetAttributes(attribute.String("deployment", modelName), attribute.String("fallback_from", completion.FallbackFrom))
+			slog.InfoContext(ctx, "OpenAI 已回應", "deployment", modelName, "fallback_from", completion.FallbackFrom,
+				"prompt_tokens", completion.Usage.PromptTokens, "completion_tokens", completion.Usage.CompletionTokens)
+			return completion, nil
+		}
+		if ctx.Err() != nil {
+			// 呼叫端取消或逾時不代表部署故障，釋放試探名額後直接結束
+			breaker.Release()
+			return nil, err
+		}
+		if !isDeploymentFailure(err) {
+			breaker.Success()
+			return nil, err
+		}
+		breaker.Failure(cfg.BreakerFailureThreshold)
+		slog.WarnContext(ctx, "OpenAI 請求失敗，嘗試下一個模型", "deployment", modelName, "error", err)
+		lastErr = err
+	}
+	return nil, fmt.Errorf("所有模型皆無法回應: %w", lastErr)
+}
+
+// Probe 以只生成 1 個 token 的請求確認部署可以回應，供就緒檢查使用；不經過斷路器也不計入用量。
+func (s *OpenAIService) Probe(ctx context.Context, modelName string) error {
+	messages := []models.Message{{Role: "user", Content: "ping"}}
+	_, err := s.complete(ctx, "", s.ModelSpec(modelName), messages, 1)
+	return err
+}
+
+// complete 對單一部署送出聊天請求。部署可指定自己的端點與 API 金鑰環境變數，
+// 讓備援模型可以位於不同區域。maxTokens 為 0 時使用預設的回應上限。
+func (s *OpenAIService) complete(ctx context.Context, apiKey string, spec config.ModelSpec, messages []models.Message, maxTokens int) (_ *models.ChatCompletion, err error) {
+	ctx, span := tracing.Start(ctx, "azure.chat_completion",
+		attribute.String("deployment", spec.Name), attribute.Int("messages.count", len(messages)))
+	defer func() { tracing.End(span, err) }()
+
+	cfg := s.cfg.Current()
+	if spec.APIKeyEnv != "" {
+		apiKey = os.Getenv(spec.APIKeyEnv)
+	}
+	if apiKey == "" {
+		apiKey = cfg.AzureOpenAIAPIKey
+	}
+	endpoint := spec.Endpoint
+	if endpoint == "" {
+		endpoint = cfg.AzureOpenAIEndpoint
+	}
+	apiVersion := spec.APIVersion
+	if apiVersion == "" {
+		apiVersion = cfg.AzureOpenAIAPIVersionChat
+	}
+
+	url := fmt.Sprintf("%s/openai/deployments/%s/chat/completions?api-version=%s", strings.TrimSuffix(endpoint, "/"), spec.Deployment, apiVersion)
+
+	slog.DebugContext(ctx, "正在發送 OpenAI 請求", "url", url, "deployment", spec.Deployment, "messages", len(messages))
+
 	reqMessages := make([]map[string]string, len(messages))
 	for i, msg := range messages {
 		reqMessages[i] = map[string]string{
 			"role":    msg.Role,
 			"content": msg.Content,
 		}
+		if msg.Name != "" {
+			reqMessages[i]["name"] = msg.Name
+		}
 	}
-
-	log.Printf("--- OpenAI Service Received Messages ---")
-	for i, msg := range reqMessages {
-		log.Printf("Message %d: Role: %s, Content: \"%s\"", i+1, msg["role"], msg["content"])
+	for i, msg := range messages {
+		slog.DebugContext(ctx, "OpenAI 請求訊息", "index", i+1, "role", msg.Role, logging.Content("content", msg.Content))
 	}
-	log.Printf("--- End OpenAI Service Received Messages ---")
 
+	if maxTokens <= 0 {
+		maxTokens = 800
+	}
+	if spec.MaxOutputTokens > 0 && spec.MaxOutputTokens < maxTokens {
+		maxTokens = spec.MaxOutputTokens
+	}
 
 	payload := map[string]interface{}{
 		"messages": reqMessages,
-		"max_tokens":        800,
-		"temperature":       1.0,
-		"top_p":             1.0,
-		"frequency_penalty": 0.0,
-		"presence_penalty":  0.0,
+	}
+	if spec.Capabilities.Reasoning {
+		// 推理模型不接受 max_tokens 與取樣參數
+		payload["max_completion_tokens"] = maxTokens
+	} else {
+		payload["max_tokens"] = maxTokens
+		payload["temperature"] = 1.0
+		payload["top_p"] = 1.0
+		payload["frequency_penalty"] = 0.0
+		payload["presence_penalty"] = 0.0
 	}
 
 	jsonData, err := json.Marshal(payload)
 	if err != nil {
-		return "", fmt.Errorf("JSON 編碼錯誤: %w", err)
+		return nil, &responseParseError{fmt.Errorf("JSON 編碼錯誤: %w", err)}
 	}
 
-	req, err := http.NewRequest("POST", url, bytes.NewBuffer(jsonData))
+	policy := RetryPolicy{Timeout: cfg.AzureRequestTimeout, Idempotent: true, Deployment: spec.Name}
+	resp, err := s.azure.Do(ctx, policy, func(ctx context.Context) (*http.Request, error) {
+		req, err := http.NewRequestWithContext(ctx, "POST", url, bytes.NewReader(jsonData))
+		if err != nil {
+			return nil, fmt.Errorf("建立請求失敗: %w", err)
+		}
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("api-key", apiKey)
+		return req, nil
+	})
 	if err != nil {
-		return "", fmt.Errorf("建立請求失敗: %w", err)
+		return nil, fmt.Errorf("請求失敗: %w", err)
 	}
-	req.Header.Set("Content-Type", "application/json")
-	req.Header.Set("api-key", apiKey)
 
-	client := &http.Client{}
-	resp, err := client.Do(req)
+	body, err := readBody(resp)
 	if err != nil {
-		return "", fmt.Errorf("請求失敗: %w", err)
+		return nil, err
 	}
-	defer resp.Body.Close()
-
-	body, err := io.ReadAll(resp.Body)
-	if err != nil {
-		return "", fmt.Errorf("讀取回應失敗: %w", err)
+	if resp.StatusCode != http.StatusOK {
+		return nil, &AzureStatusError{StatusCode: resp.StatusCode, Body: string(body)}
 	}
-	
+
 	var result struct {
 		Choices []struct {
 			Message struct {
 				Content string `json:"content"`
 			} `json:"message"`
 		} `json:"choices"`
+		Usage models.Usage `json:"usage"`
 	}
 
 	if err := json.Unmarshal(body, &result); err != nil {
-		log.Printf("回應解析錯誤: %v", err)
-		log.Printf("原始回應: %s", string(body))
-		return "", fmt.Errorf("回應解析錯誤: %w", err)
+		slog.ErrorContext(ctx, "OpenAI 回應解析錯誤", "deployment", spec.Deployment, "error", err, logging.Content("body", string(body)))
+		return nil, &responseParseError{fmt.Errorf("回應解析錯誤: %w", err)}
 	}
 
 	if len(result.Choices) > 0 {
-		return result.Choices[0].Message.Content, nil
+		span.SetAttributes(attribute.Int("usage.prompt_tokens", result.Usage.PromptTokens),
+			attribute.Int("usage.completion_tokens", result.Usage.CompletionTokens))
+		return &models.ChatCompletion{
+			Content:    result.Choices[0].Message.Content,
+			Deployment: spec.Name,
+			Usage:      result.Usage,
+			Cost:       spec.Pricing.EstimateCost(result.Usage.PromptTokens, result.Usage.CompletionTokens),
+		}, nil
 	}
 
-	log.Printf("回應中沒有 choices")
-	log.Printf("原始回應: %s", string(body))
-	return "", fmt.Errorf("未從 OpenAI 收到任何回應")
-}
\ No newline at end of file
+	slog.ErrorContext(ctx, "OpenAI 回應中沒有 choices", "deployment", spec.Deployment, logging.Content("body", string(body)))
+	return nil, &responseParseError{fmt.Errorf("未從 OpenAI 收到任何回應")}
+}
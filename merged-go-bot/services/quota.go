@@ -0,0 +1,140 @@
+package services
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"time"
+
+	"merged-go-bot/config"
+	"merged-go-bot/models"
+)
+
+const (
+	QuotaUnitTokens       = "tokens"
+	QuotaUnitVideoSeconds = "video_seconds"
+
+	QuotaPeriodDaily   = "daily"
+	QuotaPeriodMonthly = "monthly"
+)
+
+type QuotaService struct {
+	redisSvc *RedisService
+	cfg      *config.Store
+}
+
+func NewQuotaService(cfg *config.Store, redisSvc *RedisService) *QuotaService {
+	return &QuotaService{
+		redisSvc: redisSvc,
+		cfg:      cfg,
+	}
+}
+
+// EffectiveQuota 回傳聊天室自訂的額度，未設定時使用全域預設值。
+func (s *QuotaService) EffectiveQuota(roomConfig *models.RoomConfig) models.RoomQuota {
+	if roomConfig != nil && roomConfig.Quota != nil {
+		return *roomConfig.Quota
+	}
+	return s.cfg.Current().DefaultRoomQuota
+}
+
+// Status 回傳聊天室在指定單位下所有有上限的期間的使用情況。
+func (s *QuotaService) Status(ctx context.Context, roomConfig *models.RoomConfig, unit string) ([]models.QuotaStatus, error) {
+	quota := s.EffectiveQuota(roomConfig)
+	var daily, monthly int64
+	switch unit {
+	case QuotaUnitTokens:
+		daily, monthly = quota.DailyTokens, quota.MonthlyTokens
+	case QuotaUnitVideoSeconds:
+		daily, monthly = quota.DailyVideoSeconds, quota.MonthlyVideoSeconds
+	default:
+		return nil, fmt.Errorf("未知的額度單位: %s", unit)
+	}
+	if daily == 0 && monthly == 0 {
+		return nil, nil
+	}
+
+	now := time.Now()
+	today := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, now.Location())
+	var statuses []models.QuotaStatus
+
+	if daily > 0 {
+		usage, err := s.redisSvc.GetRoomUsage(ctx, roomConfig.ChatID, today, today)
+		if err != nil {
+			return nil, err
+		}
+		statuses = append(statuses, models.QuotaStatus{Period: QuotaPeriodDaily, Unit: unit, Limit: daily, Used: usedFor(usage, unit)})
+	}
+	if monthly > 0 {
+		monthStart := time.Date(today.Year(), today.Month(), 1, 0, 0, 0, 0, today.Location())
+		usage, err := s.redisSvc.GetRoomUsage(ctx, roomConfig.ChatID, monthStart, today)
+		if err != nil {
+			return nil, err
+		}
+		statuses = append(statuses, models.QuotaStatus{Period: QuotaPeriodMonthly, Unit: unit, Limit: monthly, Used: usedFor(usage, unit)})
+	}
+	return statuses, nil
+}
+
+// Check 判斷聊天室是否還有足夠額度；requested 為本次預計使用量 (token 請求無法預知，傳入 0)。
+// 額度不足時回傳已用盡的期間。
+func (s *QuotaService) Check(ctx context.Context, roomConfig *models.RoomConfig, unit string, requested int64) (*models.QuotaStatus, error) {
+	statuses, err := s.Status(ctx, roomConfig, unit)
+	if err != nil {
+		return nil, err
+	}
+	for _, status := range statuses {
+		if status.Used >= status.Limit || status.Used+requested > status.Limit {
+			exhausted := status
+			return &exhausted, nil
+		}
+	}
+	return nil, nil
+}
+
+// CrossedThresholds 回傳本期間首次跨過的警告門檻；同一門檻在同一期間只會回傳一次。
+func (s *QuotaService) CrossedThresholds(ctx context.Context, roomConfig *models.RoomConfig, unit string) ([]models.QuotaStatus, []float64, error) {
+	statuses, err := s.Status(ctx, roomConfig, unit)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	thresholds := append([]float64(nil), s.cfg.Current().QuotaWarningThresholds...)
+	sort.Sort(sort.Reverse(sort.Float64Slice(thresholds)))
+
+	var crossed []models.QuotaStatus
+	var levels []float64
+	now := time.Now()
+	for _, status := range statuses {
+		ratio := float64(status.Used) / float64(status.Limit)
+		for _, threshold := range thresholds {
+			if ratio < threshold {
+				continue
+			}
+			periodKey := now.Format("2006-01-02")
+			ttl := 48 * time.Hour
+			if status.Period == QuotaPeriodMonthly {
+				periodKey = now.Format("2006-01")
+				ttl = 32 * 24 * time.Hour
+			}
+			first, err := s.redisSvc.MarkQuotaWarned(ctx, roomConfig.ChatID, unit, periodKey, threshold, ttl)
+			if err != nil {
+				return nil, nil, err
+			}
+			if first {
+				crossed = append(crossed, status)
+				levels = append(levels, threshold)
+			}
+			// 只針對最高的已跨過門檻提醒一次
+			break
+		}
+	}
+	return crossed, levels, nil
+}
+
+func usedFor(usage *models.UsageSummary, unit string) int64 {
+	if unit == QuotaUnitVideoSeconds {
+		return usage.VideoSeconds
+	}
+	return usage.TotalTokens
+}
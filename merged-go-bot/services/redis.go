@@ -4,54 +4,68 @@ import (
 	"context"
 	"encoding/json"
 	"fmt"
-	"log"
+	"log/slog"
+	"net"
 	"time"
 
 	"github.com/redis/go-redis/v9"
+	"go.opentelemetry.io/otel/attribute"
+	"merged-go-bot/metrics"
 	"merged-go-bot/models"
+	"merged-go-bot/tracing"
 )
 
 type RedisService struct {
 	client *redis.Client
-	ctx    context.Context
 }
 
-func NewRedisService(addr, password string, db int) *RedisService {
+// NewRedisService 建立 Redis 客戶端。啟動時連不上 Redis 只會記錄警告，
+// 客戶端會在之後的指令自動重連，狀態由 /readyz 回報。
+func NewRedisService(ctx context.Context, addr, password string, db int) *RedisService {
 	rdb := redis.NewClient(&redis.Options{
 		Addr:     addr,
 		Password: password,
 		DB:       db,
 	})
-
-	ctx := context.Background()
-	_, err := rdb.Ping(ctx).Result()
-	if err != nil {
-		log.Fatalf("無法連接到 Redis (DB %d): %v", db, err)
+	rdb.AddHook(redisLogHook{})
+	s := &RedisService{
+		client: rdb,
 	}
 
-	log.Printf("成功連接到 Redis (DB %d)。", db)
-	return &RedisService{
-		client: rdb,
-		ctx:    ctx,
+	pingCtx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+	if err := s.Ping(pingCtx); err != nil {
+		slog.Warn("目前無法連接到 Redis，將在之後的請求重試", "addr", addr, "db", db, "error", err)
+	} else {
+		slog.Info("成功連接到 Redis", "addr", addr, "db", db)
 	}
+	return s
+}
+
+func (s *RedisService) Ping(ctx context.Context) error {
+	return s.client.Ping(ctx).Err()
 }
 
 func (s *RedisService) Close() error {
 	return s.client.Close()
 }
 
-func (s *RedisService) SaveRoomConfig(config *models.RoomConfig) error {
+func (s *RedisService) SaveRoomConfig(ctx context.Context, config *models.RoomConfig) (err error) {
+	ctx, span := tracing.Start(ctx, "redis.SaveRoomConfig", attribute.Int64("chat.id", config.ChatID))
+	defer func() { tracing.End(span, err) }()
 	key := fmt.Sprintf("room_config:%d", config.ChatID)
 	data, err := json.Marshal(config)
 	if err != nil {
 		return fmt.Errorf("序列化聊天室配置失敗: %w", err)
 	}
-	return s.client.Set(s.ctx, key, data, 0).Err()
+	return s.client.Set(ctx, key, data, 0).Err()
 }
 
-func (s *RedisService) GetRoomConfig(chatID int64) (*models.RoomConfig, error) {
+func (s *RedisService) GetRoomConfig(ctx context.Context, chatID int64) (_ *models.RoomConfig, err error) {
+	ctx, span := tracing.Start(ctx, "redis.GetRoomConfig", attribute.Int64("chat.id", chatID))
+	defer func() { tracing.End(span, err) }()
 	key := fmt.Sprintf("room_config:%d", chatID)
-	data, err := s.client.Get(s.ctx, key).Bytes()
+	data, err := s.client.Get(ctx, key).Bytes()
 	if err == redis.Nil {
 		return nil, nil
 	}
@@ -66,33 +80,270 @@ func (s *RedisService) GetRoomConfig(chatID int64) (*models.RoomConfig, error) {
 	return &config, nil
 }
 
-func (s *RedisService) SaveMessages(chatID int64, messages []models.Message) error {
-	key := fmt.Sprintf("chat_history:%d", chatID)
-	data, err := json.Marshal(messages)
+func historyKey(k models.HistoryKey) string {
+	key := "chat_history:" + scopeID(k)
+	if k.UserID == 0 && k.RootID != 0 {
+		key += fmt.Sprintf(":thread:%d", k.RootID)
+	}
+	if k.ConversationID != 0 {
+		key += fmt.Sprintf(":conv:%d", k.ConversationID)
+	}
+	return key
+}
+
+// scopeID 為聊天室、論壇主題與成員 (每位成員各自的範圍) 組成的識別，具名對話以此為單位。
+func scopeID(k models.HistoryKey) string {
+	id := fmt.Sprintf("%d", k.ChatID)
+	if k.TopicID != 0 {
+		id += fmt.Sprintf(":topic:%d", k.TopicID)
+	}
+	if k.UserID != 0 {
+		id += fmt.Sprintf(":user:%d", k.UserID)
+	}
+	return id
+}
+
+func historyAttributes(k models.HistoryKey) []attribute.KeyValue {
+	return []attribute.KeyValue{attribute.Int64("chat.id", k.ChatID), attribute.String("history.key", historyKey(k))}
+}
+
+// HistoryTTL 回傳聊天歷史的剩餘保存時間；沒有聊天歷史時 exists 為 false，永久保存時 ttl 為 0。
+func (s *RedisService) HistoryTTL(ctx context.Context, hk models.HistoryKey) (ttl time.Duration, exists bool, err error) {
+	ttl, err = s.client.PTTL(ctx, historyKey(hk)).Result()
+	if err != nil {
+		return 0, false, fmt.Errorf("查詢聊天歷史保存時間失敗: %w", err)
+	}
+	// go-redis 以 -2 表示 key 不存在、-1 表示沒有設定過期時間
+	switch ttl {
+	case -2:
+		return 0, false, nil
+	case -1:
+		return 0, true, nil
+	}
+	return ttl, true, nil
+}
+
+func (s *RedisService) ClearMessages(ctx context.Context, hk models.HistoryKey) (err error) {
+	ctx, span := tracing.Start(ctx, "redis.ClearMessages", historyAttributes(hk)...)
+	defer func() { tracing.End(span, err) }()
+	return s.client.Del(ctx, historyKey(hk)).Err()
+}
+
+// scanKeys 回傳符合 pattern 的所有 key。
+func (s *RedisService) scanKeys(ctx context.Context, pattern string) ([]string, error) {
+	var keys []string
+	iter := s.client.Scan(ctx, 0, pattern, 100).Iterator()
+	for iter.Next(ctx) {
+		keys = append(keys, iter.Val())
+	}
+	return keys, iter.Err()
+}
+
+// ExpireAllMessages 將聊天室 (含所有論壇主題、成員、回覆串與具名對話) 的聊天歷史與對話資訊保存時間改為 ttl，
+// ttl 為 0 時改為永久保存；訊息 ID 索引的保存時間只會縮短。回傳更新的聊天歷史數量。
+func (s *RedisService) ExpireAllMessages(ctx context.Context, chatID int64, ttl time.Duration) (_ int, err error) {
+	ctx, span := tracing.Start(ctx, "redis.ExpireAllMessages", attribute.Int64("chat.id", chatID))
+	defer func() { tracing.End(span, err) }()
+
+	prefix := historyKey(models.HistoryKey{ChatID: chatID})
+	keys, err := s.scanKeys(ctx, prefix+":*")
+	if err != nil {
+		return 0, fmt.Errorf("列出聊天歷史失敗: %w", err)
+	}
+	keys = append(keys, prefix)
+	var meta []string
+	for _, p := range []string{"conversations:", "active_conversation:"} {
+		scoped, err := s.scanKeys(ctx, fmt.Sprintf("%s%d:*", p, chatID))
+		if err != nil {
+			return 0, fmt.Errorf("列出對話資訊失敗: %w", err)
+		}
+		meta = append(append(meta, fmt.Sprintf("%s%d", p, chatID)), scoped...)
+	}
+	var turns []string
+	if ttl > 0 && ttl < turnTTL {
+		if turns, err = s.scanKeys(ctx, fmt.Sprintf("turn:%d:*", chatID)); err != nil {
+			return 0, fmt.Errorf("列出對話索引失敗: %w", err)
+		}
+	}
+
+	cmds, err := s.client.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+		for _, key := range append(keys, meta...) {
+			expireHistory(ctx, pipe, key, ttl)
+		}
+		for _, key := range turns {
+			pipe.ExpireLT(ctx, key, ttl)
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, fmt.Errorf("更新聊天歷史保存時間失敗: %w", err)
+	}
+	n := 0
+	for _, cmd := range cmds[:len(keys)] {
+		if cmd.(*redis.BoolCmd).Val() {
+			n++
+		}
+	}
+	return n, nil
+}
+
+// ClearTurns 刪除聊天室所有的訊息 ID 索引，回傳刪除的數量。
+func (s *RedisService) ClearTurns(ctx context.Context, chatID int64) (_ int, err error) {
+	ctx, span := tracing.Start(ctx, "redis.ClearTurns", attribute.Int64("chat.id", chatID))
+	defer func() { tracing.End(span, err) }()
+
+	keys, err := s.scanKeys(ctx, fmt.Sprintf("turn:%d:*", chatID))
+	if err != nil {
+		return 0, fmt.Errorf("列出對話索引失敗: %w", err)
+	}
+	if len(keys) == 0 {
+		return 0, nil
+	}
+	n, err := s.client.Del(ctx, keys...).Result()
+	if err != nil {
+		return 0, fmt.Errorf("刪除對話索引失敗: %w", err)
+	}
+	return int(n), nil
+}
+
+// ClearAllMessages 刪除 base (聊天室或論壇主題) 之下所有範圍 (共用、每位成員、每個回覆串) 的聊天歷史
+// 與具名對話，回傳刪除的數量。base 為聊天室時也會刪除所有主題的歷史。
+func (s *RedisService) ClearAllMessages(ctx context.Context, base models.HistoryKey) (_ int, err error) {
+	ctx, span := tracing.Start(ctx, "redis.ClearAllMessages", historyAttributes(base)...)
+	defer func() { tracing.End(span, err) }()
+
+	scope := scopeID(models.HistoryKey{ChatID: base.ChatID, TopicID: base.TopicID})
+	var keys []string
+	for _, prefix := range []string{"chat_history:", "conversations:", "active_conversation:"} {
+		keys = append(keys, prefix+scope)
+		iter := s.client.Scan(ctx, 0, prefix+scope+":*", 100).Iterator()
+		for iter.Next(ctx) {
+			keys = append(keys, iter.Val())
+		}
+		if err := iter.Err(); err != nil {
+			return 0, fmt.Errorf("列出聊天歷史失敗: %w", err)
+		}
+	}
+	n, err := s.client.Del(ctx, keys...).Result()
+	if err != nil {
+		return 0, fmt.Errorf("刪除聊天歷史失敗: %w", err)
+	}
+	span.SetAttributes(attribute.Int64("deleted", n))
+	return int(n), nil
+}
+
+// turnTTL 為訊息 ID 索引的保存時間上限，比預設的聊天歷史長，才能找回已過期或被裁剪的回答
+const turnTTL = 7 * 24 * time.Hour
+
+func turnKey(chatID int64, messageID int) string {
+	return fmt.Sprintf("turn:%d:%d", chatID, messageID)
+}
+
+// SaveTurn 以使用者訊息與機器人回覆的訊息 ID 索引一問一答。索引含有對話內容，
+// 聊天歷史的保存時間 ttl 比 turnTTL 短時以 ttl 為準。
+func (s *RedisService) SaveTurn(ctx context.Context, turn *models.Turn, ttl time.Duration) (err error) {
+	ctx, span := tracing.Start(ctx, "redis.SaveTurn", historyAttributes(turn.History)...)
+	defer func() { tracing.End(span, err) }()
+	data, err := json.Marshal(turn)
+	if err != nil {
+		return fmt.Errorf("序列化對話索引失敗: %w", err)
+	}
+	if ttl == 0 || ttl > turnTTL {
+		ttl = turnTTL
+	}
+	_, err = s.client.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+		for _, id := range []int{turn.UserMessageID, turn.BotMessageID} {
+			if id != 0 {
+				pipe.Set(ctx, turnKey(turn.History.ChatID, id), data, ttl)
+			}
+		}
+		return nil
+	})
 	if err != nil {
-		return fmt.Errorf("序列化聊天歷史失敗: %w", err)
+		return fmt.Errorf("保存對話索引失敗: %w", err)
 	}
-	return s.client.Set(s.ctx, key, data, 24*time.Hour).Err()
+	return nil
 }
 
-func (s *RedisService) GetMessages(chatID int64) ([]models.Message, error) {
-	key := fmt.Sprintf("chat_history:%d", chatID)
-	data, err := s.client.Get(s.ctx, key).Bytes()
+// GetTurn 以使用者訊息或機器人回覆的訊息 ID 找出一問一答，找不到時回傳 nil。
+func (s *RedisService) GetTurn(ctx context.Context, chatID int64, messageID int) (_ *models.Turn, err error) {
+	ctx, span := tracing.Start(ctx, "redis.GetTurn", attribute.Int64("chat.id", chatID), attribute.Int("message.id", messageID))
+	defer func() { tracing.End(span, err) }()
+	data, err := s.client.Get(ctx, turnKey(chatID, messageID)).Bytes()
 	if err == redis.Nil {
-		return []models.Message{}, nil
+		return nil, nil
 	}
 	if err != nil {
-		return nil, fmt.Errorf("從 Redis 獲取聊天歷史失敗: %w", err)
+		return nil, fmt.Errorf("查詢對話索引失敗: %w", err)
+	}
+	var turn models.Turn
+	if err := json.Unmarshal(data, &turn); err != nil {
+		return nil, fmt.Errorf("反序列化對話索引失敗: %w", err)
 	}
+	return &turn, nil
+}
 
-	var messages []models.Message
-	if err := json.Unmarshal(data, &messages); err != nil {
-		return nil, fmt.Errorf("反序列化聊天歷史失敗: %w", err)
+// SetThreadRoot 記錄訊息所屬回覆串的第一則訊息，讓之後回覆這則訊息的人接續同一段歷史。
+// ttl 與回覆串的聊天歷史相同。
+func (s *RedisService) SetThreadRoot(ctx context.Context, chatID int64, rootID int, ttl time.Duration, messageIDs ...int) error {
+	_, err := s.client.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+		for _, id := range messageIDs {
+			pipe.Set(ctx, fmt.Sprintf("thread_root:%d:%d", chatID, id), rootID, ttl)
+		}
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("記錄回覆串失敗: %w", err)
 	}
-	return messages, nil
+	return nil
 }
 
-func (s *RedisService) ClearMessages(chatID int64) error {
-	key := fmt.Sprintf("chat_history:%d", chatID)
-	return s.client.Del(s.ctx, key).Err()
+// GetThreadRoot 回傳訊息所屬回覆串的第一則訊息，未記錄時回傳 0。
+func (s *RedisService) GetThreadRoot(ctx context.Context, chatID int64, messageID int) (int, error) {
+	root, err := s.client.Get(ctx, fmt.Sprintf("thread_root:%d:%d", chatID, messageID)).Int()
+	if err == redis.Nil {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, fmt.Errorf("查詢回覆串失敗: %w", err)
+	}
+	return root, nil
+}
+
+// redisLogHook 記錄失敗的 Redis 指令 (debug 等級時記錄所有指令)，並帶上 context 中的 correlation ID。
+type redisLogHook struct{}
+
+func (redisLogHook) DialHook(next redis.DialHook) redis.DialHook {
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		return next(ctx, network, addr)
+	}
+}
+
+func (redisLogHook) ProcessHook(next redis.ProcessHook) redis.ProcessHook {
+	return func(ctx context.Context, cmd redis.Cmder) error {
+		start := time.Now()
+		err := next(ctx, cmd)
+		if err != nil && err != redis.Nil {
+			metrics.RedisErrors.WithLabelValues(cmd.Name()).Inc()
+			slog.WarnContext(ctx, "Redis 指令失敗", "command", cmd.Name(), "error", err)
+		} else {
+			slog.DebugContext(ctx, "Redis 指令", "command", cmd.Name(), "duration", time.Since(start))
+		}
+		return err
+	}
+}
+
+func (redisLogHook) ProcessPipelineHook(next redis.ProcessPipelineHook) redis.ProcessPipelineHook {
+	return func(ctx context.Context, cmds []redis.Cmder) error {
+		start := time.Now()
+		err := next(ctx, cmds)
+		// TxFailedErr 為 WATCH 的 key 被並行修改，由呼叫端重試，不算錯誤
+		if err != nil && err != redis.Nil && err != redis.TxFailedErr {
+			metrics.RedisErrors.WithLabelValues("pipeline").Inc()
+			slog.WarnContext(ctx, "Redis pipeline 失敗", "commands", len(cmds), "error", err)
+		} else {
+			slog.DebugContext(ctx, "Redis pipeline", "commands", len(cmds), "duration", time.Since(start))
+		}
+		return err
+	}
 }
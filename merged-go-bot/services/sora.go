@@ -2,11 +2,12 @@ package services
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
 	"fmt"
 	"io"
 	"io/ioutil"
-	"log"
+	"log/slog"
 	"net/http"
 	"os"
 	"path/filepath"
@@ -15,197 +16,234 @@ import (
 	"strconv"
 
 	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 	"merged-go-bot/config"
+	"merged-go-bot/logging"
+	"merged-go-bot/metrics"
+	"merged-go-bot/models"
+	"merged-go-bot/telegram"
+	"merged-go-bot/tracing"
 )
 
 type SoraService struct {
-	bot               *tgbotapi.BotAPI
-	endpoint          string
-	deploymentName    string
-	apiVersion        string
-	apiKey            string
-	defaultWidth      int
-	defaultHeight     int
-	defaultNSeconds   int
+	bot   *tgbotapi.BotAPI
+	cfg   *config.Store
+	azure *AzureClient
 }
 
-func NewSoraService(cfg *config.Config, bot *tgbotapi.BotAPI) *SoraService {
+func NewSoraService(cfg *config.Store, azure *AzureClient, bot *tgbotapi.BotAPI) *SoraService {
 	if _, err := os.Stat("tmp"); os.IsNotExist(err) {
-		log.Println("Creating tmp directory for video files...")
+		slog.Info("建立影片暫存目錄 tmp")
 		os.Mkdir("tmp", 0755)
 	}
 	return &SoraService{
-		bot:               bot,
-		endpoint:          cfg.AzureOpenAIEndpoint,
-		deploymentName:    cfg.AzureOpenAISoraDeploymentName,
-		apiVersion:        cfg.AzureOpenAISoraAPIVersion,
-		apiKey:            cfg.AzureOpenAIAPIKey,
-		defaultWidth:      cfg.SoraDefaultWidth,
-		defaultHeight:     cfg.SoraDefaultHeight,
-		defaultNSeconds:   cfg.SoraDefaultNSeconds,
+		bot:   bot,
+		cfg:   cfg,
+		azure: azure,
 	}
 }
 
-func (s *SoraService) GenerateVideo(chatID int64, prompt string) (string, error) {
-	log.Printf("SoraService: 準備生成影片。Prompt: \"%s\"", prompt)
-	s.sendMessage(chatID, "開始生成影片... 🎬")
+// GenerateVideo 提交 Sora 任務並輪詢到完成；ctx 被取消 (例如 /cancel 或關機) 時停止輪詢並回傳 ctx 的錯誤。
+func (s *SoraService) GenerateVideo(ctx context.Context, chatID int64, prompt string) (_ *models.VideoGeneration, err error) {
+	ctx, span := tracing.Start(ctx, "sora.job", attribute.Int64("chat.id", chatID))
+	defer func() { tracing.End(span, err) }()
 
-	createURL := fmt.Sprintf("%s/openai/v1/video/generations/jobs?api-version=%s", strings.TrimSuffix(s.endpoint, "/"), s.apiVersion)
+	slog.InfoContext(ctx, "SoraService: 準備生成影片", "chat_id", chatID, logging.Content("prompt", prompt))
+	s.sendMessage(ctx, chatID, "開始生成影片... 🎬")
+
+	cfg := s.cfg.Current()
+	endpoint := strings.TrimSuffix(cfg.AzureOpenAIEndpoint, "/")
+	apiVersion := cfg.AzureOpenAISoraAPIVersion
+	apiKey := cfg.AzureOpenAIAPIKey
+
+	createURL := fmt.Sprintf("%s/openai/v1/video/generations/jobs?api-version=%s", endpoint, apiVersion)
 
 	payload := map[string]interface{}{
-		"model":      s.deploymentName,
+		"model":      cfg.AzureOpenAISoraDeploymentName,
 		"prompt":     prompt,
-		"width":      strconv.Itoa(s.defaultWidth),
-		"height":     strconv.Itoa(s.defaultHeight),
-		"n_seconds":  strconv.Itoa(s.defaultNSeconds),
+		"width":      strconv.Itoa(cfg.SoraDefaultWidth),
+		"height":     strconv.Itoa(cfg.SoraDefaultHeight),
+		"n_seconds":  strconv.Itoa(cfg.SoraDefaultNSeconds),
 		"n_variants": strconv.Itoa(1),
 	}
 
 	body, err := json.Marshal(payload)
 	if err != nil {
-		return "", fmt.Errorf("SoraService: JSON 編碼失敗: %w", err)
-	}
-
-	req, err := http.NewRequest("POST", createURL, bytes.NewBuffer(body))
-	if err != nil {
-		return "", fmt.Errorf("SoraService: 建立影片生成請求失敗: %w", err)
+		return nil, fmt.Errorf("SoraService: JSON 編碼失敗: %w", err)
 	}
 
-	req.Header.Set("Content-Type", "application/json")
-	req.Header.Set("api-key", s.apiKey)
-	
-	log.Printf("SoraService: 正在發送 curl 請求：\ncurl -X POST \"%s\" \\\n  -H \"Content-Type: application/json\" \\\n  -H \"Api-key: %s\" \\\n  -d '%s'",
-		createURL, s.apiKey, string(body))
+	slog.DebugContext(ctx, "SoraService: 提交影片生成任務", "url", createURL, "width", cfg.SoraDefaultWidth,
+		"height", cfg.SoraDefaultHeight, "n_seconds", cfg.SoraDefaultNSeconds)
 
-	client := &http.Client{}
-	resp, err := client.Do(req)
+	// 建立任務不是冪等操作，只在確定 Azure 尚未受理時才重試，避免重複建立任務
+	createPolicy := RetryPolicy{Timeout: cfg.AzureRequestTimeout, Idempotent: false, Deployment: cfg.AzureOpenAISoraDeploymentName}
+	resp, err := s.azure.Do(ctx, createPolicy, func(ctx context.Context) (*http.Request, error) {
+		req, err := http.NewRequestWithContext(ctx, "POST", createURL, bytes.NewReader(body))
+		if err != nil {
+			return nil, fmt.Errorf("SoraService: 建立影片生成請求失敗: %w", err)
+		}
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("api-key", apiKey)
+		return req, nil
+	})
 	if err != nil {
-		return "", fmt.Errorf("SoraService: 提交影片生成請求失敗: %w", err)
+		return nil, fmt.Errorf("SoraService: 提交影片生成請求失敗: %w", err)
 	}
 	defer resp.Body.Close()
 
 	respBody, _ := ioutil.ReadAll(resp.Body)
 	if resp.StatusCode != http.StatusCreated {
-		return "", fmt.Errorf("SoraService: 提交影片生成請求失敗，狀態碼: %d，回應內容: %s", resp.StatusCode, string(respBody))
+		return nil, fmt.Errorf("SoraService: 提交影片生成請求失敗，狀態碼: %d，回應內容: %s", resp.StatusCode, string(respBody))
 	}
 
 	var createResult map[string]interface{}
 	if err := json.Unmarshal(respBody, &createResult); err != nil {
-		return "", fmt.Errorf("SoraService: 解析生成請求回應失敗: %w", err)
+		return nil, fmt.Errorf("SoraService: 解析生成請求回應失敗: %w", err)
 	}
 
 	jobID, ok := createResult["id"].(string)
 	if !ok {
-		return "", fmt.Errorf("SoraService: 生成請求回應中未找到 job ID")
+		return nil, fmt.Errorf("SoraService: 生成請求回應中未找到 job ID")
 	}
-	log.Printf("SoraService: 影片生成任務已提交，Job ID: %s", jobID)
-	s.sendMessage(chatID, "開始輪詢影片生成狀態... 🔄")
+	slog.InfoContext(ctx, "SoraService: 影片生成任務已提交", "job_id", jobID)
+	span.SetAttributes(attribute.String("sora.job_id", jobID))
 
+	// 任務結束時依最終狀態記錄指標；輪詢或下載失敗記為 error，被取消記為 aborted
+	jobStarted := time.Now()
+	finalStatus := "error"
+	defer func() {
+		if ctx.Err() != nil && finalStatus == "error" {
+			finalStatus = "aborted"
+		}
+		metrics.SoraJobs.WithLabelValues(finalStatus).Inc()
+		metrics.SoraJobDuration.WithLabelValues(finalStatus).Observe(time.Since(jobStarted).Seconds())
+	}()
+	s.sendMessage(ctx, chatID, "開始輪詢影片生成狀態... 🔄")
+
+	pollPolicy := RetryPolicy{Timeout: cfg.AzureRequestTimeout, Idempotent: true, Deployment: cfg.AzureOpenAISoraDeploymentName}
 	var currentStatus string
 	var statusResult map[string]interface{}
 	for currentStatus != "succeeded" && currentStatus != "failed" && currentStatus != "cancelled" {
-		time.Sleep(5 * time.Second)
-
-		statusURL := fmt.Sprintf("%s/openai/v1/video/generations/jobs/%s?api-version=%s", strings.TrimSuffix(s.endpoint, "/"), jobID, s.apiVersion)
-		statusReq, err := http.NewRequest("GET", statusURL, nil)
-		if err != nil {
-			return "", fmt.Errorf("SoraService: 建立狀態查詢請求失敗: %w", err)
+		if !sleepContext(ctx, 5*time.Second) {
+			slog.InfoContext(ctx, "SoraService: 輪詢已中止", "job_id", jobID, "error", ctx.Err())
+			return nil, ctx.Err()
 		}
-		statusReq.Header.Set("api-key", s.apiKey)
 
-		statusResp, err := client.Do(statusReq)
+		statusURL := fmt.Sprintf("%s/openai/v1/video/generations/jobs/%s?api-version=%s", endpoint, jobID, apiVersion)
+		statusResp, err := s.azure.Do(ctx, pollPolicy, s.getRequest(statusURL, apiKey))
 		if err != nil {
-			return "", fmt.Errorf("SoraService: 查詢狀態失敗: %w", err)
+			return nil, fmt.Errorf("SoraService: 查詢狀態失敗: %w", err)
 		}
 		statusBody, _ := ioutil.ReadAll(statusResp.Body)
 		statusResp.Body.Close()
 
 		if statusResp.StatusCode != http.StatusOK {
-			return "", fmt.Errorf("SoraService: 查詢狀態請求失敗，狀態碼: %d，回應內容: %s", statusResp.StatusCode, string(statusBody))
+			return nil, fmt.Errorf("SoraService: 查詢狀態請求失敗，狀態碼: %d，回應內容: %s", statusResp.StatusCode, string(statusBody))
 		}
 
 		if err := json.Unmarshal(statusBody, &statusResult); err != nil {
-			return "", fmt.Errorf("SoraService: 解析狀態回應失敗: %w", err)
+			return nil, fmt.Errorf("SoraService: 解析狀態回應失敗: %w", err)
 		}
 		
 		tempStatus, ok := statusResult["status"].(string)
 		if !ok {
-			return "", fmt.Errorf("SoraService: 狀態回應中未找到 'status' 字段")
+			return nil, fmt.Errorf("SoraService: 狀態回應中未找到 'status' 字段")
 		}
+		span.AddEvent("poll", trace.WithAttributes(attribute.String("sora.status", tempStatus)))
 		
 		if currentStatus != tempStatus {
 			currentStatus = tempStatus
-			log.Printf("SoraService: Job 狀態: %s", currentStatus)
-			s.sendMessage(chatID, fmt.Sprintf("Job 狀態: %s", currentStatus))
+			slog.InfoContext(ctx, "SoraService: Job 狀態變更", "job_id", jobID, "status", currentStatus)
+			s.sendMessage(ctx, chatID, fmt.Sprintf("Job 狀態: %s", currentStatus))
 		}
 	}
 
+	span.SetAttributes(attribute.String("sora.final_status", currentStatus))
 	if currentStatus != "succeeded" {
-		s.sendMessage(chatID, fmt.Sprintf("影片生成任務未成功。最終狀態: %s ❌", currentStatus))
-		return "", fmt.Errorf("SoraService: 影片生成任務未成功。最終狀態: %s", currentStatus)
+		finalStatus = currentStatus
+		s.sendMessage(ctx, chatID, fmt.Sprintf("影片生成任務未成功。最終狀態: %s ❌", currentStatus))
+		return nil, fmt.Errorf("SoraService: 影片生成任務未成功。最終狀態: %s", currentStatus)
 	}
 
-	s.sendMessage(chatID, "✅ 影片生成成功。")
+	s.sendMessage(ctx, chatID, "✅ 影片生成成功。")
 
 	generations, ok := statusResult["generations"].([]interface{})
 	if !ok || len(generations) == 0 {
-		return "", fmt.Errorf("SoraService: 影片生成成功，但未找到影片內容。")
+		return nil, fmt.Errorf("SoraService: 影片生成成功，但未找到影片內容。")
 	}
 
 	firstGeneration, ok := generations[0].(map[string]interface{})
 	if !ok {
-		return "", fmt.Errorf("SoraService: 無法解析生成結果。")
+		return nil, fmt.Errorf("SoraService: 無法解析生成結果。")
 	}
 
 	generationID, ok := firstGeneration["id"].(string)
 	if !ok {
-		return "", fmt.Errorf("SoraService: 未找到 generation ID。")
+		return nil, fmt.Errorf("SoraService: 未找到 generation ID。")
 	}
 
-	videoURL := fmt.Sprintf("%s/openai/v1/video/generations/%s/content/video?api-version=%s", strings.TrimSuffix(s.endpoint, "/"), generationID, s.apiVersion)
-	log.Printf("SoraService: 正在下載影片: %s", videoURL)
-	s.sendMessage(chatID, "正在下載影片... 📥")
+	videoURL := fmt.Sprintf("%s/openai/v1/video/generations/%s/content/video?api-version=%s", endpoint, generationID, apiVersion)
+	span.AddEvent("download", trace.WithAttributes(attribute.String("sora.generation_id", generationID)))
+	slog.InfoContext(ctx, "SoraService: 正在下載影片", "job_id", jobID, "generation_id", generationID)
+	s.sendMessage(ctx, chatID, "正在下載影片... 📥")
 
-	videoReq, err := http.NewRequest("GET", videoURL, nil)
+	downloadPolicy := RetryPolicy{Timeout: cfg.AzureVideoDownloadTimeout, Idempotent: true, Deployment: cfg.AzureOpenAISoraDeploymentName}
+	finalVideoResp, err := s.azure.Do(ctx, downloadPolicy, s.getRequest(videoURL, apiKey))
 	if err != nil {
-		return "", fmt.Errorf("SoraService: 建立影片下載請求失敗: %w", err)
-	}
-	videoReq.Header.Set("api-key", s.apiKey)
-
-	finalVideoResp, err := client.Do(videoReq)
-	if err != nil {
-		return "", fmt.Errorf("SoraService: 下載影片失敗: %w", err)
+		return nil, fmt.Errorf("SoraService: 下載影片失敗: %w", err)
 	}
 	defer finalVideoResp.Body.Close()
 
 	if finalVideoResp.StatusCode != http.StatusOK {
 		videoErrorBody, _ := ioutil.ReadAll(finalVideoResp.Body)
-		return "", fmt.Errorf("SoraService: 下載影片失敗，狀態碼: %d，回應: %s", finalVideoResp.StatusCode, string(videoErrorBody))
+		return nil, fmt.Errorf("SoraService: 下載影片失敗，狀態碼: %d，回應: %s", finalVideoResp.StatusCode, string(videoErrorBody))
 	}
 
 	outputFilename := fmt.Sprintf("sora_output_%d.mp4", time.Now().Unix())
 	outputPath := filepath.Join("tmp", outputFilename)
 	file, err := os.Create(outputPath)
 	if err != nil {
-		return "", fmt.Errorf("SoraService: 建立檔案 %s 失敗: %w", outputPath, err)
+		return nil, fmt.Errorf("SoraService: 建立檔案 %s 失敗: %w", outputPath, err)
 	}
 	defer file.Close()
 
 	_, err = io.Copy(file, finalVideoResp.Body)
 	if err != nil {
-		return "", fmt.Errorf("SoraService: 寫入影片檔案 %s 失敗: %w", outputPath, err)
-	}
+		return nil, fmt.Errorf("SoraService: 寫入影片檔案 %s 失敗: %w", outputPath, err)
+	}
+
+	finalStatus = "succeeded"
+	slog.InfoContext(ctx, "SoraService: 影片已儲存", "job_id", jobID, "path", outputPath)
+	s.sendMessage(ctx, chatID, fmt.Sprintf("影片已下載到伺服器: `%s`", outputFilename))
+	return &models.VideoGeneration{
+		Path:    outputPath,
+		Width:   cfg.SoraDefaultWidth,
+		Height:  cfg.SoraDefaultHeight,
+		Seconds: cfg.SoraDefaultNSeconds,
+		Cost:    float64(cfg.SoraDefaultNSeconds) * cfg.SoraPricePerSecond,
+	}, nil
+}
 
-	log.Printf("SoraService: 生成的影片已儲存為 \"%s\"", outputPath)
-	s.sendMessage(chatID, fmt.Sprintf("影片已下載到伺服器: `%s`", outputFilename))
-	return outputPath, nil
+func (s *SoraService) getRequest(url, apiKey string) func(ctx context.Context) (*http.Request, error) {
+	return func(ctx context.Context) (*http.Request, error) {
+		req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
+		if err != nil {
+			return nil, fmt.Errorf("SoraService: 建立請求失敗: %w", err)
+		}
+		req.Header.Set("api-key", apiKey)
+		return req, nil
+	}
 }
 
-func (s *SoraService) sendMessage(chatID int64, text string) {
+func (s *SoraService) sendMessage(ctx context.Context, chatID int64, text string) {
 	msg := tgbotapi.NewMessage(chatID, text)
 	msg.ParseMode = tgbotapi.ModeMarkdown
-	_, err := s.bot.Send(msg)
+	_, span := tracing.Start(ctx, "telegram.Send", attribute.String("kind", "message"))
+	_, err := telegram.Send(ctx, s.bot, msg)
+	tracing.End(span, err)
 	if err != nil {
-		log.Printf("錯誤：SoraService 無法發送訊息到聊天室 %d: %v", chatID, err)
+		metrics.TelegramSendFailures.WithLabelValues("message").Inc()
+		slog.ErrorContext(ctx, "SoraService: 無法發送訊息到聊天室", "chat_id", chatID, "error", err)
 	}
 }
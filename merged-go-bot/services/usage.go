@@ -0,0 +1,185 @@
+package services
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+	"merged-go-bot/models"
+)
+
+const (
+	usageDateLayout = "2006-01-02"
+	usageTTL        = 400 * 24 * time.Hour
+	usageRoomsKey   = "usage:rooms"
+)
+
+func roomUsageKey(chatID int64, day string) string {
+	return fmt.Sprintf("usage:room:%d:%s", chatID, day)
+}
+
+func userUsageKey(userID int64, day string) string {
+	return fmt.Sprintf("usage:user:%d:%s", userID, day)
+}
+
+func roomUserUsageKey(chatID, userID int64, day string) string {
+	return fmt.Sprintf("usage:room:%d:user:%d:%s", chatID, userID, day)
+}
+
+// recordUsage 以 HINCRBY 將欄位累加到聊天室、使用者及聊天室內使用者的每日用量，
+// 預估費用則以 HINCRBYFLOAT 累加。
+func (s *RedisService) recordUsage(ctx context.Context, chatID, userID int64, fields map[string]int64, cost float64) error {
+	day := time.Now().Format(usageDateLayout)
+	keys := []string{roomUsageKey(chatID, day)}
+	if userID != 0 {
+		keys = append(keys, userUsageKey(userID, day), roomUserUsageKey(chatID, userID, day))
+	}
+
+	_, err := s.client.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		for _, key := range keys {
+			for field, value := range fields {
+				pipe.HIncrBy(ctx, key, field, value)
+			}
+			if cost > 0 {
+				pipe.HIncrByFloat(ctx, key, "cost", cost)
+			}
+			pipe.Expire(ctx, key, usageTTL)
+		}
+		pipe.SAdd(ctx, usageRoomsKey, chatID)
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("記錄用量失敗: %w", err)
+	}
+	return nil
+}
+
+func (s *RedisService) RecordChatUsage(ctx context.Context, chatID, userID int64, completion *models.ChatCompletion) error {
+	fields := map[string]int64{
+		"requests":          1,
+		"prompt_tokens":     int64(completion.Usage.PromptTokens),
+		"completion_tokens": int64(completion.Usage.CompletionTokens),
+		"total_tokens":      int64(completion.Usage.TotalTokens),
+	}
+	if completion.Deployment != "" {
+		fields["requests:"+completion.Deployment] = 1
+	}
+	if completion.FallbackFrom != "" {
+		fields["fallback_requests"] = 1
+	}
+	return s.recordUsage(ctx, chatID, userID, fields, completion.Cost)
+}
+
+func (s *RedisService) RecordVideoUsage(ctx context.Context, chatID, userID int64, video *models.VideoGeneration) error {
+	return s.recordUsage(ctx, chatID, userID, map[string]int64{
+		"video_jobs":    1,
+		"video_seconds": int64(video.Seconds),
+		fmt.Sprintf("video_seconds:%dx%d", video.Width, video.Height): int64(video.Seconds),
+	}, video.Cost)
+}
+
+func (s *RedisService) GetRoomUsage(ctx context.Context, chatID int64, from, to time.Time) (*models.UsageSummary, error) {
+	return s.sumUsage(ctx, from, to, func(day string) string { return roomUsageKey(chatID, day) })
+}
+
+func (s *RedisService) GetUserUsage(ctx context.Context, userID int64, from, to time.Time) (*models.UsageSummary, error) {
+	return s.sumUsage(ctx, from, to, func(day string) string { return userUsageKey(userID, day) })
+}
+
+func (s *RedisService) GetRoomUserUsage(ctx context.Context, chatID, userID int64, from, to time.Time) (*models.UsageSummary, error) {
+	return s.sumUsage(ctx, from, to, func(day string) string { return roomUserUsageKey(chatID, userID, day) })
+}
+
+// GetUsageRooms 回傳曾經記錄過用量的聊天室 ID。
+func (s *RedisService) GetUsageRooms(ctx context.Context) ([]int64, error) {
+	members, err := s.client.SMembers(ctx, usageRoomsKey).Result()
+	if err != nil {
+		return nil, fmt.Errorf("獲取用量聊天室清單失敗: %w", err)
+	}
+	chatIDs := make([]int64, 0, len(members))
+	for _, m := range members {
+		id, err := strconv.ParseInt(m, 10, 64)
+		if err != nil {
+			continue
+		}
+		chatIDs = append(chatIDs, id)
+	}
+	return chatIDs, nil
+}
+
+func (s *RedisService) sumUsage(ctx context.Context, from, to time.Time, keyFor func(day string) string) (*models.UsageSummary, error) {
+	summary := &models.UsageSummary{
+		From: from.Format(usageDateLayout),
+		To:   to.Format(usageDateLayout),
+	}
+	if to.Before(from) {
+		return summary, nil
+	}
+
+	pipe := s.client.Pipeline()
+	var cmds []*redis.MapStringStringCmd
+	for day := from; !day.After(to); day = day.AddDate(0, 0, 1) {
+		cmds = append(cmds, pipe.HGetAll(ctx, keyFor(day.Format(usageDateLayout))))
+	}
+	if _, err := pipe.Exec(ctx); err != nil && err != redis.Nil {
+		return nil, fmt.Errorf("讀取用量失敗: %w", err)
+	}
+
+	for _, cmd := range cmds {
+		for field, raw := range cmd.Val() {
+			if field == "cost" {
+				if cost, err := strconv.ParseFloat(raw, 64); err == nil {
+					summary.EstimatedCost += cost
+				}
+				continue
+			}
+			value, err := strconv.ParseInt(raw, 10, 64)
+			if err != nil {
+				continue
+			}
+			switch field {
+			case "requests":
+				summary.Requests += value
+			case "fallback_requests":
+				summary.FallbackRequests += value
+			case "prompt_tokens":
+				summary.PromptTokens += value
+			case "completion_tokens":
+				summary.CompletionTokens += value
+			case "total_tokens":
+				summary.TotalTokens += value
+			case "video_jobs":
+				summary.VideoJobs += value
+			case "video_seconds":
+				summary.VideoSeconds += value
+			default:
+				if deployment, ok := strings.CutPrefix(field, "requests:"); ok {
+					if summary.RequestsByDeployment == nil {
+						summary.RequestsByDeployment = make(map[string]int64)
+					}
+					summary.RequestsByDeployment[deployment] += value
+				}
+				if resolution, ok := strings.CutPrefix(field, "video_seconds:"); ok {
+					if summary.VideoSecondsByResolution == nil {
+						summary.VideoSecondsByResolution = make(map[string]int64)
+					}
+					summary.VideoSecondsByResolution[resolution] += value
+				}
+			}
+		}
+	}
+	return summary, nil
+}
+
+// MarkQuotaWarned 以 SETNX 標記額度警告已發送，回傳 true 表示這是本期間第一次。
+func (s *RedisService) MarkQuotaWarned(ctx context.Context, chatID int64, unit, period string, threshold float64, ttl time.Duration) (bool, error) {
+	key := fmt.Sprintf("quota_warned:%d:%s:%s:%g", chatID, unit, period, threshold)
+	ok, err := s.client.SetNX(ctx, key, 1, ttl).Result()
+	if err != nil {
+		return false, fmt.Errorf("標記額度警告失敗: %w", err)
+	}
+	return ok, nil
+}
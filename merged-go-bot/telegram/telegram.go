@@ -0,0 +1,163 @@
+// Package telegram 補足 tgbotapi v5.5.1 尚未支援的 Bot API 欄位，例如論壇主題 (forum topic)。
+package telegram
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+)
+
+// Topic 描述訊息所在的論壇主題。Name 只有在訊息回覆主題的建立訊息時才知道。
+type Topic struct {
+	ThreadID int
+	Name     string
+}
+
+// Extra 為 tgbotapi.Message 沒有解析的欄位。
+type Extra struct {
+	// Topic.ThreadID 為 0 表示不是論壇主題中的訊息
+	Topic Topic
+	// Quote 為使用者回覆時引用的片段
+	Quote string
+}
+
+// rawMessage 只解析 tgbotapi.Message 沒有的欄位。
+type rawMessage struct {
+	MessageThreadID int  `json:"message_thread_id"`
+	IsTopicMessage  bool `json:"is_topic_message"`
+	ReplyToMessage  *struct {
+		MessageID         int `json:"message_id"`
+		ForumTopicCreated *struct {
+			Name string `json:"name"`
+		} `json:"forum_topic_created"`
+	} `json:"reply_to_message"`
+	ForumTopicEdited *struct {
+		Name string `json:"name"`
+	} `json:"forum_topic_edited"`
+	Quote *struct {
+		Text string `json:"text"`
+	} `json:"quote"`
+}
+
+// ParseExtra 從原始的 message JSON 取出論壇主題與引用片段。
+// 主題中的每則訊息都會以 reply_to_message 指向主題的建立訊息，這個回覆關係會從 message 中移除，
+// 以免被當成使用者真正的回覆。
+func ParseExtra(raw json.RawMessage, message *tgbotapi.Message) Extra {
+	if len(raw) == 0 || message == nil {
+		return Extra{}
+	}
+	var m rawMessage
+	if err := json.Unmarshal(raw, &m); err != nil {
+		return Extra{}
+	}
+	var extra Extra
+	if m.Quote != nil {
+		extra.Quote = m.Quote.Text
+	}
+	if !m.IsTopicMessage || m.MessageThreadID == 0 {
+		return extra
+	}
+
+	topic := Topic{ThreadID: m.MessageThreadID}
+	if reply := m.ReplyToMessage; reply != nil && reply.MessageID == m.MessageThreadID {
+		if reply.ForumTopicCreated != nil {
+			topic.Name = reply.ForumTopicCreated.Name
+		}
+		message.ReplyToMessage = nil
+	}
+	if m.ForumTopicEdited != nil && m.ForumTopicEdited.Name != "" {
+		topic.Name = m.ForumTopicEdited.Name
+	}
+	extra.Topic = topic
+	return extra
+}
+
+type topicKey struct{}
+
+// WithTopic 讓之後以 Send 發送的訊息都發到同一個主題。
+func WithTopic(ctx context.Context, threadID int) context.Context {
+	if threadID == 0 {
+		return ctx
+	}
+	return context.WithValue(ctx, topicKey{}, threadID)
+}
+
+// TopicID 回傳 context 中的主題 ID，不在主題中時為 0。
+func TopicID(ctx context.Context) int {
+	id, _ := ctx.Value(topicKey{}).(int)
+	return id
+}
+
+// Send 與 bot.Send 相同，但 context 中有主題時會加上 message_thread_id。
+// tgbotapi 的請求參數無法從外部擴充，因此對用到的訊息類型自行組合參數。
+func Send(ctx context.Context, bot *tgbotapi.BotAPI, c tgbotapi.Chattable) (tgbotapi.Message, error) {
+	threadID := TopicID(ctx)
+	if threadID == 0 {
+		return bot.Send(c)
+	}
+
+	switch m := c.(type) {
+	case tgbotapi.MessageConfig:
+		params, err := baseParams(m.BaseChat, threadID)
+		if err != nil {
+			return tgbotapi.Message{}, err
+		}
+		params.AddNonEmpty("text", m.Text)
+		params.AddNonEmpty("parse_mode", m.ParseMode)
+		params.AddBool("disable_web_page_preview", m.DisableWebPagePreview)
+		if len(m.Entities) > 0 {
+			if err := params.AddInterface("entities", m.Entities); err != nil {
+				return tgbotapi.Message{}, err
+			}
+		}
+		return decode(bot.MakeRequest("sendMessage", params))
+	case tgbotapi.VideoConfig:
+		params, err := baseParams(m.BaseChat, threadID)
+		if err != nil {
+			return tgbotapi.Message{}, err
+		}
+		params.AddNonZero("duration", m.Duration)
+		params.AddNonEmpty("caption", m.Caption)
+		params.AddNonEmpty("parse_mode", m.ParseMode)
+		params.AddBool("supports_streaming", m.SupportsStreaming)
+		return decode(bot.UploadFiles("sendVideo", params, []tgbotapi.RequestFile{{Name: "video", Data: m.File}}))
+	case tgbotapi.DocumentConfig:
+		params, err := baseParams(m.BaseChat, threadID)
+		if err != nil {
+			return tgbotapi.Message{}, err
+		}
+		params.AddNonEmpty("caption", m.Caption)
+		params.AddNonEmpty("parse_mode", m.ParseMode)
+		return decode(bot.UploadFiles("sendDocument", params, []tgbotapi.RequestFile{{Name: "document", Data: m.File}}))
+	}
+	// 編輯、刪除等以訊息 ID 指定目標的請求不需要主題
+	return bot.Send(c)
+}
+
+func baseParams(chat tgbotapi.BaseChat, threadID int) (tgbotapi.Params, error) {
+	params := make(tgbotapi.Params)
+	if err := params.AddFirstValid("chat_id", chat.ChatID, chat.ChannelUsername); err != nil {
+		return nil, err
+	}
+	params.AddNonZero("message_thread_id", threadID)
+	params.AddNonZero("reply_to_message_id", chat.ReplyToMessageID)
+	params.AddBool("disable_notification", chat.DisableNotification)
+	params.AddBool("allow_sending_without_reply", chat.AllowSendingWithoutReply)
+	if err := params.AddInterface("reply_markup", chat.ReplyMarkup); err != nil {
+		return nil, err
+	}
+	return params, nil
+}
+
+func decode(resp *tgbotapi.APIResponse, err error) (tgbotapi.Message, error) {
+	if err != nil {
+		return tgbotapi.Message{}, err
+	}
+	var message tgbotapi.Message
+	if err := json.Unmarshal(resp.Result, &message); err != nil {
+		return tgbotapi.Message{}, fmt.Errorf("解析 Telegram 回應失敗: %w", err)
+	}
+	return message, nil
+}